@@ -0,0 +1,182 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"sync"
+	"time"
+
+	"go.k6.io/k6/metrics"
+)
+
+// trendSummary describes the distribution of the samples of a trend metric with the same tags within one flush.
+type trendSummary struct {
+	Count uint64  `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+}
+
+// trendAggregate is the summary of a time series, stamped with the time of its latest sample.
+type trendAggregate struct {
+	series  metrics.TimeSeries
+	time    time.Time
+	summary trendSummary
+}
+
+// aggregateTrends replaces the samples of trend metrics by one summary per time series, i.e. per metric and tag
+// set. The other samples are returned unchanged. Percentiles are computed like in the end-of-test summary of k6.
+func aggregateTrends(samples []metrics.Sample) ([]metrics.Sample, []trendAggregate) {
+	sinks := make(map[metrics.TimeSeries]*metrics.TrendSink)
+	latest := make(map[metrics.TimeSeries]time.Time)
+	// keeps the order of the first occurrence so that the documents are indexed in a stable order
+	var series []metrics.TimeSeries
+	rest := samples[:0:0]
+	for _, sample := range samples {
+		if sample.Metric.Type != metrics.Trend {
+			rest = append(rest, sample)
+			continue
+		}
+		sink, ok := sinks[sample.TimeSeries]
+		if !ok {
+			sink = metrics.NewTrendSink()
+			sinks[sample.TimeSeries] = sink
+			series = append(series, sample.TimeSeries)
+		}
+		sink.Add(sample)
+		if sample.Time.After(latest[sample.TimeSeries]) {
+			latest[sample.TimeSeries] = sample.Time
+		}
+	}
+
+	aggregates := make([]trendAggregate, 0, len(series))
+	for _, ts := range series {
+		sink := sinks[ts]
+		aggregates = append(aggregates, trendAggregate{
+			series: ts,
+			time:   latest[ts],
+			summary: trendSummary{
+				Count: sink.Count(),
+				Min:   sink.Min(),
+				Max:   sink.Max(),
+				Avg:   sink.Avg(),
+				P50:   sink.P(0.5),
+				P90:   sink.P(0.9),
+				P95:   sink.P(0.95),
+				P99:   sink.P(0.99),
+			},
+		})
+	}
+	return rest, aggregates
+}
+
+// testSummary aggregates the samples of every metric over the whole test, like the end-of-test summary of k6.
+type testSummary struct {
+	mu    sync.Mutex
+	start time.Time
+	sinks map[*metrics.Metric]metrics.Sink
+	// keeps the order of the first occurrence so that the documents are indexed in a stable order
+	metrics []*metrics.Metric
+	// an empty tag set, the summary covers all tags of a metric
+	tags *metrics.TagSet
+}
+
+func newTestSummary() *testSummary {
+	return &testSummary{start: time.Now(), sinks: make(map[*metrics.Metric]metrics.Sink)}
+}
+
+func (s *testSummary) add(samples []metrics.SampleContainer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, container := range samples {
+		for _, sample := range container.GetSamples() {
+			sink, ok := s.sinks[sample.Metric]
+			if !ok {
+				sink = metrics.NewSink(sample.Metric.Type)
+				s.sinks[sample.Metric] = sink
+				s.metrics = append(s.metrics, sample.Metric)
+			}
+			sink.Add(sample)
+			if s.tags == nil {
+				s.tags = withoutTags(sample.Tags)
+			}
+		}
+	}
+}
+
+// metricSummary is the end-of-test summary of a metric. Its value is the one k6 shows first in its summary.
+type metricSummary struct {
+	series  metrics.TimeSeries
+	value   float64
+	summary map[string]float64
+}
+
+// summaries returns the summary of every metric that had samples until end.
+func (s *testSummary) summaries(end time.Time) []metricSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	duration := end.Sub(s.start).Seconds()
+	result := make([]metricSummary, 0, len(s.metrics))
+	for _, metric := range s.metrics {
+		summary := metricSummary{series: metrics.TimeSeries{Metric: metric, Tags: s.tags}}
+		switch sink := s.sinks[metric].(type) {
+		case *metrics.CounterSink:
+			summary.value = sink.Value
+			summary.summary = map[string]float64{"count": sink.Value, "rate": sink.Value / duration}
+		case *metrics.GaugeSink:
+			summary.value = sink.Value
+			summary.summary = map[string]float64{"value": sink.Value, "min": sink.Min, "max": sink.Max}
+		case *metrics.RateSink:
+			var rate float64
+			if sink.Total > 0 {
+				rate = float64(sink.Trues) / float64(sink.Total)
+			}
+			summary.value = rate
+			summary.summary = map[string]float64{"rate": rate, "passes": float64(sink.Trues),
+				"fails": float64(sink.Total - sink.Trues)}
+		case *metrics.TrendSink:
+			summary.value = sink.Avg()
+			summary.summary = map[string]float64{"count": float64(sink.Count()), "min": sink.Min(),
+				"max": sink.Max(), "avg": sink.Avg(), "p50": sink.P(0.5), "p90": sink.P(0.9), "p95": sink.P(0.95),
+				"p99": sink.P(0.99)}
+		default:
+			continue
+		}
+		result = append(result, summary)
+	}
+	return result
+}
+
+// withoutTags returns the empty tag set of the tag set tags belongs to.
+func withoutTags(tags *metrics.TagSet) *metrics.TagSet {
+	for name := range tags.Map() {
+		tags = tags.Without(name)
+	}
+	return tags
+}
@@ -0,0 +1,107 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"go.k6.io/k6/metrics"
+)
+
+func TestAggregateTrends(t *testing.T) {
+	registry := metrics.NewRegistry()
+	duration := registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time)
+	reqs := registry.MustNewMetric("http_reqs", metrics.Counter)
+	fast := metrics.TimeSeries{Metric: duration, Tags: registry.RootTagSet().With("name", "fast")}
+	slow := metrics.TimeSeries{Metric: duration, Tags: registry.RootTagSet().With("name", "slow")}
+
+	// 1 to 1000 for the slow requests and 1 to 100 for the fast ones in random order
+	start := time.Now()
+	var samples []metrics.Sample
+	for i, v := range rand.New(rand.NewSource(1)).Perm(1000) {
+		at := start.Add(time.Duration(i) * time.Millisecond)
+		samples = append(samples, metrics.Sample{TimeSeries: slow, Time: at, Value: float64(v + 1)})
+		if v < 100 {
+			samples = append(samples, metrics.Sample{TimeSeries: fast, Time: at, Value: float64(v + 1)})
+		}
+		if i%100 == 0 {
+			samples = append(samples, metrics.Sample{TimeSeries: metrics.TimeSeries{Metric: reqs,
+				Tags: registry.RootTagSet()}, Time: at, Value: 1})
+		}
+	}
+
+	rest, aggregates := aggregateTrends(samples)
+	if len(rest) != 10 {
+		t.Errorf("got %d samples of other metrics, want the 10 counter samples", len(rest))
+	}
+	for _, sample := range rest {
+		if sample.Metric != reqs {
+			t.Errorf("got a sample of %s, want only the counter samples", sample.Metric.Name)
+		}
+	}
+	if len(aggregates) != 2 {
+		t.Fatalf("got %d aggregates, want one per time series", len(aggregates))
+	}
+
+	tests := []struct {
+		series metrics.TimeSeries
+		want   trendSummary
+	}{
+		{slow, trendSummary{Count: 1000, Min: 1, Max: 1000, Avg: 500.5, P50: 500.5, P90: 900.1, P95: 950.05, P99: 990.01}},
+		{fast, trendSummary{Count: 100, Min: 1, Max: 100, Avg: 50.5, P50: 50.5, P90: 90.1, P95: 95.05, P99: 99.01}},
+	}
+	for i, tt := range tests {
+		got := aggregates[i]
+		if got.series != tt.series {
+			t.Errorf("aggregate %d: got the series %v, want %v", i, got.series.Tags.Map(), tt.series.Tags.Map())
+			continue
+		}
+		if got.summary.Count != tt.want.Count {
+			t.Errorf("%v: got count %d, want %d", tt.series.Tags.Map(), got.summary.Count, tt.want.Count)
+		}
+		for _, stat := range []struct {
+			name      string
+			got, want float64
+		}{
+			{"min", got.summary.Min, tt.want.Min},
+			{"max", got.summary.Max, tt.want.Max},
+			{"avg", got.summary.Avg, tt.want.Avg},
+			{"p50", got.summary.P50, tt.want.P50},
+			{"p90", got.summary.P90, tt.want.P90},
+			{"p95", got.summary.P95, tt.want.P95},
+			{"p99", got.summary.P99, tt.want.P99},
+		} {
+			if math.Abs(stat.got-stat.want) > 0.01*stat.want {
+				t.Errorf("%v: got %s %g, want %g", tt.series.Tags.Map(), stat.name, stat.got, stat.want)
+			}
+		}
+	}
+	if want := start.Add(999 * time.Millisecond); !aggregates[0].time.Equal(want) {
+		t.Errorf("got the aggregate stamped with %s, want the time of the latest sample %s", aggregates[0].time, want)
+	}
+}
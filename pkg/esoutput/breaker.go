@@ -0,0 +1,129 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// States of the circuit breaker.
+const (
+	// flushes and bulk requests go through
+	breakerClosed = "closed"
+	// nothing is sent until the cooldown has passed
+	breakerOpen = "open"
+	// the next flush tests whether the cluster has recovered
+	breakerHalfOpen = "half-open"
+)
+
+var errCircuitOpen = errors.New("the circuit breaker is open, the request was not sent")
+
+// circuitBreaker pauses flushing for circuitBreakerCooldown once circuitBreakerAfter flushes in a row have failed,
+// so that a struggling cluster can recover. Samples stay in the buffer meanwhile, where maxBufferedSamples and
+// bufferOverflow apply. Afterwards, a single flush tests the cluster and closes the breaker again if it succeeds.
+type circuitBreaker struct {
+	after    int64
+	cooldown time.Duration
+	logger   logrus.FieldLogger
+
+	mu    sync.Mutex
+	state string
+	// the number of flushes that have failed in a row
+	failures int64
+	opened   time.Time
+}
+
+func newCircuitBreaker(config Config, logger logrus.FieldLogger) *circuitBreaker {
+	return &circuitBreaker{
+		after:    config.CircuitBreakerAfter.Int64,
+		cooldown: time.Duration(config.CircuitBreakerCooldown.Duration),
+		logger:   logger,
+		state:    breakerClosed,
+	}
+}
+
+// allow reports whether samples may be sent. It half-opens the breaker once the cooldown has passed.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen {
+		if time.Since(b.opened) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.logger.Infof("Elasticsearch: circuit breaker half-open, testing whether the cluster has recovered")
+	}
+	return true
+}
+
+// flushFinished is used in OnFlushEnd of the bulk indexer. It opens the breaker after enough failed flushes in a
+// row, or right away if the test flush of the half-open breaker failed.
+func (b *circuitBreaker) flushFinished(ctx context.Context) {
+	sent, failed := flushOutcome(ctx)
+	if !sent {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		if b.state == breakerHalfOpen {
+			b.logger.Infof("Elasticsearch: circuit breaker closed, the cluster has recovered")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.after) {
+		b.state = breakerOpen
+		b.opened = time.Now()
+		b.logger.Warnf("Elasticsearch: circuit breaker open after %d failed flushes in a row, pausing flushes for %s",
+			b.failures, b.cooldown)
+	}
+}
+
+// circuitBreakerTransport fails bulk requests right away while the breaker is open, e.g. for documents that the
+// bulk indexer held when it opened.
+type circuitBreakerTransport struct {
+	next    http.RoundTripper
+	breaker *circuitBreaker
+}
+
+func (t *circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/_bulk") && !t.breaker.allow() {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, errCircuitOpen
+	}
+	return t.next.RoundTrip(req)
+}
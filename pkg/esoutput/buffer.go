@@ -0,0 +1,90 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"sync"
+
+	"go.k6.io/k6/metrics"
+)
+
+// Strategies for handling samples once the buffer is full.
+const (
+	overflowDropOldest = "drop-oldest"
+	overflowDropNewest = "drop-newest"
+)
+
+// sampleBuffer holds the samples between two flushes. Unlike output.SampleBuffer, it can be bounded so that a
+// slow cluster doesn't make the buffer grow until the runner runs out of memory.
+type sampleBuffer struct {
+	mu      sync.Mutex
+	samples []metrics.Sample
+	// the maximum number of buffered samples, 0 means unbounded
+	max        int
+	dropOldest bool
+}
+
+func newSampleBuffer(max int64, overflow string) *sampleBuffer {
+	return &sampleBuffer{max: int(max), dropOldest: overflow == overflowDropOldest}
+}
+
+// add appends the samples of the containers and returns the number of buffered samples as well as the number of
+// samples that were dropped because the buffer is full.
+func (b *sampleBuffer) add(containers []metrics.SampleContainer) (buffered int, dropped int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, container := range containers {
+		for _, sample := range container.GetSamples() {
+			if b.max > 0 && len(b.samples) >= b.max {
+				dropped++
+				if !b.dropOldest {
+					continue
+				}
+				b.samples[0] = metrics.Sample{}
+				b.samples = b.samples[1:]
+			}
+			b.samples = append(b.samples, sample)
+		}
+	}
+	return len(b.samples), dropped
+}
+
+// take returns all buffered samples and empties the buffer.
+func (b *sampleBuffer) take() []metrics.Sample {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	samples := b.samples
+	b.samples = nil
+	return samples
+}
+
+// len returns the number of buffered samples.
+func (b *sampleBuffer) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.samples)
+}
@@ -0,0 +1,93 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSampleBufferIsBounded(t *testing.T) {
+	tests := []struct {
+		overflow string
+		want     []float64
+	}{
+		{overflow: overflowDropOldest, want: []float64{7, 8, 9, 10, 11}},
+		{overflow: overflowDropNewest, want: []float64{0, 1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.overflow, func(t *testing.T) {
+			b := newSampleBuffer(5, tt.overflow)
+			samples := newTestSamples(12)
+			var dropped int
+			for i := 0; i < len(samples); i += 4 {
+				buffered, n := b.add(samples[i : i+4])
+				if buffered > 5 {
+					t.Fatalf("got %d buffered samples, want at most 5", buffered)
+				}
+				dropped += n
+			}
+			if dropped != 7 {
+				t.Errorf("got %d dropped samples, want 7", dropped)
+			}
+			var values []float64
+			for _, sample := range b.take() {
+				values = append(values, sample.Value)
+			}
+			if !reflect.DeepEqual(values, tt.want) {
+				t.Errorf("got the samples %v buffered, want %v", values, tt.want)
+			}
+			if b.len() != 0 {
+				t.Errorf("got %d samples left after take", b.len())
+			}
+		})
+	}
+}
+
+func TestFullBufferDropsAreCounted(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o, hook := newTestOutputWithLogs(t, cluster, "maxBufferedSamples=5")
+	o.AddMetricSamples(newTestSamples(4))
+	o.AddMetricSamples(newTestSamples(4))
+	o.AddMetricSamples(newTestSamples(4))
+
+	if n := o.buffer.len(); n != 5 {
+		t.Errorf("got %d buffered samples, want 5", n)
+	}
+	if n := o.stats.droppedFor(dropReasonBufferFull); n != 7 {
+		t.Errorf("got %d samples dropped for a full buffer, want 7", n)
+	}
+	warnings := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.WarnLevel {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("got %d warnings, want one the first time the buffer is full", warnings)
+	}
+}
@@ -25,52 +25,758 @@
 package esoutput
 
 import (
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/guregu/null/v5"
 
 	"github.com/kubernetes/helm/pkg/strvals"
 	"go.k6.io/k6/lib/types"
+	"go.k6.io/k6/metrics"
 )
 
 const (
-	defaultFlushPeriod = time.Second
-	defaultIndexName   = "k6-metrics"
+	// shorter flush periods mostly produce tiny bulk requests that put load on the cluster
+	minFlushPeriod         = 100 * time.Millisecond
+	defaultFlushPeriod     = time.Second
+	defaultIndexName       = "k6-metrics"
+	defaultMaxBatchSize    = 5000
+	defaultTimestampField  = "Time"
+	defaultValueField      = "Value"
+	defaultMetricNameField = "MetricName"
+	// same as the default of the go-elasticsearch bulk indexer
+	defaultMaxBatchBytes          = 5_000_000
+	defaultMaxRetries             = 3
+	defaultRetryBackoff           = 100 * time.Millisecond
+	defaultRequestTimeout         = 30 * time.Second
+	defaultShutdownFlushTimeout   = 30 * time.Second
+	defaultFailoverAfter          = 3
+	defaultCircuitBreakerCooldown = 30 * time.Second
+	defaultStartupRetryDelay      = 2 * time.Second
+	// the level gzip uses by default, a good balance of speed and ratio
+	defaultCompressionLevel = 6
+	// same as http.DefaultTransport
+	defaultIdleConnTimeout = 90 * time.Second
 )
 
 type Config struct {
-	Url                null.String `json:"url" envconfig:"K6_ELASTICSEARCH_URL"`
-	CloudID            null.String `json:"cloud-id"  envconfig:"K6_ELASTICSEARCH_CLOUD_ID"`
-	CACert             null.String `json:"caCertFile" envconfig:"K6_ELASTICSEARCH_CA_CERT_FILE"`
-	InsecureSkipVerify null.Bool   `json:"insecureSkipVerify" envconfig:"K6_ELASTICSEARCH_INSECURE_SKIP_VERIFY"`
+	Url                    null.String        `json:"url" envconfig:"K6_ELASTICSEARCH_URL"`
+	CloudID                null.String        `json:"cloud-id"  envconfig:"K6_ELASTICSEARCH_CLOUD_ID"`
+	FallbackUrl            null.String        `json:"fallbackUrl" envconfig:"K6_ELASTICSEARCH_FALLBACK_URL"`
+	FallbackCloudID        null.String        `json:"fallbackCloudId" envconfig:"K6_ELASTICSEARCH_FALLBACK_CLOUD_ID"`
+	FailoverAfter          null.Int           `json:"failoverAfter" envconfig:"K6_ELASTICSEARCH_FAILOVER_AFTER"`
+	CircuitBreakerAfter    null.Int           `json:"circuitBreakerAfter" envconfig:"K6_ELASTICSEARCH_CIRCUIT_BREAKER_AFTER"`
+	CircuitBreakerCooldown types.NullDuration `json:"circuitBreakerCooldown" envconfig:"K6_ELASTICSEARCH_CIRCUIT_BREAKER_COOLDOWN"`
+	OpenSearchCompat       null.Bool          `json:"openSearchCompat" envconfig:"K6_ELASTICSEARCH_OPENSEARCH_COMPAT"`
+	Serverless             null.Bool          `json:"serverless" envconfig:"K6_ELASTICSEARCH_SERVERLESS"`
+	DisableProductCheck    null.Bool          `json:"disableProductCheck" envconfig:"K6_ELASTICSEARCH_DISABLE_PRODUCT_CHECK"`
+	CompatibilityMode      null.Bool          `json:"compatibilityMode" envconfig:"K6_ELASTICSEARCH_COMPAT_HEADER"`
+	VerifyConnection       null.Bool          `json:"verifyConnection" envconfig:"K6_ELASTICSEARCH_VERIFY_CONNECTION"`
+	StartupRetries         null.Int           `json:"startupRetries" envconfig:"K6_ELASTICSEARCH_STARTUP_RETRIES"`
+	StartupRetryDelay      types.NullDuration `json:"startupRetryDelay" envconfig:"K6_ELASTICSEARCH_STARTUP_RETRY_DELAY"`
+	CACert                 null.String        `json:"caCertFile" envconfig:"K6_ELASTICSEARCH_CA_CERT_FILE"`
+	CACertPEM              null.String        `json:"caCertPem" envconfig:"K6_ELASTICSEARCH_CA_CERT_PEM"`
+	InsecureSkipVerify     null.Bool          `json:"insecureSkipVerify" envconfig:"K6_ELASTICSEARCH_INSECURE_SKIP_VERIFY"`
+	TLSMinVersion          null.String        `json:"tlsMinVersion" envconfig:"K6_ELASTICSEARCH_TLS_MIN_VERSION"`
+	TLSCipherSuites        []string           `json:"tlsCipherSuites" envconfig:"K6_ELASTICSEARCH_TLS_CIPHER_SUITES"`
+	Proxy                  null.String        `json:"proxy" envconfig:"K6_ELASTICSEARCH_PROXY"`
 
 	ClientCert null.String `json:"clientCertFile" envconfig:"K6_ELASTICSEARCH_CLIENT_CERT_FILE"`
 	ClientKey  null.String `json:"clientKeyFile" envconfig:"K6_ELASTICSEARCH_CLIENT_KEY_FILE"`
 
 	User                null.String `json:"user" envconfig:"K6_ELASTICSEARCH_USER"`
 	Password            null.String `json:"password" envconfig:"K6_ELASTICSEARCH_PASSWORD"`
+	PasswordFile        null.String `json:"passwordFile" envconfig:"K6_ELASTICSEARCH_PASSWORD_FILE"`
 	APIKey              null.String `json:"apiKey" envconfig:"K6_ELASTICSEARCH_API_KEY"`
+	APIKeyFile          null.String `json:"apiKeyFile" envconfig:"K6_ELASTICSEARCH_API_KEY_FILE"`
 	ServiceAccountToken null.String `json:"serviceAccountToken" envconfig:"K6_ELASTICSEARCH_SERVICE_ACCOUNT_TOKEN"`
 
-	FlushPeriod types.NullDuration `json:"flushPeriod" envconfig:"K6_ELASTICSEARCH_FLUSH_PERIOD"`
-	IndexName   null.String        `json:"indexName" envconfig:"K6_ELASTICSEARCH_INDEX_NAME"`
+	FlushPeriod         types.NullDuration `json:"flushPeriod" envconfig:"K6_ELASTICSEARCH_FLUSH_PERIOD"`
+	MaxBatchSize        null.Int           `json:"maxBatchSize" envconfig:"K6_ELASTICSEARCH_MAX_BATCH_SIZE"`
+	MaxBatchBytes       null.Int           `json:"maxBatchBytes" envconfig:"K6_ELASTICSEARCH_MAX_BATCH_BYTES"`
+	BulkPerIndex        null.Bool          `json:"bulkPerIndex" envconfig:"K6_ELASTICSEARCH_BULK_PER_INDEX"`
+	FlushTrigger        null.String        `json:"flushTrigger" envconfig:"K6_ELASTICSEARCH_FLUSH_TRIGGER"`
+	MaxBufferedSamples  null.Int           `json:"maxBufferedSamples" envconfig:"K6_ELASTICSEARCH_MAX_BUFFER"`
+	BufferOverflow      null.String        `json:"bufferOverflow" envconfig:"K6_ELASTICSEARCH_BUFFER_OVERFLOW"`
+	FailOnDrop          null.Bool          `json:"failOnDrop" envconfig:"K6_ELASTICSEARCH_FAIL_ON_DROP"`
+	PanicPolicy         null.String        `json:"panicPolicy" envconfig:"K6_ELASTICSEARCH_PANIC_POLICY"`
+	FastEncoder         null.Bool          `json:"fastEncoder" envconfig:"K6_ELASTICSEARCH_FAST_ENCODER"`
+	Concurrency         null.Int           `json:"concurrency" envconfig:"K6_ELASTICSEARCH_CONCURRENCY"`
+	MaxInFlightRequests null.Int           `json:"maxInFlightRequests" envconfig:"K6_ELASTICSEARCH_MAX_INFLIGHT"`
+
+	CompressRequestBody null.Bool `json:"compressRequestBody" envconfig:"K6_ELASTICSEARCH_COMPRESS"`
+	CompressionLevel    null.Int  `json:"compressionLevel" envconfig:"K6_ELASTICSEARCH_COMPRESSION_LEVEL"`
+
+	MaxRetries    null.Int           `json:"maxRetries" envconfig:"K6_ELASTICSEARCH_MAX_RETRIES"`
+	RetryBackoff  types.NullDuration `json:"retryBackoff" envconfig:"K6_ELASTICSEARCH_RETRY_BACKOFF"`
+	RetryJitter   null.Bool          `json:"retryJitter" envconfig:"K6_ELASTICSEARCH_RETRY_JITTER"`
+	RetryOnStatus []int              `json:"retryOnStatus" envconfig:"K6_ELASTICSEARCH_RETRY_ON_STATUS"`
+
+	RequestTimeout        types.NullDuration `json:"requestTimeout" envconfig:"K6_ELASTICSEARCH_REQUEST_TIMEOUT"`
+	ShutdownFlushTimeout  types.NullDuration `json:"shutdownFlushTimeout" envconfig:"K6_ELASTICSEARCH_SHUTDOWN_TIMEOUT"`
+	StatsInterval         types.NullDuration `json:"statsInterval" envconfig:"K6_ELASTICSEARCH_STATS_INTERVAL"`
+	MaxIdleConns          null.Int           `json:"maxIdleConns" envconfig:"K6_ELASTICSEARCH_MAX_IDLE_CONNS"`
+	IdleConnTimeout       types.NullDuration `json:"idleConnTimeout" envconfig:"K6_ELASTICSEARCH_IDLE_CONN_TIMEOUT"`
+	DiscoverNodesOnStart  null.Bool          `json:"discoverNodesOnStart" envconfig:"K6_ELASTICSEARCH_DISCOVER_NODES"`
+	DiscoverNodesInterval types.NullDuration `json:"discoverNodesInterval" envconfig:"K6_ELASTICSEARCH_DISCOVER_INTERVAL"`
+	UserAgent             null.String        `json:"userAgent" envconfig:"K6_ELASTICSEARCH_USER_AGENT"`
+	OpaqueIDPrefix        null.String        `json:"opaqueIdPrefix" envconfig:"K6_ELASTICSEARCH_OPAQUE_ID_PREFIX"`
+	Headers               map[string]string  `json:"headers" envconfig:"K6_ELASTICSEARCH_HEADERS"`
+	BulkParams            map[string]string  `json:"bulkParams" envconfig:"K6_ELASTICSEARCH_BULK_PARAMS"`
+
+	IndexName             null.String `json:"indexName" envconfig:"K6_ELASTICSEARCH_INDEX_NAME"`
+	UseSampleTimeForIndex null.Bool   `json:"useSampleTimeForIndex" envconfig:"K6_ELASTICSEARCH_USE_SAMPLE_TIME_FOR_INDEX"`
+	UseDataStream         null.Bool   `json:"useDataStream" envconfig:"K6_ELASTICSEARCH_USE_DATA_STREAM"`
+	TargetIsAlias         null.Bool   `json:"targetIsAlias" envconfig:"K6_ELASTICSEARCH_TARGET_IS_ALIAS"`
+	CreateIndex           null.Bool   `json:"createIndex" envconfig:"K6_ELASTICSEARCH_CREATE_INDEX"`
+	Pipeline              null.String `json:"pipeline" envconfig:"K6_ELASTICSEARCH_PIPELINE"`
+	Refresh               null.String `json:"refresh" envconfig:"K6_ELASTICSEARCH_REFRESH"`
+	WaitForActiveShards   null.String `json:"waitForActiveShards" envconfig:"K6_ELASTICSEARCH_WAIT_FOR_ACTIVE_SHARDS"`
+	EnsureIndexTemplate   null.Bool   `json:"ensureIndexTemplate" envconfig:"K6_ELASTICSEARCH_ENSURE_TEMPLATE"`
+	IndexTemplateName     null.String `json:"indexTemplateName" envconfig:"K6_ELASTICSEARCH_TEMPLATE_NAME"`
+
+	CustomFields map[string]string `json:"customFields" envconfig:"K6_ELASTICSEARCH_CUSTOM_FIELDS"`
+
+	IndexRouting indexRoutes `json:"indexRouting" envconfig:"K6_ELASTICSEARCH_INDEX_ROUTING"`
+	MarkerIndex  null.String `json:"markerIndex" envconfig:"K6_ELASTICSEARCH_MARKER_INDEX"`
+
+	TestRunID null.String `json:"testRunId" envconfig:"K6_ELASTICSEARCH_TEST_RUN_ID"`
+
+	IncludeMetrics     []string   `json:"includeMetrics" envconfig:"K6_ELASTICSEARCH_INCLUDE_METRICS"`
+	ExcludeMetrics     []string   `json:"excludeMetrics" envconfig:"K6_ELASTICSEARCH_EXCLUDE_METRICS"`
+	IncludeMetricTypes []string   `json:"includeMetricTypes" envconfig:"K6_ELASTICSEARCH_INCLUDE_METRIC_TYPES"`
+	ExcludeMetricTypes []string   `json:"excludeMetricTypes" envconfig:"K6_ELASTICSEARCH_EXCLUDE_METRIC_TYPES"`
+	SampleRate         null.Float `json:"sampleRate" envconfig:"K6_ELASTICSEARCH_SAMPLE_RATE"`
+	AggregateTrends    null.Bool  `json:"aggregateTrends" envconfig:"K6_ELASTICSEARCH_AGGREGATE_TRENDS"`
+	SummaryOnly        null.Bool  `json:"summaryOnly" envconfig:"K6_ELASTICSEARCH_SUMMARY_ONLY"`
+	OnlyBreaches       null.Bool  `json:"onlyBreaches" envconfig:"K6_ELASTICSEARCH_ONLY_BREACHES"`
+
+	DropTags          []string  `json:"dropTags" envconfig:"K6_ELASTICSEARCH_DROP_TAGS"`
+	KeepTags          []string  `json:"keepTags" envconfig:"K6_ELASTICSEARCH_KEEP_TAGS"`
+	PromoteTags       []string  `json:"promoteTags" envconfig:"K6_ELASTICSEARCH_PROMOTE_TAGS"`
+	PromoteVUFields   null.Bool `json:"promoteVUFields" envconfig:"K6_ELASTICSEARCH_PROMOTE_VU_FIELDS"`
+	GroupLevels       null.Bool `json:"groupLevels" envconfig:"K6_ELASTICSEARCH_GROUP_LEVELS"`
+	MetricMetadata    null.Bool `json:"metricMetadata" envconfig:"K6_ELASTICSEARCH_METRIC_METADATA"`
+	NumericTags       []string  `json:"numericTags" envconfig:"K6_ELASTICSEARCH_NUMERIC_TAGS"`
+	BooleanTags       []string  `json:"booleanTags" envconfig:"K6_ELASTICSEARCH_BOOLEAN_TAGS"`
+	MaxTagValueLength null.Int  `json:"maxTagValueLength" envconfig:"K6_ELASTICSEARCH_MAX_TAG_VALUE_LENGTH"`
+	SourceExclude     []string  `json:"sourceExclude" envconfig:"K6_ELASTICSEARCH_SOURCE_EXCLUDE"`
+
+	TimestampField     null.String `json:"timestampField" envconfig:"K6_ELASTICSEARCH_TIMESTAMP_FIELD"`
+	TimestampPrecision null.String `json:"timestampPrecision" envconfig:"K6_ELASTICSEARCH_TIMESTAMP_PRECISION"`
+	ValueField         null.String `json:"valueField" envconfig:"K6_ELASTICSEARCH_VALUE_FIELD"`
+	MetricNameField    null.String `json:"metricNameField" envconfig:"K6_ELASTICSEARCH_METRIC_NAME_FIELD"`
+	DocTypeField       null.String `json:"docTypeField" envconfig:"K6_ELASTICSEARCH_DOC_TYPE_FIELD"`
+	MetricPrefix       null.String `json:"metricPrefix" envconfig:"K6_ELASTICSEARCH_METRIC_PREFIX"`
+	ReplaceDots        null.Bool   `json:"replaceDots" envconfig:"K6_ELASTICSEARCH_REPLACE_DOTS"`
+	TagsFormat         null.String `json:"tagsFormat" envconfig:"K6_ELASTICSEARCH_TAGS_FORMAT"`
+
+	OpType          null.String `json:"opType" envconfig:"K6_ELASTICSEARCH_OP_TYPE"`
+	DocumentIDField null.String `json:"documentIdField" envconfig:"K6_ELASTICSEARCH_DOCUMENT_ID_FIELD"`
+	IDStrategy      null.String `json:"idStrategy" envconfig:"K6_ELASTICSEARCH_ID_STRATEGY"`
+	IDHash          null.String `json:"idHash" envconfig:"K6_ELASTICSEARCH_ID_HASH"`
+	RoutingField    null.String `json:"routingField" envconfig:"K6_ELASTICSEARCH_ROUTING_FIELD"`
+
+	ECSMode null.Bool `json:"ecs" envconfig:"K6_ELASTICSEARCH_ECS"`
+
+	DryRun       null.Bool   `json:"dryRun" envconfig:"K6_ELASTICSEARCH_DRY_RUN"`
+	DryRunFile   null.String `json:"dryRunFile" envconfig:"K6_ELASTICSEARCH_DRY_RUN_FILE"`
+	FileOutput   null.String `json:"fileOutput" envconfig:"K6_ELASTICSEARCH_FILE_OUTPUT"`
+	FileMaxBytes null.Int    `json:"fileMaxBytes" envconfig:"K6_ELASTICSEARCH_FILE_MAX_BYTES"`
+
+	// the variables referenced by the configuration that are not set, reported as warnings
+	undefinedVars []string
+	// the aliases of options that disagree with the options themselves, reported as warnings
+	aliasConflicts []string
 }
 
 func NewConfig() Config {
 	return Config{
-		Url:                 null.StringFrom("http://localhost:9200"),
-		CloudID:             null.NewString("", false),
-		APIKey:              null.NewString("", false),
-		CACert:              null.NewString("", false),
-		InsecureSkipVerify:  null.BoolFrom(false),
-		User:                null.NewString("", false),
-		Password:            null.NewString("", false),
-		ServiceAccountToken: null.NewString("", false),
-		FlushPeriod:         types.NullDurationFrom(defaultFlushPeriod),
-		IndexName:           null.StringFrom(defaultIndexName),
+		Url:                    null.StringFrom("http://localhost:9200"),
+		CloudID:                null.NewString("", false),
+		APIKey:                 null.NewString("", false),
+		CACert:                 null.NewString("", false),
+		CACertPEM:              null.NewString("", false),
+		InsecureSkipVerify:     null.BoolFrom(false),
+		User:                   null.NewString("", false),
+		Password:               null.NewString("", false),
+		ServiceAccountToken:    null.NewString("", false),
+		FlushPeriod:            types.NullDurationFrom(defaultFlushPeriod),
+		MaxBatchSize:           null.IntFrom(defaultMaxBatchSize),
+		MaxBatchBytes:          null.IntFrom(defaultMaxBatchBytes),
+		CompressRequestBody:    null.BoolFrom(false),
+		MaxRetries:             null.IntFrom(defaultMaxRetries),
+		RetryBackoff:           types.NullDurationFrom(defaultRetryBackoff),
+		RetryOnStatus:          []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		RequestTimeout:         types.NullDurationFrom(defaultRequestTimeout),
+		IndexName:              null.StringFrom(defaultIndexName),
+		UseDataStream:          null.BoolFrom(false),
+		TimestampField:         null.StringFrom(defaultTimestampField),
+		TimestampPrecision:     null.StringFrom(timestampMillis),
+		EnsureIndexTemplate:    null.BoolFrom(false),
+		IndexTemplateName:      null.StringFrom(defaultIndexName),
+		BufferOverflow:         null.StringFrom(overflowDropOldest),
+		ShutdownFlushTimeout:   types.NullDurationFrom(defaultShutdownFlushTimeout),
+		OpenSearchCompat:       null.BoolFrom(false),
+		Serverless:             null.BoolFrom(false),
+		ECSMode:                null.BoolFrom(false),
+		SampleRate:             null.FloatFrom(1),
+		AggregateTrends:        null.BoolFrom(false),
+		DisableProductCheck:    null.BoolFrom(false),
+		DryRun:                 null.BoolFrom(false),
+		IdleConnTimeout:        types.NullDurationFrom(defaultIdleConnTimeout),
+		VerifyConnection:       null.BoolFrom(true),
+		TagsFormat:             null.StringFrom(tagsFormatNested),
+		SummaryOnly:            null.BoolFrom(false),
+		ValueField:             null.StringFrom(defaultValueField),
+		MetricNameField:        null.StringFrom(defaultMetricNameField),
+		RetryJitter:            null.BoolFrom(false),
+		TargetIsAlias:          null.BoolFrom(false),
+		ReplaceDots:            null.BoolFrom(false),
+		OpaqueIDPrefix:         null.StringFrom("k6-"),
+		FailoverAfter:          null.IntFrom(defaultFailoverAfter),
+		CompressionLevel:       null.IntFrom(defaultCompressionLevel),
+		OnlyBreaches:           null.BoolFrom(false),
+		PanicPolicy:            null.StringFrom(panicPolicyRecover),
+		IDHash:                 null.StringFrom(idHashFNV),
+		CompatibilityMode:      null.BoolFrom(false),
+		PromoteVUFields:        null.BoolFrom(false),
+		FlushTrigger:           null.StringFrom(flushTriggerAny),
+		FailOnDrop:             null.BoolFrom(false),
+		UseSampleTimeForIndex:  null.BoolFrom(true),
+		StartupRetries:         null.IntFrom(0),
+		StartupRetryDelay:      types.NullDurationFrom(defaultStartupRetryDelay),
+		GroupLevels:            null.BoolFrom(false),
+		FastEncoder:            null.BoolFrom(false),
+		BulkPerIndex:           null.BoolFrom(false),
+		CircuitBreakerAfter:    null.IntFrom(0),
+		CircuitBreakerCooldown: types.NullDurationFrom(defaultCircuitBreakerCooldown),
+		FileMaxBytes:           null.IntFrom(0),
+		MaxTagValueLength:      null.IntFrom(0),
+		MetricMetadata:         null.BoolFrom(false),
+		CreateIndex:            null.BoolFrom(false),
+	}
+}
+
+// Validate checks the consolidated config for invalid or ambiguous settings.
+func (c Config) Validate() error {
+	if c.CloudID.String == "" && c.Url.String == "" {
+		return errors.New("either url or cloud-id must be configured to connect to Elasticsearch")
+	}
+	if c.CloudID.String != "" {
+		if _, err := cloudIDAddress(c.CloudID.String); err != nil {
+			return fmt.Errorf("invalid cloud-id: %w", err)
+		}
+	}
+
+	if c.FallbackUrl.Valid && c.FallbackCloudID.Valid {
+		return errors.New("only one of fallbackUrl or fallbackCloudId may be configured")
+	}
+	if c.FallbackUrl.Valid || c.FallbackCloudID.Valid {
+		if _, err := fallbackURL(c); err != nil {
+			return err
+		}
+	}
+	for name := range c.Headers {
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Content-Type", "Content-Encoding", "User-Agent", "X-Opaque-Id":
+			return fmt.Errorf("the header %s is set by the output and cannot be configured in headers", name)
+		}
+		if name == "" {
+			return errors.New("headers must not contain an empty header name")
+		}
+	}
+	if c.WaitForActiveShards.Valid && c.WaitForActiveShards.String != "all" {
+		if n, err := strconv.Atoi(c.WaitForActiveShards.String); err != nil || n < 1 {
+			return fmt.Errorf("waitForActiveShards must be all or a positive number but was %q",
+				c.WaitForActiveShards.String)
+		}
+	}
+	if err := validateBulkParams(c.BulkParams); err != nil {
+		return err
+	}
+	if c.FailoverAfter.Int64 <= 0 {
+		return fmt.Errorf("failoverAfter must be positive but was %d", c.FailoverAfter.Int64)
+	}
+	if c.CircuitBreakerAfter.Int64 < 0 {
+		return fmt.Errorf("circuitBreakerAfter must not be negative but was %d", c.CircuitBreakerAfter.Int64)
+	}
+	if c.CircuitBreakerCooldown.Duration <= 0 {
+		return fmt.Errorf("circuitBreakerCooldown must be positive but was %s", c.CircuitBreakerCooldown.Duration)
+	}
+
+	if c.Serverless.Bool {
+		if c.User.Valid || c.Password.Valid || c.ServiceAccountToken.Valid {
+			return errors.New("serverless projects only support apiKey authentication")
+		}
+		if !c.APIKey.Valid {
+			return errors.New("serverless projects require an apiKey")
+		}
+		if c.OpenSearchCompat.Bool {
+			return errors.New("serverless and openSearchCompat cannot be combined")
+		}
+		if c.CompatibilityMode.Bool {
+			return errors.New("serverless and compatibilityMode cannot be combined, serverless projects version their API by date")
+		}
+	}
+
+	basicAuth := c.User.Valid || c.Password.Valid
+	// client certificates authenticate as well if the deployment has a PKI realm
+	if c.CloudID.Valid && !c.APIKey.Valid && !c.ServiceAccountToken.Valid && !basicAuth && !c.ClientCert.Valid {
+		return errors.New("Elastic Cloud deployments require authentication, " +
+			"configure an apiKey (recommended), a serviceAccountToken or user and password together with the cloud-id")
+	}
+	// an API key wins over user and password with a warning on start, a service account token is ambiguous with both
+	if c.ServiceAccountToken.Valid && (c.APIKey.Valid || basicAuth) {
+		return errors.New("serviceAccountToken cannot be combined with apiKey or user/password " +
+			"(the client would otherwise silently prefer apiKey over serviceAccountToken over user/password)")
+	}
+	if c.User.Valid != c.Password.Valid {
+		return errors.New("user and password must be configured together for basic authentication")
+	}
+
+	if c.CACert.Valid {
+		if _, err := os.Stat(c.CACert.String); err != nil {
+			return fmt.Errorf("cannot read caCertFile: %v", err)
+		}
+	}
+	if c.InsecureSkipVerify.Bool && (c.CACert.Valid || c.CACertPEM.Valid) {
+		return errors.New("insecureSkipVerify cannot be combined with a CA certificate, " +
+			"either verify the certificate of the cluster or skip verification")
+	}
+
+	if _, ok := tlsVersions[c.TLSMinVersion.String]; c.TLSMinVersion.Valid && !ok {
+		return fmt.Errorf("tlsMinVersion must be 1.0, 1.1, 1.2 or 1.3 but was %q", c.TLSMinVersion.String)
+	}
+	if len(c.TLSCipherSuites) > 0 {
+		if c.TLSMinVersion.String == "1.3" {
+			return errors.New("tlsCipherSuites have no effect with tlsMinVersion 1.3, " +
+				"the cipher suites of TLS 1.3 are not configurable")
+		}
+		if _, err := cipherSuites(c.TLSCipherSuites); err != nil {
+			return fmt.Errorf("invalid tlsCipherSuites: %w", err)
+		}
+	}
+
+	if c.Proxy.Valid {
+		if _, err := proxyURL(c.Proxy.String); err != nil {
+			return err
+		}
+	}
+
+	if c.ClientCert.Valid != c.ClientKey.Valid {
+		return errors.New("clientCertFile and clientKeyFile must be configured together")
+	}
+
+	if err := validateIndexName(resolveIndexName(c.IndexName.String, time.Now())); err != nil {
+		return err
+	}
+	for _, route := range c.IndexRouting {
+		if _, err := path.Match(route.Metric, ""); err != nil || route.Metric == "" {
+			return fmt.Errorf("invalid metric pattern %q in indexRouting", route.Metric)
+		}
+		if err := validateIndexName(resolveIndexName(route.Index, time.Now())); err != nil {
+			return fmt.Errorf("invalid index for metric pattern %q in indexRouting: %v", route.Metric, err)
+		}
+	}
+	if c.SourceExclude != nil && len(c.SourceExclude) == 0 {
+		return errors.New("sourceExclude must list at least one field if it is set")
+	}
+	for _, field := range c.SourceExclude {
+		if strings.TrimSpace(field) == "" {
+			return errors.New("sourceExclude must not contain empty field names")
+		}
+	}
+	if c.MarkerIndex.Valid {
+		if err := validateIndexName(resolveIndexName(c.MarkerIndex.String, time.Now())); err != nil {
+			return fmt.Errorf("invalid markerIndex: %v", err)
+		}
+	}
+	if c.FlushPeriod.Duration <= 0 {
+		return fmt.Errorf("flushPeriod must be positive but was %s", c.FlushPeriod.Duration)
+	}
+	if c.EnsureIndexTemplate.Bool && c.IndexTemplateName.String == "" {
+		return errors.New("indexTemplateName must not be empty when ensureIndexTemplate is enabled")
+	}
+
+	if c.FileMaxBytes.Int64 < 0 {
+		return fmt.Errorf("fileMaxBytes must not be negative but was %d", c.FileMaxBytes.Int64)
+	}
+	if c.FileOutput.Valid && c.DryRunFile.Valid && c.FileOutput.String == c.DryRunFile.String {
+		return errors.New("fileOutput and dryRunFile must be different files")
+	}
+	if c.StartupRetries.Int64 < 0 {
+		return fmt.Errorf("startupRetries must not be negative but was %d", c.StartupRetries.Int64)
+	}
+	if c.StartupRetryDelay.Duration < 0 {
+		return fmt.Errorf("startupRetryDelay must not be negative but was %s", c.StartupRetryDelay.Duration)
+	}
+	if c.MaxBatchSize.Int64 < 0 {
+		return fmt.Errorf("maxBatchSize must not be negative but was %d", c.MaxBatchSize.Int64)
+	}
+	if c.MaxBatchBytes.Int64 <= 0 {
+		return fmt.Errorf("maxBatchBytes must be positive but was %d", c.MaxBatchBytes.Int64)
+	}
+	switch c.FlushTrigger.String {
+	case flushTriggerAny, flushTriggerTime, flushTriggerBytes:
+	case flushTriggerCount:
+		if c.MaxBatchSize.Int64 == 0 {
+			return errors.New("maxBatchSize must be positive with the count flushTrigger")
+		}
+	default:
+		return fmt.Errorf("flushTrigger must be %s, %s, %s or %s but was %q",
+			flushTriggerAny, flushTriggerTime, flushTriggerCount, flushTriggerBytes, c.FlushTrigger.String)
+	}
+	if _, err := metricTypes(c.IncludeMetricTypes); err != nil {
+		return fmt.Errorf("invalid includeMetricTypes: %w", err)
+	}
+	if _, err := metricTypes(c.ExcludeMetricTypes); err != nil {
+		return fmt.Errorf("invalid excludeMetricTypes: %w", err)
+	}
+	if c.SampleRate.Float64 < 0 || c.SampleRate.Float64 > 1 {
+		return fmt.Errorf("sampleRate must be between 0 and 1 but was %g", c.SampleRate.Float64)
+	}
+	if c.SummaryOnly.Bool && (c.SampleRate.Float64 < 1 || c.AggregateTrends.Bool) {
+		return errors.New("summaryOnly aggregates all samples and cannot be combined with sampleRate or aggregateTrends")
+	}
+	if c.OnlyBreaches.Bool && c.SummaryOnly.Bool {
+		return errors.New("onlyBreaches and summaryOnly cannot be combined")
+	}
+	if c.MaxBufferedSamples.Int64 < 0 {
+		return fmt.Errorf("maxBufferedSamples must not be negative but was %d", c.MaxBufferedSamples.Int64)
+	}
+	if c.Concurrency.Valid && c.Concurrency.Int64 <= 0 {
+		return fmt.Errorf("concurrency must be positive but was %d", c.Concurrency.Int64)
+	}
+	if c.MaxInFlightRequests.Valid && c.MaxInFlightRequests.Int64 <= 0 {
+		return fmt.Errorf("maxInFlightRequests must be positive but was %d", c.MaxInFlightRequests.Int64)
+	}
+	switch c.BufferOverflow.String {
+	case overflowDropOldest, overflowDropNewest:
+	default:
+		return fmt.Errorf("bufferOverflow must be %s or %s but was %q",
+			overflowDropOldest, overflowDropNewest, c.BufferOverflow.String)
+	}
+	switch c.PanicPolicy.String {
+	case panicPolicyRecover, panicPolicyCrash:
+	default:
+		return fmt.Errorf("panicPolicy must be %s or %s but was %q",
+			panicPolicyRecover, panicPolicyCrash, c.PanicPolicy.String)
+	}
+
+	if c.CompressionLevel.Int64 < gzip.BestSpeed || c.CompressionLevel.Int64 > gzip.BestCompression {
+		return fmt.Errorf("compressionLevel must be between 1 and 9 but was %d", c.CompressionLevel.Int64)
+	}
+	if c.MaxRetries.Int64 < 0 {
+		return fmt.Errorf("maxRetries must not be negative but was %d", c.MaxRetries.Int64)
+	}
+	for _, status := range c.RetryOnStatus {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("retryOnStatus must only contain HTTP status codes but contained %d", status)
+		}
+	}
+	if c.RetryBackoff.Duration < 0 {
+		return fmt.Errorf("retryBackoff must not be negative but was %s", c.RetryBackoff.Duration)
+	}
+	if c.RequestTimeout.Duration <= 0 {
+		return fmt.Errorf("requestTimeout must be positive but was %s", c.RequestTimeout.Duration)
+	}
+	if c.MaxIdleConns.Valid && c.MaxIdleConns.Int64 <= 0 {
+		return fmt.Errorf("maxIdleConns must be positive but was %d", c.MaxIdleConns.Int64)
+	}
+	if c.IdleConnTimeout.Duration < 0 {
+		return fmt.Errorf("idleConnTimeout must not be negative but was %s", c.IdleConnTimeout.Duration)
+	}
+	if c.DiscoverNodesInterval.Duration < 0 {
+		return fmt.Errorf("discoverNodesInterval must not be negative but was %s", c.DiscoverNodesInterval.Duration)
+	}
+	if (c.DiscoverNodesOnStart.Bool || c.DiscoverNodesInterval.Duration > 0) && (c.Serverless.Bool || c.CloudID.Valid) {
+		// the nodes of these deployments are only reachable through their endpoint
+		return errors.New("node discovery cannot be used with serverless projects or a cloud-id")
+	}
+	if c.DiscoverNodesOnStart.Bool || c.DiscoverNodesInterval.Duration > 0 {
+		for _, address := range splitList(c.Url.String) {
+			// the discovered nodes are contacted at their published addresses, bypassing a gateway behind the prefix
+			if u, err := url.Parse(address); err == nil && strings.Trim(u.Path, "/") != "" {
+				return fmt.Errorf("node discovery cannot be used with the path prefix %s in url", u.Path)
+			}
+		}
+	}
+	if c.StatsInterval.Duration < 0 {
+		return fmt.Errorf("statsInterval must not be negative but was %s", c.StatsInterval.Duration)
+	}
+	if c.ShutdownFlushTimeout.Duration <= 0 {
+		return fmt.Errorf("shutdownFlushTimeout must be positive but was %s", c.ShutdownFlushTimeout.Duration)
+	}
+
+	switch c.Refresh.String {
+	case "", "true", "false", "wait_for":
+	default:
+		return fmt.Errorf("refresh must be true, false or wait_for but was %q", c.Refresh.String)
+	}
+	switch c.OpType.String {
+	case "", opTypeIndex, opTypeCreate:
+	default:
+		return fmt.Errorf("opType must be %s or %s but was %q", opTypeIndex, opTypeCreate, c.OpType.String)
+	}
+	if c.UseDataStream.Bool && c.OpType.String == opTypeIndex {
+		return fmt.Errorf("data streams only accept the %s opType", opTypeCreate)
+	}
+	switch c.IDStrategy.String {
+	case "":
+	case idStrategyHash:
+		if c.DocumentIDField.Valid {
+			return fmt.Errorf("idStrategy %s and documentIdField cannot be combined", idStrategyHash)
+		}
+	default:
+		return fmt.Errorf("idStrategy must be empty or %s but was %q", idStrategyHash, c.IDStrategy.String)
+	}
+	switch c.IDHash.String {
+	case idHashFNV, idHashSHA1:
+	default:
+		return fmt.Errorf("idHash must be %s or %s but was %q", idHashFNV, idHashSHA1, c.IDHash.String)
+	}
+	if c.TargetIsAlias.Bool {
+		switch {
+		case c.UseDataStream.Bool:
+			return errors.New("targetIsAlias and useDataStream cannot be combined")
+		case isIndexTemplate(c.IndexName.String):
+			return errors.New("the name of an alias must not contain a date pattern")
+		case c.EnsureIndexTemplate.Bool:
+			// the template would match the alias instead of its backing indices
+			return errors.New("ensureIndexTemplate cannot be used with targetIsAlias, the index template of the " +
+				"backing indices must be managed separately")
+		}
+	}
+
+	if c.TimestampField.String == "" {
+		return errors.New("timestampField must not be empty")
+	}
+	if c.ValueField.String == "" {
+		return errors.New("valueField must not be empty")
+	}
+	if c.MetricNameField.String == "" {
+		return errors.New("metricNameField must not be empty")
+	}
+	if c.ECSMode.Bool && (c.ValueField.String != defaultValueField || c.MetricNameField.String != defaultMetricNameField) {
+		return errors.New("valueField and metricNameField cannot be used in ECS mode, which uses k6.metric.value and k6.metric.name")
+	}
+	switch c.TimestampPrecision.String {
+	case timestampRFC3339, timestampMillis, timestampMicros, timestampNanos:
+	case timestampSeconds:
+		// data streams read numeric timestamps as epoch milliseconds
+		if c.UseDataStream.Bool {
+			return errors.New("a timestampPrecision of s cannot be used with data streams, use ms instead")
+		}
+	default:
+		return fmt.Errorf("timestampPrecision must be one of %s, %s, %s, %s or %s but was %q", timestampRFC3339,
+			timestampSeconds, timestampMillis, timestampMicros, timestampNanos, c.TimestampPrecision.String)
+	}
+	switch c.TagsFormat.String {
+	case tagsFormatNested:
+	case tagsFormatFlat:
+		if c.ECSMode.Bool {
+			return errors.New("the flat tagsFormat cannot be used in ECS mode, tags are always stored as labels")
+		}
+	default:
+		return fmt.Errorf("tagsFormat must be either %s or %s but was %q", tagsFormatNested, tagsFormatFlat,
+			c.TagsFormat.String)
+	}
+	documentFields := c.documentFields()
+	for i, name := range documentFields {
+		for _, other := range documentFields[i+1:] {
+			if name == other {
+				return fmt.Errorf("the field %q is used more than once in the metric documents", name)
+			}
+		}
+	}
+	if len(c.PromoteTags) > 0 && c.ECSMode.Bool {
+		return errors.New("promoteTags cannot be used in ECS mode, tags are always stored as labels")
+	}
+	if (len(c.NumericTags) > 0 || len(c.BooleanTags) > 0) && c.ECSMode.Bool {
+		return errors.New("numericTags and booleanTags cannot be used in ECS mode, labels are always strings")
+	}
+	if c.MaxTagValueLength.Int64 < 0 {
+		return fmt.Errorf("maxTagValueLength must not be negative but was %d", c.MaxTagValueLength.Int64)
+	}
+	for _, name := range c.NumericTags {
+		if contains(c.BooleanTags, name) {
+			return fmt.Errorf("tag %q cannot be both numeric and boolean", name)
+		}
+	}
+	for _, name := range c.PromoteTags {
+		// the group field of checks holds the group tag anyway
+		if name != "group" && contains(documentFields, name) {
+			return fmt.Errorf("promoted tag %q collides with a field of the metric documents", name)
+		}
+		if _, ok := c.CustomFields[name]; ok {
+			return fmt.Errorf("promoted tag %q collides with a custom field", name)
+		}
+	}
+	for name := range c.CustomFields {
+		for _, reserved := range documentFields {
+			if name == reserved {
+				return fmt.Errorf("custom field %q collides with a field of the metric documents", name)
+			}
+		}
+	}
+
+	if c.UseDataStream.Bool {
+		for _, name := range c.indexNames() {
+			if isIndexTemplate(name) {
+				return errors.New("a data stream name must not contain a date pattern, data streams roll over on their own")
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateIndexName applies the naming restrictions Elasticsearch imposes on index names.
+func validateIndexName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("indexName must not be empty")
+	case name == "." || name == "..":
+		return fmt.Errorf("invalid indexName %q: must not be '.' or '..'", name)
+	case len(name) > 255:
+		return fmt.Errorf("invalid indexName %q: must not be longer than 255 bytes", name)
+	case strings.ToLower(name) != name:
+		return fmt.Errorf("invalid indexName %q: must be lowercase", name)
+	case strings.ContainsAny(name[:1], "-_+"):
+		return fmt.Errorf("invalid indexName %q: must not start with '-', '_' or '+'", name)
+	case strings.ContainsAny(name, `\/*?"<>| ,#:`):
+		return fmt.Errorf(`invalid indexName %q: must not contain any of \ / * ? " < > | space , # :`, name)
+	}
+	return nil
+}
+
+// tlsVersions are the values of tlsMinVersion.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuites looks up the IDs of cipher suites by their names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Only
+// secure suites that TLS 1.2 and lower can use are accepted, the ones of TLS 1.3 are not configurable in Go.
+func cipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		for _, version := range suite.SupportedVersions {
+			if version != tls.VersionTLS13 {
+				known[suite.Name] = suite.ID
+			}
+		}
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// bulkParamName matches the names of the query parameters of Elasticsearch.
+var bulkParamName = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+
+// reservedBulkParams are the query parameters of bulk requests that cannot be set in bulkParams, with the reason.
+var reservedBulkParams = map[string]string{
+	"pipeline":               "use pipeline instead",
+	"refresh":                "use refresh instead",
+	"wait_for_active_shards": "use waitForActiveShards instead",
+	"filter_path":            "the output needs the whole response",
+	"format":                 "the output needs the whole response",
+	"_source":                "the output needs the whole response",
+	"_source_includes":       "the output needs the whole response",
+	"_source_excludes":       "the output needs the whole response",
+}
+
+// validateBulkParams checks that the extra query parameters of bulk requests neither override the ones the output
+// sets nor contain control characters, which no parameter of Elasticsearch accepts.
+func validateBulkParams(params map[string]string) error {
+	for name, value := range params {
+		if !bulkParamName.MatchString(name) {
+			return fmt.Errorf("bulkParams contains the invalid parameter name %q", name)
+		}
+		if reason, ok := reservedBulkParams[name]; ok {
+			return fmt.Errorf("the parameter %s cannot be set in bulkParams, %s", name, reason)
+		}
+		if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return fmt.Errorf("the value of the parameter %s in bulkParams contains control characters", name)
+		}
+	}
+	return nil
+}
+
+// metricTypes parses the names of k6 metric types into a set.
+func metricTypes(names []string) (map[metrics.MetricType]bool, error) {
+	types := make(map[metrics.MetricType]bool, len(names))
+	for _, name := range names {
+		var t metrics.MetricType
+		if err := t.UnmarshalText([]byte(name)); err != nil {
+			return nil, fmt.Errorf("unknown metric type %q, must be one of counter, gauge, rate or trend", name)
+		}
+		types[t] = true
+	}
+	return types, nil
+}
+
+// fallbackURL returns the URL of the fallback cluster, configured either directly or as a cloud id.
+func fallbackURL(c Config) (*url.URL, error) {
+	if c.FallbackCloudID.Valid {
+		address, err := cloudIDAddress(c.FallbackCloudID.String)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallbackCloudId: %w", err)
+		}
+		return url.Parse(address)
+	}
+	u, err := url.Parse(c.FallbackUrl.String)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid fallbackUrl %q: must be a single http or https URL", redactURL(c.FallbackUrl.String))
+	}
+	return u, nil
+}
+
+// cloudIDAddress returns the Elasticsearch URL of an Elastic Cloud id, a deployment name followed by a colon and
+// the base64 encoding of host$es-uuid$kibana-uuid. It checks the format itself, so that a mistyped id isn't
+// reported as an obscure client error.
+func cloudIDAddress(id string) (string, error) {
+	_, encoded, found := strings.Cut(id, ":")
+	if !found {
+		return "", errors.New("expected <deployment-name>:<base64 data>, " +
+			"copy it from the deployment page of the Elastic Cloud console")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("the part after the colon is not valid base64: %w", err)
 	}
+	parts := strings.Split(string(decoded), "$")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", fmt.Errorf("the decoded value must have the form host$es-uuid$kibana-uuid, "+
+			"found %d segment(s)", len(parts))
+	}
+	if parts[0] == "" || parts[1] == "" {
+		return "", errors.New("the host and the Elasticsearch uuid must not be empty")
+	}
+	return "https://" + parts[1] + "." + parts[0], nil
 }
 
 // From here till the end of the file partial duplicates waiting for config refactor (k6 #883)
@@ -89,6 +795,9 @@ func (base Config) Apply(applied Config) Config {
 	if applied.CACert.Valid {
 		base.CACert = applied.CACert
 	}
+	if applied.CACertPEM.Valid {
+		base.CACertPEM = applied.CACertPEM
+	}
 	if applied.InsecureSkipVerify.Valid {
 		base.InsecureSkipVerify = applied.InsecureSkipVerify
 	}
@@ -115,112 +824,949 @@ func (base Config) Apply(applied Config) Config {
 	if applied.FlushPeriod.Valid {
 		base.FlushPeriod = applied.FlushPeriod
 	}
-	if applied.IndexName.Valid {
-		base.IndexName = applied.IndexName
-	}
-
-	return base
-}
-
-// ParseArg takes an arg string and converts it to a config
-func ParseArg(arg string) (Config, error) {
-	var c Config
-	params, err := strvals.Parse(arg)
-	if err != nil {
-		return c, err
+	if applied.MaxBatchSize.Valid {
+		base.MaxBatchSize = applied.MaxBatchSize
 	}
-
-	if v, ok := params["url"].(string); ok {
-		c.Url = null.StringFrom(v)
+	if applied.MaxBatchBytes.Valid {
+		base.MaxBatchBytes = applied.MaxBatchBytes
 	}
 
-	if v, ok := params["cloud-id"].(string); ok {
-		c.CloudID = null.StringFrom(v)
+	if applied.CompressRequestBody.Valid {
+		base.CompressRequestBody = applied.CompressRequestBody
 	}
 
-	if v, ok := params["caCertFile"].(string); ok {
-		c.CACert = null.StringFrom(v)
+	if applied.MaxRetries.Valid {
+		base.MaxRetries = applied.MaxRetries
 	}
-
-	if v, ok := params["insecureSkipVerify"].(bool); ok {
-		c.InsecureSkipVerify = null.BoolFrom(v)
+	if applied.RetryBackoff.Valid {
+		base.RetryBackoff = applied.RetryBackoff
 	}
 
-	if v, ok := params["clientCertFile"].(string); ok {
-		c.ClientCert = null.StringFrom(v)
+	if applied.RequestTimeout.Valid {
+		base.RequestTimeout = applied.RequestTimeout
 	}
-	if v, ok := params["clientKeyFile"].(string); ok {
-		c.ClientKey = null.StringFrom(v)
+	if applied.IndexName.Valid {
+		base.IndexName = applied.IndexName
 	}
-
-	if v, ok := params["user"].(string); ok {
-		c.User = null.StringFrom(v)
+	if applied.UseDataStream.Valid {
+		base.UseDataStream = applied.UseDataStream
 	}
-
-	if v, ok := params["password"].(string); ok {
-		c.Password = null.StringFrom(v)
+	if applied.Pipeline.Valid {
+		base.Pipeline = applied.Pipeline
 	}
-	if v, ok := params["apiKey"].(string); ok {
-		c.APIKey = null.StringFrom(v)
+	if applied.CustomFields != nil {
+		base.CustomFields = applied.CustomFields
 	}
-	if v, ok := params["serviceAccountToken"].(string); ok {
-		c.ServiceAccountToken = null.StringFrom(v)
+	if applied.Headers != nil {
+		base.Headers = applied.Headers
 	}
-
-	if v, ok := params["flushPeriod"].(string); ok {
-		if err := c.FlushPeriod.UnmarshalText([]byte(v)); err != nil {
-			return c, err
-		}
+	if applied.BulkParams != nil {
+		base.BulkParams = applied.BulkParams
 	}
-	if v, ok := params["indexName"].(string); ok {
-		c.IndexName = null.StringFrom(v)
+	if applied.IndexRouting != nil {
+		base.IndexRouting = applied.IndexRouting
 	}
 
-	return c, nil
-}
-
-// GetConsolidatedConfig combines {default config values + JSON config +
-// environment vars + arg config values}, and returns the final result.
-func GetConsolidatedConfig(jsonRawConf json.RawMessage, env map[string]string, arg string) (Config, error) {
-	result := NewConfig()
-	if jsonRawConf != nil {
-		jsonConf := Config{}
-		if err := json.Unmarshal(jsonRawConf, &jsonConf); err != nil {
-			return result, err
-		}
-		result = result.Apply(jsonConf)
+	if applied.TestRunID.Valid {
+		base.TestRunID = applied.TestRunID
 	}
 
-	getEnvBool := func(env map[string]string, name string) (null.Bool, error) {
-		if v, vDefined := env[name]; vDefined {
-			if b, err := strconv.ParseBool(v); err != nil {
-				return null.NewBool(false, false), err
-			} else {
-				return null.BoolFrom(b), nil
-			}
-		}
-		return null.NewBool(false, false), nil
+	if applied.RetryOnStatus != nil {
+		base.RetryOnStatus = applied.RetryOnStatus
 	}
 
-	// envconfig is not processing some undefined vars (at least duration) so apply them manually
-	if flushPeriod, flushPeriodDefined := env["K6_ELASTICSEARCH_FLUSH_PERIOD"]; flushPeriodDefined {
-		if err := result.FlushPeriod.UnmarshalText([]byte(flushPeriod)); err != nil {
-			return result, err
-		}
+	if applied.IncludeMetrics != nil {
+		base.IncludeMetrics = applied.IncludeMetrics
 	}
-
-	if url, defined := env["K6_ELASTICSEARCH_URL"]; defined {
-		result.Url = null.StringFrom(url)
+	if applied.ExcludeMetrics != nil {
+		base.ExcludeMetrics = applied.ExcludeMetrics
 	}
 
-	if cloudId, defined := env["K6_ELASTICSEARCH_CLOUD_ID"]; defined {
-		result.CloudID = null.StringFrom(cloudId)
+	if applied.DropTags != nil {
+		base.DropTags = applied.DropTags
+	}
+	if applied.KeepTags != nil {
+		base.KeepTags = applied.KeepTags
+	}
+
+	if applied.TimestampField.Valid {
+		base.TimestampField = applied.TimestampField
+	}
+	if applied.TimestampPrecision.Valid {
+		base.TimestampPrecision = applied.TimestampPrecision
+	}
+	if applied.EnsureIndexTemplate.Valid {
+		base.EnsureIndexTemplate = applied.EnsureIndexTemplate
+	}
+	if applied.IndexTemplateName.Valid {
+		base.IndexTemplateName = applied.IndexTemplateName
+	}
+	if applied.MaxBufferedSamples.Valid {
+		base.MaxBufferedSamples = applied.MaxBufferedSamples
+	}
+	if applied.BufferOverflow.Valid {
+		base.BufferOverflow = applied.BufferOverflow
+	}
+	if applied.Concurrency.Valid {
+		base.Concurrency = applied.Concurrency
+	}
+	if applied.ShutdownFlushTimeout.Valid {
+		base.ShutdownFlushTimeout = applied.ShutdownFlushTimeout
+	}
+	if applied.OpenSearchCompat.Valid {
+		base.OpenSearchCompat = applied.OpenSearchCompat
+	}
+	if applied.Serverless.Valid {
+		base.Serverless = applied.Serverless
+	}
+
+	if applied.OpType.Valid {
+		base.OpType = applied.OpType
+	}
+	if applied.DocumentIDField.Valid {
+		base.DocumentIDField = applied.DocumentIDField
+	}
+	if applied.Proxy.Valid {
+		base.Proxy = applied.Proxy
+	}
+	if applied.PasswordFile.Valid {
+		base.PasswordFile = applied.PasswordFile
+	}
+	if applied.APIKeyFile.Valid {
+		base.APIKeyFile = applied.APIKeyFile
+	}
+
+	if applied.ECSMode.Valid {
+		base.ECSMode = applied.ECSMode
+	}
+	if applied.SampleRate.Valid {
+		base.SampleRate = applied.SampleRate
+	}
+	if applied.AggregateTrends.Valid {
+		base.AggregateTrends = applied.AggregateTrends
+	}
+	if applied.DisableProductCheck.Valid {
+		base.DisableProductCheck = applied.DisableProductCheck
+	}
+	if applied.Refresh.Valid {
+		base.Refresh = applied.Refresh
+	}
+	if applied.RoutingField.Valid {
+		base.RoutingField = applied.RoutingField
+	}
+
+	if applied.DryRun.Valid {
+		base.DryRun = applied.DryRun
+	}
+	if applied.DryRunFile.Valid {
+		base.DryRunFile = applied.DryRunFile
+	}
+	if applied.MaxIdleConns.Valid {
+		base.MaxIdleConns = applied.MaxIdleConns
+	}
+	if applied.IdleConnTimeout.Valid {
+		base.IdleConnTimeout = applied.IdleConnTimeout
+	}
+	if applied.VerifyConnection.Valid {
+		base.VerifyConnection = applied.VerifyConnection
+	}
+	if applied.TagsFormat.Valid {
+		base.TagsFormat = applied.TagsFormat
+	}
+	if applied.UserAgent.Valid {
+		base.UserAgent = applied.UserAgent
+	}
+	if applied.SummaryOnly.Valid {
+		base.SummaryOnly = applied.SummaryOnly
+	}
+	if applied.MarkerIndex.Valid {
+		base.MarkerIndex = applied.MarkerIndex
+	}
+	if applied.SourceExclude != nil {
+		base.SourceExclude = applied.SourceExclude
+	}
+	if applied.ValueField.Valid {
+		base.ValueField = applied.ValueField
+	}
+	if applied.MetricNameField.Valid {
+		base.MetricNameField = applied.MetricNameField
+	}
+	if applied.DiscoverNodesOnStart.Valid {
+		base.DiscoverNodesOnStart = applied.DiscoverNodesOnStart
+	}
+	if applied.DiscoverNodesInterval.Valid {
+		base.DiscoverNodesInterval = applied.DiscoverNodesInterval
+	}
+	if applied.RetryJitter.Valid {
+		base.RetryJitter = applied.RetryJitter
+	}
+	if applied.TargetIsAlias.Valid {
+		base.TargetIsAlias = applied.TargetIsAlias
+	}
+	if applied.PromoteTags != nil {
+		base.PromoteTags = applied.PromoteTags
+	}
+	if applied.MetricPrefix.Valid {
+		base.MetricPrefix = applied.MetricPrefix
+	}
+	if applied.ReplaceDots.Valid {
+		base.ReplaceDots = applied.ReplaceDots
+	}
+	if applied.MaxInFlightRequests.Valid {
+		base.MaxInFlightRequests = applied.MaxInFlightRequests
+	}
+	if applied.OpaqueIDPrefix.Valid {
+		base.OpaqueIDPrefix = applied.OpaqueIDPrefix
+	}
+	if applied.IncludeMetricTypes != nil {
+		base.IncludeMetricTypes = applied.IncludeMetricTypes
+	}
+	if applied.ExcludeMetricTypes != nil {
+		base.ExcludeMetricTypes = applied.ExcludeMetricTypes
+	}
+	if applied.StatsInterval.Valid {
+		base.StatsInterval = applied.StatsInterval
+	}
+	if applied.FallbackUrl.Valid {
+		base.FallbackUrl = applied.FallbackUrl
+	}
+	if applied.FallbackCloudID.Valid {
+		base.FallbackCloudID = applied.FallbackCloudID
+	}
+	if applied.FailoverAfter.Valid {
+		base.FailoverAfter = applied.FailoverAfter
+	}
+	if applied.CompressionLevel.Valid {
+		base.CompressionLevel = applied.CompressionLevel
+	}
+	if applied.NumericTags != nil {
+		base.NumericTags = applied.NumericTags
+	}
+	if applied.BooleanTags != nil {
+		base.BooleanTags = applied.BooleanTags
+	}
+	if applied.OnlyBreaches.Valid {
+		base.OnlyBreaches = applied.OnlyBreaches
+	}
+	if applied.PanicPolicy.Valid {
+		base.PanicPolicy = applied.PanicPolicy
+	}
+	if applied.IDStrategy.Valid {
+		base.IDStrategy = applied.IDStrategy
+	}
+	if applied.IDHash.Valid {
+		base.IDHash = applied.IDHash
+	}
+	if applied.CompatibilityMode.Valid {
+		base.CompatibilityMode = applied.CompatibilityMode
+	}
+	if applied.PromoteVUFields.Valid {
+		base.PromoteVUFields = applied.PromoteVUFields
+	}
+	if applied.FlushTrigger.Valid {
+		base.FlushTrigger = applied.FlushTrigger
+	}
+	if applied.FailOnDrop.Valid {
+		base.FailOnDrop = applied.FailOnDrop
+	}
+	if applied.UseSampleTimeForIndex.Valid {
+		base.UseSampleTimeForIndex = applied.UseSampleTimeForIndex
+	}
+	if applied.StartupRetries.Valid {
+		base.StartupRetries = applied.StartupRetries
+	}
+	if applied.StartupRetryDelay.Valid {
+		base.StartupRetryDelay = applied.StartupRetryDelay
+	}
+	if applied.GroupLevels.Valid {
+		base.GroupLevels = applied.GroupLevels
+	}
+	if applied.FastEncoder.Valid {
+		base.FastEncoder = applied.FastEncoder
+	}
+	if applied.BulkPerIndex.Valid {
+		base.BulkPerIndex = applied.BulkPerIndex
+	}
+	if applied.TLSMinVersion.Valid {
+		base.TLSMinVersion = applied.TLSMinVersion
+	}
+	if applied.TLSCipherSuites != nil {
+		base.TLSCipherSuites = applied.TLSCipherSuites
+	}
+	if applied.CircuitBreakerAfter.Valid {
+		base.CircuitBreakerAfter = applied.CircuitBreakerAfter
+	}
+	if applied.CircuitBreakerCooldown.Valid {
+		base.CircuitBreakerCooldown = applied.CircuitBreakerCooldown
+	}
+	if applied.FileOutput.Valid {
+		base.FileOutput = applied.FileOutput
+	}
+	if applied.FileMaxBytes.Valid {
+		base.FileMaxBytes = applied.FileMaxBytes
+	}
+	if applied.MaxTagValueLength.Valid {
+		base.MaxTagValueLength = applied.MaxTagValueLength
+	}
+	if applied.MetricMetadata.Valid {
+		base.MetricMetadata = applied.MetricMetadata
+	}
+	if applied.CreateIndex.Valid {
+		base.CreateIndex = applied.CreateIndex
+	}
+	if applied.DocTypeField.Valid {
+		base.DocTypeField = applied.DocTypeField
+	}
+	if applied.WaitForActiveShards.Valid {
+		base.WaitForActiveShards = applied.WaitForActiveShards
+	}
+	base.aliasConflicts = append(base.aliasConflicts, applied.aliasConflicts...)
+
+	return base
+}
+
+const redacted = "***"
+
+// Redacted returns a copy of the config with secrets replaced by "***", so that it can be logged.
+func (c Config) Redacted() Config {
+	for _, secret := range []*null.String{&c.Password, &c.APIKey, &c.ServiceAccountToken} {
+		if secret.Valid {
+			*secret = null.StringFrom(redacted)
+		}
+	}
+	if c.Url.Valid {
+		addresses := splitList(c.Url.String)
+		for i, address := range addresses {
+			addresses[i] = redactURL(address)
+		}
+		c.Url = null.StringFrom(strings.Join(addresses, ","))
+	}
+	if c.FallbackUrl.Valid {
+		c.FallbackUrl = null.StringFrom(redactURL(c.FallbackUrl.String))
+	}
+	// headers often carry tokens of gateways
+	if len(c.Headers) > 0 {
+		headers := make(map[string]string, len(c.Headers))
+		for name := range c.Headers {
+			headers[name] = redacted
+		}
+		c.Headers = headers
+	}
+	if c.Proxy.Valid {
+		c.Proxy = null.StringFrom(redactURL(c.Proxy.String))
+	}
+	return c
+}
+
+// redactURL hides the password of a URL with user info.
+func redactURL(address string) string {
+	u, err := url.Parse(address)
+	if err != nil || u.User == nil {
+		return address
+	}
+	if _, ok := u.User.Password(); !ok {
+		return address
+	}
+	// url.UserPassword would escape the asterisks
+	user := url.User(u.User.Username()).String()
+	u.User = nil
+	scheme := u.Scheme + "://"
+	return scheme + user + ":" + redacted + "@" + strings.TrimPrefix(u.String(), scheme)
+}
+
+// userAgent returns the configured User-Agent or else one naming this extension and its version.
+func (c Config) userAgent() string {
+	if c.UserAgent.Valid {
+		return c.UserAgent.String
+	}
+	return "xk6-output-elasticsearch/" + Version
+}
+
+// proxyURL parses the configured proxy, which may be an HTTP, HTTPS or SOCKS5 proxy.
+func proxyURL(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("proxy must be an http, https or socks5 URL but was %q", proxy)
+	}
+	return u, nil
+}
+
+// splitList splits a comma-separated list and drops empty entries.
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// parseListArg accepts either a single value (key=a) or a list (key={a,b}) of an output argument.
+func parseListArg(v interface{}) ([]string, bool) {
+	switch v := v.(type) {
+	case string:
+		return splitList(v), true
+	case int64:
+		return []string{fmt.Sprint(v)}, true
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, value := range v {
+			values = append(values, fmt.Sprint(value))
+		}
+		return values, true
+	}
+	return nil, false
+}
+
+// parseStatusList parses a list of HTTP status codes.
+func parseStatusList(values []string) ([]int, error) {
+	statuses := make([]int, 0, len(values))
+	for _, value := range values {
+		status, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code %q in retryOnStatus", value)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// ParseArg takes an arg string and converts it to a config
+func ParseArg(arg string) (Config, error) {
+	var c Config
+	params, err := strvals.Parse(arg)
+	if err != nil {
+		return c, err
+	}
+
+	if v, ok := params["url"].(string); ok {
+		c.Url = null.StringFrom(v)
+	}
+
+	if v, ok := params["cloud-id"].(string); ok {
+		c.CloudID = null.StringFrom(v)
+	}
+
+	if v, ok := params["caCertFile"].(string); ok {
+		c.CACert = null.StringFrom(v)
+	}
+	if v, ok := params["caCertPem"].(string); ok {
+		c.CACertPEM = null.StringFrom(v)
+	}
+
+	// insecureSkipTLSVerify is an alias, insecureSkipVerify wins if both are given
+	if v, ok := params["insecureSkipTLSVerify"].(bool); ok {
+		c.InsecureSkipVerify = null.BoolFrom(v)
+	}
+	if v, ok := params["insecureSkipVerify"].(bool); ok {
+		c.InsecureSkipVerify = null.BoolFrom(v)
+	}
+
+	if v, ok := params["clientCertFile"].(string); ok {
+		c.ClientCert = null.StringFrom(v)
+	}
+	if v, ok := params["clientKeyFile"].(string); ok {
+		c.ClientKey = null.StringFrom(v)
+	}
+
+	if v, ok := params["user"].(string); ok {
+		c.User = null.StringFrom(v)
+	}
+
+	if v, ok := params["password"].(string); ok {
+		c.Password = null.StringFrom(v)
+	}
+	if v, ok := params["apiKey"].(string); ok {
+		c.APIKey = null.StringFrom(v)
+	}
+	// serviceToken is an alias named after the option of the client, serviceAccountToken wins if both are given
+	if v, ok := params["serviceToken"].(string); ok {
+		c.ServiceAccountToken = null.StringFrom(v)
+	}
+	if v, ok := params["serviceAccountToken"].(string); ok {
+		c.ServiceAccountToken = null.StringFrom(v)
+	}
+
+	if v, ok := params["flushPeriod"]; ok {
+		// a bare number like 0 is parsed as an integer and would otherwise be ignored
+		s, ok := v.(string)
+		if !ok {
+			return c, fmt.Errorf("invalid flushPeriod %v, it must be a duration like 1s", v)
+		}
+		if err := c.FlushPeriod.UnmarshalText([]byte(s)); err != nil {
+			return c, fmt.Errorf("invalid flushPeriod %q: %v", s, err)
+		}
+	}
+	if v, ok := params["maxBatchSize"].(int64); ok {
+		c.MaxBatchSize = null.IntFrom(v)
+	}
+	if v, ok := params["maxBatchBytes"].(int64); ok {
+		c.MaxBatchBytes = null.IntFrom(v)
+	}
+
+	if v, ok := params["compressRequestBody"].(bool); ok {
+		c.CompressRequestBody = null.BoolFrom(v)
+	}
+
+	if v, ok := params["maxRetries"].(int64); ok {
+		c.MaxRetries = null.IntFrom(v)
+	}
+	if v, ok := params["retryBackoff"].(string); ok {
+		if err := c.RetryBackoff.UnmarshalText([]byte(v)); err != nil {
+			return c, err
+		}
+	}
+
+	if v, ok := params["requestTimeout"].(string); ok {
+		if err := c.RequestTimeout.UnmarshalText([]byte(v)); err != nil {
+			return c, err
+		}
+	}
+	// index is a shorter alias, indexName wins if both are given
+	if v, ok := params["index"].(string); ok {
+		c.IndexName = null.StringFrom(v)
+	}
+	if v, ok := params["indexName"].(string); ok {
+		if c.IndexName.Valid && c.IndexName.String != v {
+			c.aliasConflicts = append(c.aliasConflicts, aliasConflict("index", c.IndexName.String, "indexName", v))
+		}
+		c.IndexName = null.StringFrom(v)
+	}
+	if v, ok := params["useDataStream"].(bool); ok {
+		c.UseDataStream = null.BoolFrom(v)
+	}
+	if v, ok := params["pipeline"].(string); ok {
+		c.Pipeline = null.StringFrom(v)
+	}
+	if v, ok := params["customFields"].(map[string]interface{}); ok {
+		c.CustomFields = make(map[string]string, len(v))
+		for key, value := range v {
+			c.CustomFields[key] = fmt.Sprint(value)
+		}
+	}
+	if v, ok := params["headers"].(map[string]interface{}); ok {
+		c.Headers = make(map[string]string, len(v))
+		for key, value := range v {
+			c.Headers[key] = fmt.Sprint(value)
+		}
+	}
+	if v, ok := params["bulkParams"].(map[string]interface{}); ok {
+		c.BulkParams = make(map[string]string, len(v))
+		for key, value := range v {
+			c.BulkParams[key] = fmt.Sprint(value)
+		}
+	}
+	if v, ok := parseListArg(params["indexRouting"]); ok {
+		if c.IndexRouting, err = parseIndexRoutes(v); err != nil {
+			return c, err
+		}
+	}
+
+	if v, ok := params["testRunId"].(string); ok {
+		c.TestRunID = null.StringFrom(v)
+	}
+
+	if v, ok := parseListArg(params["includeMetrics"]); ok {
+		c.IncludeMetrics = v
+	}
+	if v, ok := parseListArg(params["excludeMetrics"]); ok {
+		c.ExcludeMetrics = v
+	}
+	if v, ok := parseListArg(params["retryOnStatus"]); ok {
+		if c.RetryOnStatus, err = parseStatusList(v); err != nil {
+			return c, err
+		}
+	}
+
+	if v, ok := parseListArg(params["dropTags"]); ok {
+		c.DropTags = v
+	}
+	if v, ok := parseListArg(params["keepTags"]); ok {
+		c.KeepTags = v
+	}
+
+	if v, ok := params["timestampField"].(string); ok {
+		c.TimestampField = null.StringFrom(v)
+	}
+	if v, ok := params["timestampPrecision"].(string); ok {
+		c.TimestampPrecision = null.StringFrom(v)
+	}
+	if v, ok := params["ensureIndexTemplate"].(bool); ok {
+		c.EnsureIndexTemplate = null.BoolFrom(v)
+	}
+	if v, ok := params["indexTemplateName"].(string); ok {
+		c.IndexTemplateName = null.StringFrom(v)
+	}
+	if v, ok := params["maxBufferedSamples"].(int64); ok {
+		c.MaxBufferedSamples = null.IntFrom(v)
+	}
+	if v, ok := params["bufferOverflow"].(string); ok {
+		c.BufferOverflow = null.StringFrom(v)
+	}
+	if v, ok := params["concurrency"].(int64); ok {
+		c.Concurrency = null.IntFrom(v)
+	}
+	if v, ok := params["shutdownFlushTimeout"].(string); ok {
+		if err := c.ShutdownFlushTimeout.UnmarshalText([]byte(v)); err != nil {
+			return c, err
+		}
+	}
+	if v, ok := params["openSearchCompat"].(bool); ok {
+		c.OpenSearchCompat = null.BoolFrom(v)
+	}
+	if v, ok := params["serverless"].(bool); ok {
+		c.Serverless = null.BoolFrom(v)
+	}
+
+	if v, ok := params["opType"].(string); ok {
+		c.OpType = null.StringFrom(v)
+	}
+	if v, ok := params["documentIdField"].(string); ok {
+		c.DocumentIDField = null.StringFrom(v)
+	}
+	if v, ok := params["proxy"].(string); ok {
+		c.Proxy = null.StringFrom(v)
+	}
+	if v, ok := params["passwordFile"].(string); ok {
+		c.PasswordFile = null.StringFrom(v)
+	}
+	if v, ok := params["apiKeyFile"].(string); ok {
+		c.APIKeyFile = null.StringFrom(v)
+	}
+
+	if v, ok := params["ecs"].(bool); ok {
+		c.ECSMode = null.BoolFrom(v)
+	}
+	switch v := params["sampleRate"].(type) {
+	case int64:
+		c.SampleRate = null.FloatFrom(float64(v))
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return c, err
+		}
+		c.SampleRate = null.FloatFrom(f)
+	}
+	if v, ok := params["aggregateTrends"].(bool); ok {
+		c.AggregateTrends = null.BoolFrom(v)
+	}
+	if v, ok := params["disableProductCheck"].(bool); ok {
+		c.DisableProductCheck = null.BoolFrom(v)
+	}
+	// true and false are parsed as booleans
+	switch v := params["refresh"].(type) {
+	case string:
+		c.Refresh = null.StringFrom(v)
+	case bool:
+		c.Refresh = null.StringFrom(strconv.FormatBool(v))
+	}
+	if v, ok := params["routingField"].(string); ok {
+		c.RoutingField = null.StringFrom(v)
+	}
+
+	if v, ok := params["dryRun"].(bool); ok {
+		c.DryRun = null.BoolFrom(v)
+	}
+	if v, ok := params["dryRunFile"].(string); ok {
+		c.DryRunFile = null.StringFrom(v)
+	}
+	if v, ok := params["maxIdleConns"].(int64); ok {
+		c.MaxIdleConns = null.IntFrom(v)
+	}
+	if v, ok := params["idleConnTimeout"].(string); ok {
+		if err := c.IdleConnTimeout.UnmarshalText([]byte(v)); err != nil {
+			return c, err
+		}
+	}
+	if v, ok := params["verifyConnection"].(bool); ok {
+		c.VerifyConnection = null.BoolFrom(v)
+	}
+	if v, ok := params["tagsFormat"].(string); ok {
+		c.TagsFormat = null.StringFrom(v)
+	}
+	if v, ok := params["userAgent"].(string); ok {
+		c.UserAgent = null.StringFrom(v)
+	}
+	if v, ok := params["summaryOnly"].(bool); ok {
+		c.SummaryOnly = null.BoolFrom(v)
+	}
+	if v, ok := params["markerIndex"].(string); ok {
+		c.MarkerIndex = null.StringFrom(v)
+	}
+	if v, ok := parseListArg(params["sourceExclude"]); ok {
+		c.SourceExclude = v
+	}
+	if v, ok := params["valueField"].(string); ok {
+		c.ValueField = null.StringFrom(v)
+	}
+	if v, ok := params["metricNameField"].(string); ok {
+		c.MetricNameField = null.StringFrom(v)
+	}
+	if v, ok := params["discoverNodesOnStart"].(bool); ok {
+		c.DiscoverNodesOnStart = null.BoolFrom(v)
+	}
+	if v, ok := params["discoverNodesInterval"].(string); ok {
+		if err := c.DiscoverNodesInterval.UnmarshalText([]byte(v)); err != nil {
+			return c, err
+		}
+	}
+	if v, ok := params["retryJitter"].(bool); ok {
+		c.RetryJitter = null.BoolFrom(v)
+	}
+	if v, ok := params["targetIsAlias"].(bool); ok {
+		c.TargetIsAlias = null.BoolFrom(v)
+	}
+	if v, ok := parseListArg(params["promoteTags"]); ok {
+		c.PromoteTags = v
+	}
+	if v, ok := params["metricPrefix"].(string); ok {
+		c.MetricPrefix = null.StringFrom(v)
+	}
+	if v, ok := params["replaceDots"].(bool); ok {
+		c.ReplaceDots = null.BoolFrom(v)
+	}
+	if v, ok := params["maxInFlightRequests"].(int64); ok {
+		c.MaxInFlightRequests = null.IntFrom(v)
+	}
+	if v, ok := params["opaqueIdPrefix"].(string); ok {
+		c.OpaqueIDPrefix = null.StringFrom(v)
+	}
+	if v, ok := parseListArg(params["includeMetricTypes"]); ok {
+		c.IncludeMetricTypes = v
+	}
+	if v, ok := parseListArg(params["excludeMetricTypes"]); ok {
+		c.ExcludeMetricTypes = v
+	}
+	if v, ok := params["statsInterval"].(string); ok {
+		if err := c.StatsInterval.UnmarshalText([]byte(v)); err != nil {
+			return c, err
+		}
+	}
+	if v, ok := params["fallbackUrl"].(string); ok {
+		c.FallbackUrl = null.StringFrom(v)
+	}
+	if v, ok := params["fallbackCloudId"].(string); ok {
+		c.FallbackCloudID = null.StringFrom(v)
+	}
+	if v, ok := params["failoverAfter"].(int64); ok {
+		c.FailoverAfter = null.IntFrom(v)
+	}
+	if v, ok := params["compressionLevel"].(int64); ok {
+		c.CompressionLevel = null.IntFrom(v)
+	}
+	if v, ok := parseListArg(params["numericTags"]); ok {
+		c.NumericTags = v
+	}
+	if v, ok := parseListArg(params["booleanTags"]); ok {
+		c.BooleanTags = v
+	}
+	if v, ok := params["onlyBreaches"].(bool); ok {
+		c.OnlyBreaches = null.BoolFrom(v)
+	}
+	if v, ok := params["panicPolicy"].(string); ok {
+		c.PanicPolicy = null.StringFrom(v)
+	}
+	if v, ok := params["idStrategy"].(string); ok {
+		c.IDStrategy = null.StringFrom(v)
+	}
+	if v, ok := params["idHash"].(string); ok {
+		c.IDHash = null.StringFrom(v)
+	}
+	if v, ok := params["compatibilityMode"].(bool); ok {
+		c.CompatibilityMode = null.BoolFrom(v)
+	}
+	if v, ok := params["promoteVUFields"].(bool); ok {
+		c.PromoteVUFields = null.BoolFrom(v)
+	}
+	if v, ok := params["flushTrigger"].(string); ok {
+		c.FlushTrigger = null.StringFrom(v)
+	}
+	if v, ok := params["failOnDrop"].(bool); ok {
+		c.FailOnDrop = null.BoolFrom(v)
+	}
+	if v, ok := params["useSampleTimeForIndex"].(bool); ok {
+		c.UseSampleTimeForIndex = null.BoolFrom(v)
+	}
+	if v, ok := params["startupRetries"].(int64); ok {
+		c.StartupRetries = null.IntFrom(v)
+	}
+	if v, ok := params["startupRetryDelay"].(string); ok {
+		if err := c.StartupRetryDelay.UnmarshalText([]byte(v)); err != nil {
+			return c, err
+		}
+	}
+	if v, ok := params["groupLevels"].(bool); ok {
+		c.GroupLevels = null.BoolFrom(v)
+	}
+	if v, ok := params["fastEncoder"].(bool); ok {
+		c.FastEncoder = null.BoolFrom(v)
+	}
+	if v, ok := params["bulkPerIndex"].(bool); ok {
+		c.BulkPerIndex = null.BoolFrom(v)
+	}
+	if v, ok := params["tlsMinVersion"].(string); ok {
+		c.TLSMinVersion = null.StringFrom(v)
+	}
+	if v, ok := parseListArg(params["tlsCipherSuites"]); ok {
+		c.TLSCipherSuites = v
+	}
+	if v, ok := params["circuitBreakerAfter"].(int64); ok {
+		c.CircuitBreakerAfter = null.IntFrom(v)
+	}
+	if v, ok := params["circuitBreakerCooldown"].(string); ok {
+		if err := c.CircuitBreakerCooldown.UnmarshalText([]byte(v)); err != nil {
+			return c, err
+		}
+	}
+	if v, ok := params["fileOutput"].(string); ok {
+		c.FileOutput = null.StringFrom(v)
+	}
+	if v, ok := params["fileMaxBytes"].(int64); ok {
+		c.FileMaxBytes = null.IntFrom(v)
+	}
+	if v, ok := params["maxTagValueLength"].(int64); ok {
+		c.MaxTagValueLength = null.IntFrom(v)
+	}
+	if v, ok := params["metricMetadata"].(bool); ok {
+		c.MetricMetadata = null.BoolFrom(v)
+	}
+	if v, ok := params["createIndex"].(bool); ok {
+		c.CreateIndex = null.BoolFrom(v)
+	}
+	if v, ok := params["docTypeField"].(string); ok {
+		c.DocTypeField = null.StringFrom(v)
+	}
+	switch v := params["waitForActiveShards"].(type) {
+	case string:
+		c.WaitForActiveShards = null.StringFrom(v)
+	case int64:
+		c.WaitForActiveShards = null.StringFrom(strconv.FormatInt(v, 10))
+	}
+
+	return c, nil
+}
+
+// GetConsolidatedConfig combines {default config values + JSON config +
+// environment vars + arg config values}, and returns the final result.
+func GetConsolidatedConfig(jsonRawConf json.RawMessage, env map[string]string, arg string) (Config, error) {
+	result := NewConfig()
+	if jsonRawConf != nil {
+		jsonConf := Config{}
+		if err := json.Unmarshal(jsonRawConf, &jsonConf); err != nil {
+			return result, err
+		}
+		result = result.Apply(jsonConf)
+	}
+
+	getEnvBool := func(env map[string]string, name string) (null.Bool, error) {
+		if v, vDefined := env[name]; vDefined {
+			if b, err := strconv.ParseBool(v); err != nil {
+				return null.NewBool(false, false), err
+			} else {
+				return null.BoolFrom(b), nil
+			}
+		}
+		return null.NewBool(false, false), nil
+	}
+
+	getEnvInt := func(env map[string]string, name string) (null.Int, error) {
+		if v, vDefined := env[name]; vDefined {
+			if i, err := strconv.ParseInt(v, 10, 64); err != nil {
+				return null.NewInt(0, false), err
+			} else {
+				return null.IntFrom(i), nil
+			}
+		}
+		return null.NewInt(0, false), nil
+	}
+	getEnvFloat := func(env map[string]string, name string) (null.Float, error) {
+		if v, vDefined := env[name]; vDefined {
+			if f, err := strconv.ParseFloat(v, 64); err != nil {
+				return null.NewFloat(0, false), err
+			} else {
+				return null.FloatFrom(f), nil
+			}
+		}
+		return null.NewFloat(0, false), nil
+	}
+
+	// envconfig is not processing some undefined vars (at least duration) so apply them manually
+	if flushPeriod, flushPeriodDefined := env["K6_ELASTICSEARCH_FLUSH_PERIOD"]; flushPeriodDefined {
+		if err := result.FlushPeriod.UnmarshalText([]byte(flushPeriod)); err != nil {
+			return result, fmt.Errorf("invalid K6_ELASTICSEARCH_FLUSH_PERIOD %q: %v", flushPeriod, err)
+		}
+	}
+
+	if maxBatchSize, err := getEnvInt(env, "K6_ELASTICSEARCH_MAX_BATCH_SIZE"); err != nil {
+		return result, err
+	} else {
+		if maxBatchSize.Valid {
+			result.MaxBatchSize = maxBatchSize
+		}
+	}
+	if maxBatchBytes, err := getEnvInt(env, "K6_ELASTICSEARCH_MAX_BATCH_BYTES"); err != nil {
+		return result, err
+	} else {
+		if maxBatchBytes.Valid {
+			result.MaxBatchBytes = maxBatchBytes
+		}
+	}
+
+	if compress, err := getEnvBool(env, "K6_ELASTICSEARCH_COMPRESS"); err != nil {
+		return result, err
+	} else {
+		if compress.Valid {
+			result.CompressRequestBody = compress
+		}
+	}
+
+	if maxRetries, err := getEnvInt(env, "K6_ELASTICSEARCH_MAX_RETRIES"); err != nil {
+		return result, err
+	} else {
+		if maxRetries.Valid {
+			result.MaxRetries = maxRetries
+		}
+	}
+	if retryBackoff, defined := env["K6_ELASTICSEARCH_RETRY_BACKOFF"]; defined {
+		if err := result.RetryBackoff.UnmarshalText([]byte(retryBackoff)); err != nil {
+			return result, err
+		}
+	}
+
+	if requestTimeout, defined := env["K6_ELASTICSEARCH_REQUEST_TIMEOUT"]; defined {
+		if err := result.RequestTimeout.UnmarshalText([]byte(requestTimeout)); err != nil {
+			return result, err
+		}
+	}
+
+	if url, defined := env["K6_ELASTICSEARCH_URL"]; defined {
+		result.Url = null.StringFrom(url)
+	}
+
+	if cloudId, defined := env["K6_ELASTICSEARCH_CLOUD_ID"]; defined {
+		result.CloudID = null.StringFrom(cloudId)
 	}
 
 	if ca, defined := env["K6_ELASTICSEARCH_CA_CERT_FILE"]; defined {
 		result.CACert = null.StringFrom(ca)
 	}
+	if caPEM, defined := env["K6_ELASTICSEARCH_CA_CERT_PEM"]; defined {
+		result.CACertPEM = null.StringFrom(caPEM)
+	}
 
+	if skipVerify, err := getEnvBool(env, "K6_ELASTICSEARCH_INSECURE_SKIP_TLS_VERIFY"); err != nil {
+		return result, err
+	} else {
+		if skipVerify.Valid {
+			result.InsecureSkipVerify = skipVerify
+		}
+	}
 	if skipVerify, err := getEnvBool(env, "K6_ELASTICSEARCH_INSECURE_SKIP_VERIFY"); err != nil {
 		return result, err
 	} else {
@@ -246,12 +1792,457 @@ func GetConsolidatedConfig(jsonRawConf json.RawMessage, env map[string]string, a
 	if apiKey, defined := env["K6_ELASTICSEARCH_API_KEY"]; defined {
 		result.APIKey = null.StringFrom(apiKey)
 	}
+	if serviceAccountToken, defined := env["K6_ELASTICSEARCH_SERVICE_TOKEN"]; defined {
+		result.ServiceAccountToken = null.StringFrom(serviceAccountToken)
+	}
 	if serviceAccountToken, defined := env["K6_ELASTICSEARCH_SERVICE_ACCOUNT_TOKEN"]; defined {
 		result.ServiceAccountToken = null.StringFrom(serviceAccountToken)
 	}
+	if indexName, defined := env["K6_ELASTICSEARCH_INDEX"]; defined {
+		result.IndexName = null.StringFrom(indexName)
+	}
 	if indexName, defined := env["K6_ELASTICSEARCH_INDEX_NAME"]; defined {
+		if alias, defined := env["K6_ELASTICSEARCH_INDEX"]; defined && alias != indexName {
+			result.aliasConflicts = append(result.aliasConflicts,
+				aliasConflict("K6_ELASTICSEARCH_INDEX", alias, "K6_ELASTICSEARCH_INDEX_NAME", indexName))
+		}
 		result.IndexName = null.StringFrom(indexName)
 	}
+	if useDataStream, err := getEnvBool(env, "K6_ELASTICSEARCH_USE_DATA_STREAM"); err != nil {
+		return result, err
+	} else {
+		if useDataStream.Valid {
+			result.UseDataStream = useDataStream
+		}
+	}
+	if pipeline, defined := env["K6_ELASTICSEARCH_PIPELINE"]; defined {
+		result.Pipeline = null.StringFrom(pipeline)
+	}
+	if customFields, defined := env["K6_ELASTICSEARCH_CUSTOM_FIELDS"]; defined {
+		if err := json.Unmarshal([]byte(customFields), &result.CustomFields); err != nil {
+			return result, fmt.Errorf("K6_ELASTICSEARCH_CUSTOM_FIELDS must be a JSON object: %v", err)
+		}
+	}
+	if headers, defined := env["K6_ELASTICSEARCH_HEADERS"]; defined {
+		if err := json.Unmarshal([]byte(headers), &result.Headers); err != nil {
+			return result, fmt.Errorf("K6_ELASTICSEARCH_HEADERS must be a JSON object: %v", err)
+		}
+	}
+	if bulkParams, defined := env["K6_ELASTICSEARCH_BULK_PARAMS"]; defined {
+		if err := json.Unmarshal([]byte(bulkParams), &result.BulkParams); err != nil {
+			return result, fmt.Errorf("K6_ELASTICSEARCH_BULK_PARAMS must be a JSON object: %v", err)
+		}
+	}
+	if indexRouting, defined := env["K6_ELASTICSEARCH_INDEX_ROUTING"]; defined {
+		if err := json.Unmarshal([]byte(indexRouting), &result.IndexRouting); err != nil {
+			return result, fmt.Errorf("K6_ELASTICSEARCH_INDEX_ROUTING must be a JSON object: %v", err)
+		}
+	}
+
+	if testRunID, defined := env["K6_ELASTICSEARCH_TEST_RUN_ID"]; defined {
+		result.TestRunID = null.StringFrom(testRunID)
+	}
+
+	if includeMetrics, defined := env["K6_ELASTICSEARCH_INCLUDE_METRICS"]; defined {
+		result.IncludeMetrics = splitList(includeMetrics)
+	}
+	if excludeMetrics, defined := env["K6_ELASTICSEARCH_EXCLUDE_METRICS"]; defined {
+		result.ExcludeMetrics = splitList(excludeMetrics)
+	}
+	if retryOnStatus, defined := env["K6_ELASTICSEARCH_RETRY_ON_STATUS"]; defined {
+		statuses, err := parseStatusList(splitList(retryOnStatus))
+		if err != nil {
+			return result, err
+		}
+		result.RetryOnStatus = statuses
+	}
+
+	if dropTags, defined := env["K6_ELASTICSEARCH_DROP_TAGS"]; defined {
+		result.DropTags = splitList(dropTags)
+	}
+	if keepTags, defined := env["K6_ELASTICSEARCH_KEEP_TAGS"]; defined {
+		result.KeepTags = splitList(keepTags)
+	}
+
+	if timestampField, defined := env["K6_ELASTICSEARCH_TIMESTAMP_FIELD"]; defined {
+		result.TimestampField = null.StringFrom(timestampField)
+	}
+	if timestampPrecision, defined := env["K6_ELASTICSEARCH_TIMESTAMP_PRECISION"]; defined {
+		result.TimestampPrecision = null.StringFrom(timestampPrecision)
+	}
+	if ensureTemplate, err := getEnvBool(env, "K6_ELASTICSEARCH_ENSURE_TEMPLATE"); err != nil {
+		return result, err
+	} else {
+		if ensureTemplate.Valid {
+			result.EnsureIndexTemplate = ensureTemplate
+		}
+	}
+	if templateName, defined := env["K6_ELASTICSEARCH_TEMPLATE_NAME"]; defined {
+		result.IndexTemplateName = null.StringFrom(templateName)
+	}
+	if maxBufferedSamples, err := getEnvInt(env, "K6_ELASTICSEARCH_MAX_BUFFER"); err != nil {
+		return result, err
+	} else {
+		if maxBufferedSamples.Valid {
+			result.MaxBufferedSamples = maxBufferedSamples
+		}
+	}
+	if bufferOverflow, defined := env["K6_ELASTICSEARCH_BUFFER_OVERFLOW"]; defined {
+		result.BufferOverflow = null.StringFrom(bufferOverflow)
+	}
+	if concurrency, err := getEnvInt(env, "K6_ELASTICSEARCH_CONCURRENCY"); err != nil {
+		return result, err
+	} else {
+		if concurrency.Valid {
+			result.Concurrency = concurrency
+		}
+	}
+	if shutdownFlushTimeout, defined := env["K6_ELASTICSEARCH_SHUTDOWN_TIMEOUT"]; defined {
+		if err := result.ShutdownFlushTimeout.UnmarshalText([]byte(shutdownFlushTimeout)); err != nil {
+			return result, err
+		}
+	}
+	if openSearchCompat, err := getEnvBool(env, "K6_ELASTICSEARCH_OPENSEARCH_COMPAT"); err != nil {
+		return result, err
+	} else {
+		if openSearchCompat.Valid {
+			result.OpenSearchCompat = openSearchCompat
+		}
+	}
+	if serverless, err := getEnvBool(env, "K6_ELASTICSEARCH_SERVERLESS"); err != nil {
+		return result, err
+	} else {
+		if serverless.Valid {
+			result.Serverless = serverless
+		}
+	}
+
+	if opType, defined := env["K6_ELASTICSEARCH_OP_TYPE"]; defined {
+		result.OpType = null.StringFrom(opType)
+	}
+	if documentIDField, defined := env["K6_ELASTICSEARCH_DOCUMENT_ID_FIELD"]; defined {
+		result.DocumentIDField = null.StringFrom(documentIDField)
+	}
+	if proxy, defined := env["K6_ELASTICSEARCH_PROXY"]; defined {
+		result.Proxy = null.StringFrom(proxy)
+	}
+	if passwordFile, defined := env["K6_ELASTICSEARCH_PASSWORD_FILE"]; defined {
+		result.PasswordFile = null.StringFrom(passwordFile)
+	}
+	if apiKeyFile, defined := env["K6_ELASTICSEARCH_API_KEY_FILE"]; defined {
+		result.APIKeyFile = null.StringFrom(apiKeyFile)
+	}
+
+	if ecsMode, err := getEnvBool(env, "K6_ELASTICSEARCH_ECS"); err != nil {
+		return result, err
+	} else {
+		if ecsMode.Valid {
+			result.ECSMode = ecsMode
+		}
+	}
+	if sampleRate, err := getEnvFloat(env, "K6_ELASTICSEARCH_SAMPLE_RATE"); err != nil {
+		return result, err
+	} else {
+		if sampleRate.Valid {
+			result.SampleRate = sampleRate
+		}
+	}
+	if aggregateTrends, err := getEnvBool(env, "K6_ELASTICSEARCH_AGGREGATE_TRENDS"); err != nil {
+		return result, err
+	} else {
+		if aggregateTrends.Valid {
+			result.AggregateTrends = aggregateTrends
+		}
+	}
+	if disableProductCheck, err := getEnvBool(env, "K6_ELASTICSEARCH_DISABLE_PRODUCT_CHECK"); err != nil {
+		return result, err
+	} else {
+		if disableProductCheck.Valid {
+			result.DisableProductCheck = disableProductCheck
+		}
+	}
+	if refresh, defined := env["K6_ELASTICSEARCH_REFRESH"]; defined {
+		result.Refresh = null.StringFrom(refresh)
+	}
+	if routingField, defined := env["K6_ELASTICSEARCH_ROUTING_FIELD"]; defined {
+		result.RoutingField = null.StringFrom(routingField)
+	}
+
+	if dryRun, err := getEnvBool(env, "K6_ELASTICSEARCH_DRY_RUN"); err != nil {
+		return result, err
+	} else {
+		if dryRun.Valid {
+			result.DryRun = dryRun
+		}
+	}
+	if dryRunFile, defined := env["K6_ELASTICSEARCH_DRY_RUN_FILE"]; defined {
+		result.DryRunFile = null.StringFrom(dryRunFile)
+	}
+	if maxIdleConns, err := getEnvInt(env, "K6_ELASTICSEARCH_MAX_IDLE_CONNS"); err != nil {
+		return result, err
+	} else {
+		if maxIdleConns.Valid {
+			result.MaxIdleConns = maxIdleConns
+		}
+	}
+	if idleConnTimeout, defined := env["K6_ELASTICSEARCH_IDLE_CONN_TIMEOUT"]; defined {
+		if err := result.IdleConnTimeout.UnmarshalText([]byte(idleConnTimeout)); err != nil {
+			return result, err
+		}
+	}
+	if verifyConnection, err := getEnvBool(env, "K6_ELASTICSEARCH_VERIFY_CONNECTION"); err != nil {
+		return result, err
+	} else {
+		if verifyConnection.Valid {
+			result.VerifyConnection = verifyConnection
+		}
+	}
+	if tagsFormat, defined := env["K6_ELASTICSEARCH_TAGS_FORMAT"]; defined {
+		result.TagsFormat = null.StringFrom(tagsFormat)
+	}
+	if userAgent, defined := env["K6_ELASTICSEARCH_USER_AGENT"]; defined {
+		result.UserAgent = null.StringFrom(userAgent)
+	}
+	if summaryOnly, err := getEnvBool(env, "K6_ELASTICSEARCH_SUMMARY_ONLY"); err != nil {
+		return result, err
+	} else {
+		if summaryOnly.Valid {
+			result.SummaryOnly = summaryOnly
+		}
+	}
+	if markerIndex, defined := env["K6_ELASTICSEARCH_MARKER_INDEX"]; defined {
+		result.MarkerIndex = null.StringFrom(markerIndex)
+	}
+	if sourceExclude, defined := env["K6_ELASTICSEARCH_SOURCE_EXCLUDE"]; defined {
+		result.SourceExclude = splitList(sourceExclude)
+	}
+	if valueField, defined := env["K6_ELASTICSEARCH_VALUE_FIELD"]; defined {
+		result.ValueField = null.StringFrom(valueField)
+	}
+	if metricNameField, defined := env["K6_ELASTICSEARCH_METRIC_NAME_FIELD"]; defined {
+		result.MetricNameField = null.StringFrom(metricNameField)
+	}
+	if discoverNodesOnStart, err := getEnvBool(env, "K6_ELASTICSEARCH_DISCOVER_NODES"); err != nil {
+		return result, err
+	} else {
+		if discoverNodesOnStart.Valid {
+			result.DiscoverNodesOnStart = discoverNodesOnStart
+		}
+	}
+	if discoverNodesInterval, defined := env["K6_ELASTICSEARCH_DISCOVER_INTERVAL"]; defined {
+		if err := result.DiscoverNodesInterval.UnmarshalText([]byte(discoverNodesInterval)); err != nil {
+			return result, err
+		}
+	}
+	if retryJitter, err := getEnvBool(env, "K6_ELASTICSEARCH_RETRY_JITTER"); err != nil {
+		return result, err
+	} else {
+		if retryJitter.Valid {
+			result.RetryJitter = retryJitter
+		}
+	}
+	if targetIsAlias, err := getEnvBool(env, "K6_ELASTICSEARCH_TARGET_IS_ALIAS"); err != nil {
+		return result, err
+	} else {
+		if targetIsAlias.Valid {
+			result.TargetIsAlias = targetIsAlias
+		}
+	}
+	if promoteTags, defined := env["K6_ELASTICSEARCH_PROMOTE_TAGS"]; defined {
+		result.PromoteTags = splitList(promoteTags)
+	}
+	if metricPrefix, defined := env["K6_ELASTICSEARCH_METRIC_PREFIX"]; defined {
+		result.MetricPrefix = null.StringFrom(metricPrefix)
+	}
+	if replaceDots, err := getEnvBool(env, "K6_ELASTICSEARCH_REPLACE_DOTS"); err != nil {
+		return result, err
+	} else {
+		if replaceDots.Valid {
+			result.ReplaceDots = replaceDots
+		}
+	}
+	if maxInFlightRequests, err := getEnvInt(env, "K6_ELASTICSEARCH_MAX_INFLIGHT"); err != nil {
+		return result, err
+	} else {
+		if maxInFlightRequests.Valid {
+			result.MaxInFlightRequests = maxInFlightRequests
+		}
+	}
+	if opaqueIDPrefix, defined := env["K6_ELASTICSEARCH_OPAQUE_ID_PREFIX"]; defined {
+		result.OpaqueIDPrefix = null.StringFrom(opaqueIDPrefix)
+	}
+	if includeMetricTypes, defined := env["K6_ELASTICSEARCH_INCLUDE_METRIC_TYPES"]; defined {
+		result.IncludeMetricTypes = splitList(includeMetricTypes)
+	}
+	if excludeMetricTypes, defined := env["K6_ELASTICSEARCH_EXCLUDE_METRIC_TYPES"]; defined {
+		result.ExcludeMetricTypes = splitList(excludeMetricTypes)
+	}
+	if statsInterval, defined := env["K6_ELASTICSEARCH_STATS_INTERVAL"]; defined {
+		if err := result.StatsInterval.UnmarshalText([]byte(statsInterval)); err != nil {
+			return result, err
+		}
+	}
+	if fallbackUrl, defined := env["K6_ELASTICSEARCH_FALLBACK_URL"]; defined {
+		result.FallbackUrl = null.StringFrom(fallbackUrl)
+	}
+	if fallbackCloudID, defined := env["K6_ELASTICSEARCH_FALLBACK_CLOUD_ID"]; defined {
+		result.FallbackCloudID = null.StringFrom(fallbackCloudID)
+	}
+	if failoverAfter, err := getEnvInt(env, "K6_ELASTICSEARCH_FAILOVER_AFTER"); err != nil {
+		return result, err
+	} else {
+		if failoverAfter.Valid {
+			result.FailoverAfter = failoverAfter
+		}
+	}
+	if compressionLevel, err := getEnvInt(env, "K6_ELASTICSEARCH_COMPRESSION_LEVEL"); err != nil {
+		return result, err
+	} else {
+		if compressionLevel.Valid {
+			result.CompressionLevel = compressionLevel
+		}
+	}
+	if numericTags, defined := env["K6_ELASTICSEARCH_NUMERIC_TAGS"]; defined {
+		result.NumericTags = splitList(numericTags)
+	}
+	if booleanTags, defined := env["K6_ELASTICSEARCH_BOOLEAN_TAGS"]; defined {
+		result.BooleanTags = splitList(booleanTags)
+	}
+	if onlyBreaches, err := getEnvBool(env, "K6_ELASTICSEARCH_ONLY_BREACHES"); err != nil {
+		return result, err
+	} else {
+		if onlyBreaches.Valid {
+			result.OnlyBreaches = onlyBreaches
+		}
+	}
+	if panicPolicy, defined := env["K6_ELASTICSEARCH_PANIC_POLICY"]; defined {
+		result.PanicPolicy = null.StringFrom(panicPolicy)
+	}
+	if idStrategy, defined := env["K6_ELASTICSEARCH_ID_STRATEGY"]; defined {
+		result.IDStrategy = null.StringFrom(idStrategy)
+	}
+	if idHash, defined := env["K6_ELASTICSEARCH_ID_HASH"]; defined {
+		result.IDHash = null.StringFrom(idHash)
+	}
+	if compatibilityMode, err := getEnvBool(env, "K6_ELASTICSEARCH_COMPAT_HEADER"); err != nil {
+		return result, err
+	} else {
+		if compatibilityMode.Valid {
+			result.CompatibilityMode = compatibilityMode
+		}
+	}
+	if promoteVUFields, err := getEnvBool(env, "K6_ELASTICSEARCH_PROMOTE_VU_FIELDS"); err != nil {
+		return result, err
+	} else {
+		if promoteVUFields.Valid {
+			result.PromoteVUFields = promoteVUFields
+		}
+	}
+	if flushTrigger, defined := env["K6_ELASTICSEARCH_FLUSH_TRIGGER"]; defined {
+		result.FlushTrigger = null.StringFrom(flushTrigger)
+	}
+	if failOnDrop, err := getEnvBool(env, "K6_ELASTICSEARCH_FAIL_ON_DROP"); err != nil {
+		return result, err
+	} else {
+		if failOnDrop.Valid {
+			result.FailOnDrop = failOnDrop
+		}
+	}
+	if useSampleTimeForIndex, err := getEnvBool(env, "K6_ELASTICSEARCH_USE_SAMPLE_TIME_FOR_INDEX"); err != nil {
+		return result, err
+	} else {
+		if useSampleTimeForIndex.Valid {
+			result.UseSampleTimeForIndex = useSampleTimeForIndex
+		}
+	}
+	if startupRetries, err := getEnvInt(env, "K6_ELASTICSEARCH_STARTUP_RETRIES"); err != nil {
+		return result, err
+	} else {
+		if startupRetries.Valid {
+			result.StartupRetries = startupRetries
+		}
+	}
+	if startupRetryDelay, defined := env["K6_ELASTICSEARCH_STARTUP_RETRY_DELAY"]; defined {
+		if err := result.StartupRetryDelay.UnmarshalText([]byte(startupRetryDelay)); err != nil {
+			return result, err
+		}
+	}
+	if groupLevels, err := getEnvBool(env, "K6_ELASTICSEARCH_GROUP_LEVELS"); err != nil {
+		return result, err
+	} else {
+		if groupLevels.Valid {
+			result.GroupLevels = groupLevels
+		}
+	}
+	if fastEncoder, err := getEnvBool(env, "K6_ELASTICSEARCH_FAST_ENCODER"); err != nil {
+		return result, err
+	} else {
+		if fastEncoder.Valid {
+			result.FastEncoder = fastEncoder
+		}
+	}
+	if bulkPerIndex, err := getEnvBool(env, "K6_ELASTICSEARCH_BULK_PER_INDEX"); err != nil {
+		return result, err
+	} else {
+		if bulkPerIndex.Valid {
+			result.BulkPerIndex = bulkPerIndex
+		}
+	}
+	if tlsMinVersion, defined := env["K6_ELASTICSEARCH_TLS_MIN_VERSION"]; defined {
+		result.TLSMinVersion = null.StringFrom(tlsMinVersion)
+	}
+	if tlsCipherSuites, defined := env["K6_ELASTICSEARCH_TLS_CIPHER_SUITES"]; defined {
+		result.TLSCipherSuites = splitList(tlsCipherSuites)
+	}
+	if circuitBreakerAfter, err := getEnvInt(env, "K6_ELASTICSEARCH_CIRCUIT_BREAKER_AFTER"); err != nil {
+		return result, err
+	} else {
+		if circuitBreakerAfter.Valid {
+			result.CircuitBreakerAfter = circuitBreakerAfter
+		}
+	}
+	if circuitBreakerCooldown, defined := env["K6_ELASTICSEARCH_CIRCUIT_BREAKER_COOLDOWN"]; defined {
+		if err := result.CircuitBreakerCooldown.UnmarshalText([]byte(circuitBreakerCooldown)); err != nil {
+			return result, err
+		}
+	}
+	if fileOutput, defined := env["K6_ELASTICSEARCH_FILE_OUTPUT"]; defined {
+		result.FileOutput = null.StringFrom(fileOutput)
+	}
+	if fileMaxBytes, err := getEnvInt(env, "K6_ELASTICSEARCH_FILE_MAX_BYTES"); err != nil {
+		return result, err
+	} else {
+		if fileMaxBytes.Valid {
+			result.FileMaxBytes = fileMaxBytes
+		}
+	}
+	if maxTagValueLength, err := getEnvInt(env, "K6_ELASTICSEARCH_MAX_TAG_VALUE_LENGTH"); err != nil {
+		return result, err
+	} else {
+		if maxTagValueLength.Valid {
+			result.MaxTagValueLength = maxTagValueLength
+		}
+	}
+	if metricMetadata, err := getEnvBool(env, "K6_ELASTICSEARCH_METRIC_METADATA"); err != nil {
+		return result, err
+	} else {
+		if metricMetadata.Valid {
+			result.MetricMetadata = metricMetadata
+		}
+	}
+	if createIndex, err := getEnvBool(env, "K6_ELASTICSEARCH_CREATE_INDEX"); err != nil {
+		return result, err
+	} else {
+		if createIndex.Valid {
+			result.CreateIndex = createIndex
+		}
+	}
+	if docTypeField, defined := env["K6_ELASTICSEARCH_DOC_TYPE_FIELD"]; defined {
+		result.DocTypeField = null.StringFrom(docTypeField)
+	}
+	if waitForActiveShards, defined := env["K6_ELASTICSEARCH_WAIT_FOR_ACTIVE_SHARDS"]; defined {
+		result.WaitForActiveShards = null.StringFrom(waitForActiveShards)
+	}
 
 	if arg != "" {
 		argConf, err := ParseArg(arg)
@@ -262,5 +2253,79 @@ func GetConsolidatedConfig(jsonRawConf json.RawMessage, env map[string]string, a
 		result = result.Apply(argConf)
 	}
 
-	return result, nil
+	result = result.expandEnv(env)
+	return result.readSecretFiles()
+}
+
+// aliasConflict describes that an alias and the option it stands for are set to different values, of which the
+// option wins.
+func aliasConflict(alias, aliasValue, name, value string) string {
+	return fmt.Sprintf("both %s=%q and %s=%q are configured, using %s", alias, aliasValue, name, value, name)
+}
+
+// envReference matches a reference to an environment variable like ${CI_PIPELINE_ID}.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces references to environment variables in the index name, the pipeline and the custom fields.
+// Variables that are not set are replaced by an empty string and recorded in undefinedVars.
+func (c Config) expandEnv(env map[string]string) Config {
+	expand := func(value string) string {
+		return envReference.ReplaceAllStringFunc(value, func(reference string) string {
+			name := envReference.FindStringSubmatch(reference)[1]
+			value, ok := env[name]
+			if !ok && !contains(c.undefinedVars, name) {
+				c.undefinedVars = append(c.undefinedVars, name)
+			}
+			return value
+		})
+	}
+	if c.IndexName.Valid {
+		c.IndexName = null.StringFrom(expand(c.IndexName.String))
+	}
+	if c.Pipeline.Valid {
+		c.Pipeline = null.StringFrom(expand(c.Pipeline.String))
+	}
+	if len(c.CustomFields) > 0 {
+		fields := make(map[string]string, len(c.CustomFields))
+		for name, value := range c.CustomFields {
+			fields[name] = expand(value)
+		}
+		c.CustomFields = fields
+	}
+	return c
+}
+
+// readSecretFiles loads the password and API key from files, e.g. mounted secrets, so that they don't show up in
+// the arguments or the environment of the process.
+func (c Config) readSecretFiles() (Config, error) {
+	for _, secret := range []struct {
+		name, fileName string
+		value          *null.String
+		file           null.String
+	}{
+		{"password", "passwordFile", &c.Password, c.PasswordFile},
+		{"apiKey", "apiKeyFile", &c.APIKey, c.APIKeyFile},
+	} {
+		if !secret.file.Valid {
+			continue
+		}
+		if secret.value.Valid {
+			return c, fmt.Errorf("only one of %s and %s may be configured", secret.name, secret.fileName)
+		}
+		value, err := readSecretFile(secret.file.String)
+		if err != nil {
+			return c, fmt.Errorf("cannot read %s: %v", secret.fileName, err)
+		}
+		*secret.value = null.StringFrom(value)
+	}
+	return c, nil
+}
+
+// readSecretFile returns the content of a file holding a secret without the trailing line break.
+func readSecretFile(name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
 }
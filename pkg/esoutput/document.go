@@ -0,0 +1,531 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.k6.io/k6/metrics"
+)
+
+// The supported representations of timestamps.
+const (
+	timestampRFC3339 = "rfc3339"
+	timestampSeconds = "s"
+	timestampMillis  = "ms"
+	timestampMicros  = "us"
+	timestampNanos   = "ns"
+)
+
+// The supported representations of tags.
+const (
+	// all tags are stored in the object Tags
+	tagsFormatNested = "nested"
+	// every tag is stored in its own top-level field prefixed with tagFieldPrefix
+	tagsFormatFlat = "flat"
+)
+
+const tagFieldPrefix = "tag_"
+
+// tagValueEllipsis marks the tag values truncated to maxTagValueLength.
+const tagValueEllipsis = "…"
+
+// The values of docTypeField for the categories of documents.
+const (
+	docTypeMetric  = "metric"
+	docTypeCheck   = "check"
+	docTypeSummary = "summary"
+	docTypeMarker  = "marker"
+)
+
+// documentField is a single top-level field of a metric document.
+type documentField struct {
+	Name  string
+	Value interface{}
+}
+
+// elasticMetricEntry is the document indexed for a sample. It is a list of fields rather than a struct so that field
+// names can be configured while keeping the fields in a stable order.
+type elasticMetricEntry []documentField
+
+// MarshalJSON encodes the entry as a JSON object with the fields in order.
+func (e elasticMetricEntry) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range e {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(field.Name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Bulk actions for indexing documents.
+const (
+	opTypeIndex  = "index"
+	opTypeCreate = "create"
+)
+
+// Strategies for generating document ids, by default Elasticsearch generates them.
+const (
+	// the id is a hash of the metric name, the timestamp and the tags of a sample
+	idStrategyHash = "hash"
+)
+
+// The hash functions for idStrategyHash.
+const (
+	idHashFNV  = "fnv"
+	idHashSHA1 = "sha1"
+)
+
+// opType returns the configured bulk action. Without document ids both are equivalent, but only create works with
+// data streams and skips documents with a hashed id that already exist.
+func (c Config) opType() string {
+	if c.OpType.Valid {
+		return c.OpType.String
+	}
+	if c.UseDataStream.Bool || c.IDStrategy.String == idStrategyHash {
+		return opTypeCreate
+	}
+	return opTypeIndex
+}
+
+// timestampField returns the name of the field holding the timestamp of a sample, which is always @timestamp in
+// ECS mode.
+func (c Config) timestampField() string {
+	if c.ECSMode.Bool {
+		return "@timestamp"
+	}
+	return c.TimestampField.String
+}
+
+// metricName returns the name of a metric as stored in the documents, with dots replaced if configured and the
+// prefix prepended.
+func (c Config) metricName(name string) string {
+	if c.ReplaceDots.Bool {
+		name = strings.ReplaceAll(name, ".", "_")
+	}
+	return c.MetricPrefix.String + name
+}
+
+// documentFields returns the names of the top-level fields of the metric and marker documents.
+func (c Config) documentFields() []string {
+	var fields []string
+	if c.DocTypeField.String != "" {
+		fields = append(fields, c.DocTypeField.String)
+	}
+	if c.ECSMode.Bool {
+		return append(fields, "@timestamp", "event", "labels", "k6")
+	}
+	fields = append(fields, c.MetricNameField.String, "MetricType", c.ValueField.String, c.timestampField(),
+		"test_run_id", "check_name", "passed", "group", "Summary", "event_type", "test_name", "vu", "iteration",
+		"group_levels", "metric_unit", "metric_contains")
+	if c.TagsFormat.String != tagsFormatFlat {
+		fields = append(fields, "Tags")
+	}
+	if c.UseDataStream.Bool && c.timestampField() != "@timestamp" {
+		fields = append(fields, "@timestamp")
+	}
+	return fields
+}
+
+// newEntry maps a sample to the document that is indexed for it.
+func (o *Output) newEntry(sample metrics.Sample) elasticMetricEntry {
+	return o.newDocument(sample, nil)
+}
+
+// newSummaryEntry maps the aggregated samples of a trend metric to a single document. Its value is the average.
+func (o *Output) newSummaryEntry(aggregate trendAggregate) elasticMetricEntry {
+	sample := metrics.Sample{TimeSeries: aggregate.series, Time: aggregate.time, Value: aggregate.summary.Avg}
+	return o.newDocument(sample, &aggregate.summary)
+}
+
+// newSummaryDocument maps the end-of-test summary of a metric to a document, stamped with the end of the test.
+func (o *Output) newSummaryDocument(summary metricSummary, end time.Time) (elasticMetricEntry, metrics.Sample) {
+	sample := metrics.Sample{TimeSeries: summary.series, Time: end, Value: summary.value}
+	return o.newDocument(sample, summary.summary), sample
+}
+
+// newDocument maps a sample to a document in the configured format. The summary of aggregated samples, if any, is
+// stored along with it.
+func (o *Output) newDocument(sample metrics.Sample, summary interface{}) elasticMetricEntry {
+	var entry elasticMetricEntry
+	if o.config.ECSMode.Bool {
+		entry = o.newECSEntry(sample, summary)
+	} else {
+		entry = elasticMetricEntry{
+			{o.config.MetricNameField.String, o.config.metricName(sample.Metric.Name)},
+			{"MetricType", sample.Metric.Type.String()},
+			{o.config.ValueField.String, sample.Value},
+		}
+		if o.config.MetricMetadata.Bool {
+			contains, unit := metricMetadata(sample.Metric)
+			entry = append(entry, documentField{"metric_contains", contains})
+			if unit != "" {
+				entry = append(entry, documentField{"metric_unit", unit})
+			}
+		}
+		tags := sample.GetTags().Map()
+		// promoted tags are kept even if they would be dropped otherwise
+		for _, name := range o.config.PromoteTags {
+			if value, ok := tags[name]; ok {
+				entry = append(entry, documentField{name, o.tagValue(name, o.truncateTagValue(value))})
+				delete(tags, name)
+			}
+		}
+		tags = o.filterTags(tags)
+		if o.config.TagsFormat.String == tagsFormatFlat {
+			names := make([]string, 0, len(tags))
+			for name := range tags {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				entry = append(entry, documentField{tagFieldPrefix + name, o.tagValue(name, tags[name])})
+			}
+		} else {
+			entry = append(entry, documentField{"Tags", o.typedTags(tags)})
+		}
+		entry = append(entry, documentField{o.config.timestampField(), o.timestamp(sample.Time)})
+		// data streams require this field
+		if o.config.UseDataStream.Bool && o.config.timestampField() != "@timestamp" {
+			entry = append(entry, documentField{"@timestamp", o.timestamp(sample.Time)})
+		}
+		entry = append(entry, documentField{"test_run_id", o.config.TestRunID.String})
+		entry = append(entry, o.vuFields(sample)...)
+		if levels := o.groupLevels(sample); levels != nil {
+			entry = append(entry, documentField{"group_levels", levels})
+		}
+		// a summary covers all checks
+		if check, ok := checkResult(sample); ok && summary == nil {
+			entry = append(entry,
+				documentField{"check_name", check.Name},
+				documentField{"passed", check.Passed})
+			// a promoted group tag has the same value
+			if !contains(o.config.PromoteTags, "group") {
+				entry = append(entry, documentField{"group", check.Group})
+			}
+		}
+		if summary != nil {
+			entry = append(entry, documentField{"Summary", summary})
+		}
+	}
+	docType := docTypeMetric
+	if summary != nil {
+		docType = docTypeSummary
+	} else if _, ok := checkResult(sample); ok {
+		docType = docTypeCheck
+	}
+	entry = append(entry, o.docTypeFields(docType)...)
+	return append(entry, o.customFields()...)
+}
+
+// docTypeFields returns the field telling the category of a document apart if docTypeField is set.
+func (o *Output) docTypeFields(docType string) []documentField {
+	if o.config.DocTypeField.String == "" {
+		return nil
+	}
+	return []documentField{{o.config.DocTypeField.String, docType}}
+}
+
+// customFields returns the configured custom fields sorted by name.
+func (o *Output) customFields() []documentField {
+	names := make([]string, 0, len(o.config.CustomFields))
+	for name := range o.config.CustomFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := make([]documentField, 0, len(names))
+	for _, name := range names {
+		fields = append(fields, documentField{name, o.config.CustomFields[name]})
+	}
+	return fields
+}
+
+// newECSEntry maps a sample to a document following the Elastic Common Schema. Tags become labels, and the metric
+// itself, which has no equivalent in ECS, is stored in the k6 namespace.
+func (o *Output) newECSEntry(sample metrics.Sample, summary interface{}) elasticMetricEntry {
+	metric := map[string]interface{}{
+		"name":  o.config.metricName(sample.Metric.Name),
+		"type":  sample.Metric.Type.String(),
+		"value": sample.Value,
+	}
+	if summary != nil {
+		metric["summary"] = summary
+	}
+	if o.config.MetricMetadata.Bool {
+		contains, unit := metricMetadata(sample.Metric)
+		metric["contains"] = contains
+		if unit != "" {
+			metric["unit"] = unit
+		}
+	}
+	k6 := map[string]interface{}{
+		"metric":      metric,
+		"test_run_id": o.config.TestRunID.String,
+	}
+	if check, ok := checkResult(sample); ok && summary == nil {
+		k6["check"] = check
+	}
+	for _, field := range o.vuFields(sample) {
+		k6[field.Name] = field.Value
+	}
+	if levels := o.groupLevels(sample); levels != nil {
+		k6["group_levels"] = levels
+	}
+	return elasticMetricEntry{
+		{"@timestamp", o.timestamp(sample.Time)},
+		{"event", map[string]string{"dataset": "k6", "kind": "metric"}},
+		{"labels", o.filterTags(sample.GetTags().Map())},
+		{"k6", k6},
+	}
+}
+
+// metricMetadata returns the kind of values a metric contains (default, time or data) and the unit k6 records
+// them in, which is empty for plain numbers.
+func metricMetadata(metric *metrics.Metric) (contains, unit string) {
+	switch metric.Contains {
+	case metrics.Time:
+		return metric.Contains.String(), "ms"
+	case metrics.Data:
+		return metric.Contains.String(), "bytes"
+	default:
+		return metric.Contains.String(), ""
+	}
+}
+
+// vuFields returns the number of the VU and the iteration that emitted a sample if promoteVUFields is enabled.
+// k6 records them as metadata rather than tags, and only if the vu and iter system tags are enabled.
+func (o *Output) vuFields(sample metrics.Sample) []documentField {
+	if !o.config.PromoteVUFields.Bool {
+		return nil
+	}
+	var fields []documentField
+	for _, key := range []struct{ metadata, field string }{{"vu", "vu"}, {"iter", "iteration"}} {
+		if n, err := strconv.ParseInt(sample.Metadata[key.metadata], 10, 64); err == nil {
+			fields = append(fields, documentField{key.field, n})
+		}
+	}
+	return fields
+}
+
+// groupLevels splits the path in the group tag of a sample into the names of the nested groups if groupLevels is
+// enabled, e.g. ::a::b into [a b]. The tag is read before the tags are filtered, and samples outside of any group
+// have no levels.
+func (o *Output) groupLevels(sample metrics.Sample) []string {
+	if !o.config.GroupLevels.Bool {
+		return nil
+	}
+	group, _ := sample.GetTags().Get("group")
+	var levels []string
+	for _, name := range strings.Split(group, "::") {
+		// paths start with the separator, the root group has no name
+		if name != "" {
+			levels = append(levels, name)
+		}
+	}
+	return levels
+}
+
+// check is the result of a single k6 check.
+type check struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Group  string `json:"group"`
+}
+
+// checkResult extracts the result of a check from a sample of the checks metric, which carries it in its tags and
+// its value (1 for passed, 0 for failed). Its fields are set even if the tags are dropped from the documents so
+// that pass rates can be charted.
+func checkResult(sample metrics.Sample) (check, bool) {
+	if sample.Metric.Name != metrics.ChecksName {
+		return check{}, false
+	}
+	tags := sample.GetTags()
+	name, _ := tags.Get("check")
+	group, _ := tags.Get("group")
+	return check{Name: name, Passed: sample.Value != 0, Group: group}, true
+}
+
+// timestamp formats t according to the configured precision. Elasticsearch has no epoch format with a higher
+// resolution than milliseconds, therefore microseconds and nanoseconds are represented as the fraction of epoch
+// milliseconds, which date_nanos fields accept.
+func (o *Output) timestamp(t time.Time) interface{} {
+	switch o.config.TimestampPrecision.String {
+	case timestampSeconds:
+		return t.Unix()
+	case timestampMillis:
+		return t.UnixMilli()
+	case timestampMicros:
+		return json.Number(fmt.Sprintf("%d.%03d", t.UnixMilli(), t.UnixMicro()%1000))
+	case timestampNanos:
+		return json.Number(fmt.Sprintf("%d.%06d", t.UnixMilli(), t.UnixNano()%1_000_000))
+	default:
+		return t
+	}
+}
+
+// filterTags applies keepTags, dropTags and the systemTags of k6 to the tags of a sample and truncates the values
+// that are kept. The map is modified in place.
+func (o *Output) filterTags(tags map[string]string) map[string]string {
+	for name, value := range tags {
+		if (len(o.keepTags) > 0 && !o.keepTags[name]) || o.dropTags[name] || o.disabledSystemTags[name] {
+			delete(tags, name)
+		} else {
+			tags[name] = o.truncateTagValue(value)
+		}
+	}
+	return tags
+}
+
+// truncateTagValue shortens values longer than maxTagValueLength characters to that length, the last character
+// being an ellipsis. Longer values would otherwise not be indexed once they exceed ignore_above of the keyword
+// mapping.
+func (o *Output) truncateTagValue(value string) string {
+	limit := int(o.config.MaxTagValueLength.Int64)
+	if limit == 0 || len(value) <= limit || utf8.RuneCountInString(value) <= limit {
+		return value
+	}
+	runes := []rune(value)
+	return string(runes[:limit-1]) + tagValueEllipsis
+}
+
+// typedTags converts the values of numericTags and booleanTags, the map is returned as is if there are none.
+func (o *Output) typedTags(tags map[string]string) interface{} {
+	if len(o.numericTags) == 0 && len(o.booleanTags) == 0 {
+		return tags
+	}
+	typed := make(map[string]interface{}, len(tags))
+	for name, value := range tags {
+		typed[name] = o.tagValue(name, value)
+	}
+	return typed
+}
+
+// tagValue converts the value of a tag to a number or a boolean if it is listed in numericTags or booleanTags.
+// Values that cannot be converted are stored as null, as Elasticsearch would reject them once the field is mapped
+// with that type.
+func (o *Output) tagValue(name, value string) interface{} {
+	switch {
+	case o.numericTags[name]:
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i
+		}
+		if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return f
+		}
+		return nil
+	case o.booleanTags[name]:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+		return nil
+	default:
+		return value
+	}
+}
+
+// documentID returns the id of the document, taken from the configured document field or else the tag with that
+// name. It returns an empty string to let Elasticsearch generate an id.
+func (o *Output) documentID(entry elasticMetricEntry, sample metrics.Sample) string {
+	if o.config.IDStrategy.String == idStrategyHash {
+		return o.hashID(sample)
+	}
+	name := o.config.DocumentIDField.String
+	if name == "" {
+		return ""
+	}
+	for _, field := range entry {
+		if field.Name != name || field.Name == "Tags" {
+			continue
+		}
+		switch v := field.Value.(type) {
+		case time.Time:
+			return v.Format(time.RFC3339Nano)
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+	if v, ok := sample.GetTags().Get(name); ok {
+		return v
+	}
+	return ""
+}
+
+// hashID returns a deterministic id for a sample, so that sending the same samples again doesn't create duplicates.
+func (o *Output) hashID(sample metrics.Sample) string {
+	var h hash.Hash
+	if o.config.IDHash.String == idHashSHA1 {
+		h = sha1.New()
+	} else {
+		h = fnv.New64a()
+	}
+	tags := sample.GetTags().Map()
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// the quotes keep different combinations of names and values apart, e.g. if a value contains the separators
+	fmt.Fprintf(h, "%s\x00%d", sample.Metric.Name, sample.Time.UnixNano())
+	for _, name := range names {
+		fmt.Fprintf(h, "\x00%q=%q", name, tags[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// routing returns the value of the configured routing tag, or an empty string for the default routing if the
+// sample doesn't have this tag.
+func (o *Output) routing(sample metrics.Sample) string {
+	if !o.config.RoutingField.Valid {
+		return ""
+	}
+	v, _ := sample.GetTags().Get(o.config.RoutingField.String)
+	return v
+}
@@ -0,0 +1,935 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guregu/null/v5"
+	"github.com/sirupsen/logrus/hooks/test"
+	"go.k6.io/k6/metrics"
+	"go.k6.io/k6/output"
+)
+
+// newOfflineOutput creates an output with the given argument that is never started, e.g. to map samples to
+// documents.
+func newOfflineOutput(t testing.TB, arg string) *Output {
+	t.Helper()
+	logger, _ := test.NewNullLogger()
+	out, err := New(output.Params{Logger: logger, ConfigArgument: arg, Environment: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.(*Output)
+}
+
+// encodeDocument returns the document the output indexes for the sample as decoded JSON.
+func encodeDocument(t *testing.T, o *Output, sample metrics.Sample) map[string]interface{} {
+	t.Helper()
+	data, err := o.encode(o.newEntry(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		t.Fatalf("invalid document %s: %v", data, err)
+	}
+	return document
+}
+
+// newTestSample returns a sample of a counter with only the given tags.
+func newTestSample(tags map[string]string) metrics.Sample {
+	sample := newTestSamples(1)[0].(metrics.Sample)
+	sample.Tags = sample.Tags.Without("i").WithTagsFromMap(tags)
+	return sample
+}
+
+func TestCustomFields(t *testing.T) {
+	o := newOfflineOutput(t, "customFields.env=staging,customFields.team=payments")
+	document := encodeDocument(t, o, newTestSample(nil))
+	for name, want := range map[string]string{"env": "staging", "team": "payments"} {
+		if got := document[name]; got != want {
+			t.Errorf("got %s %v, want %q", name, got, want)
+		}
+	}
+	if document["MetricName"] != "test_counter" {
+		t.Errorf("got metric %v, want the fields of the sample to be kept", document["MetricName"])
+	}
+
+	for _, name := range []string{"MetricName", "Value", "Time", "Tags", "test_run_id"} {
+		t.Run(name, func(t *testing.T) {
+			config, err := GetConsolidatedConfig(nil, map[string]string{
+				"K6_ELASTICSEARCH_CUSTOM_FIELDS": `{"` + name + `":"x"}`,
+			}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "collides") {
+				t.Errorf("got error %v, want the custom field %s to collide", err, name)
+			}
+		})
+	}
+}
+
+func TestDropAndKeepTags(t *testing.T) {
+	sample := newTestSample(map[string]string{
+		"method": "GET", "status": "200", "url": "https://test.k6.io", "name": "home", "scenario": "default",
+	})
+	tests := []struct {
+		name string
+		arg  string
+		want map[string]interface{}
+	}{
+		{
+			name: "all",
+			want: map[string]interface{}{
+				"method": "GET", "status": "200", "url": "https://test.k6.io", "name": "home", "scenario": "default",
+			},
+		},
+		{
+			name: "drop",
+			arg:  "dropTags={url,name}",
+			want: map[string]interface{}{"method": "GET", "status": "200", "scenario": "default"},
+		},
+		{
+			name: "keep",
+			arg:  "keepTags={method,status}",
+			want: map[string]interface{}{"method": "GET", "status": "200"},
+		},
+		{
+			name: "keep and drop",
+			arg:  "keepTags={method,status},dropTags=status",
+			want: map[string]interface{}{"method": "GET"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			document := encodeDocument(t, newOfflineOutput(t, tt.arg), sample)
+			if !reflect.DeepEqual(document["Tags"], tt.want) {
+				t.Errorf("got tags %v, want %v", document["Tags"], tt.want)
+			}
+		})
+	}
+}
+
+func TestTimestampField(t *testing.T) {
+	sample := newTestSample(nil)
+	document := encodeDocument(t, newOfflineOutput(t, "timestampField=@timestamp"), sample)
+	if got, want := document["@timestamp"], float64(sample.Time.UnixMilli()); got != want {
+		t.Errorf("got @timestamp %v, want %v", got, want)
+	}
+	if _, ok := document["Time"]; ok {
+		t.Error("the timestamp is also stored in the default field Time")
+	}
+}
+
+func TestTimestampPrecision(t *testing.T) {
+	sample := newTestSample(nil)
+	sample.Time = time.Date(2024, 3, 1, 12, 34, 56, 123456789, time.UTC)
+	tests := []struct {
+		precision string
+		want      string
+	}{
+		{precision: "s", want: "1709296496"},
+		{precision: "ms", want: "1709296496123"},
+		{precision: "us", want: "1709296496123.456"},
+		{precision: "ns", want: "1709296496123.456789"},
+		{precision: "rfc3339", want: `"2024-03-01T12:34:56.123456789Z"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.precision, func(t *testing.T) {
+			o := newOfflineOutput(t, "timestampPrecision="+tt.precision)
+			data, err := o.encode(o.newEntry(sample))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var document map[string]json.RawMessage
+			if err := json.Unmarshal(data, &document); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(document["Time"]); got != tt.want {
+				t.Errorf("got Time %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	config := NewConfig()
+	config.TimestampPrecision = null.StringFrom("minutes")
+	if err := config.Validate(); err == nil {
+		t.Error("got no error for an unknown timestampPrecision")
+	}
+}
+
+func TestEpochSecondTimestamp(t *testing.T) {
+	o := newOfflineOutput(t, "timestampPrecision=s")
+	for _, at := range []time.Time{
+		time.Date(2024, 3, 1, 12, 34, 56, 0, time.UTC),
+		// the fraction is cut off, not rounded
+		time.Date(2024, 3, 1, 12, 34, 56, 999999999, time.UTC),
+		time.Date(2024, 3, 1, 13, 34, 56, 500000000, time.FixedZone("CET", 60*60)),
+	} {
+		sample := newTestSample(nil)
+		sample.Time = at
+		data, err := o.encode(o.newEntry(sample))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var document map[string]json.RawMessage
+		if err := json.Unmarshal(data, &document); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(document["Time"]), strconv.FormatInt(at.Unix(), 10); got != want {
+			t.Errorf("got Time %s for %s, want %s", got, at, want)
+		}
+	}
+
+	// indices created by the output read the number as seconds
+	mapping, err := indexMapping(o.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(mapping), `"format":"epoch_second"`) {
+		t.Errorf("got mapping %s, want the epoch_second format for Time", mapping)
+	}
+
+	config := NewConfig()
+	config.TimestampPrecision = null.StringFrom("s")
+	config.UseDataStream = null.BoolFrom(true)
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "cannot be used with data streams") {
+		t.Errorf("got error %v, want epoch seconds to be rejected for data streams", err)
+	}
+}
+
+func TestDocumentFormats(t *testing.T) {
+	sample := newTestSample(map[string]string{"method": "GET", "status": "200"})
+	sample.Time = time.Date(2024, 3, 1, 12, 34, 56, 123456789, time.UTC)
+	sample.Value = 42.5
+	tests := []struct {
+		name string
+		arg  string
+		want string
+	}{
+		{
+			name: "legacy",
+			want: `{"MetricName":"test_counter","MetricType":"counter","Value":42.5,` +
+				`"Tags":{"method":"GET","status":"200"},"Time":1709296496123,"test_run_id":"run-1"}`,
+		},
+		{
+			name: "flat tags",
+			arg:  "tagsFormat=flat",
+			want: `{"MetricName":"test_counter","MetricType":"counter","Value":42.5,` +
+				`"tag_method":"GET","tag_status":"200","Time":1709296496123,"test_run_id":"run-1"}`,
+		},
+		{
+			name: "ecs",
+			arg:  "ecs=true",
+			want: `{"@timestamp":1709296496123,"event":{"dataset":"k6","kind":"metric"},` +
+				`"labels":{"method":"GET","status":"200"},` +
+				`"k6":{"metric":{"name":"test_counter","type":"counter","value":42.5},"test_run_id":"run-1"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOfflineOutput(t, "testRunId=run-1,"+tt.arg)
+			data, err := o.encode(o.newEntry(sample))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashID(t *testing.T) {
+	base := newTestSample(map[string]string{"method": "GET", "status": "200"})
+	base.Time = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	with := func(change func(s *metrics.Sample)) metrics.Sample {
+		s := base
+		change(&s)
+		return s
+	}
+	for _, tt := range []struct {
+		hash string
+		size int
+	}{{hash: "fnv", size: 16}, {hash: "sha1", size: 40}} {
+		t.Run(tt.hash, func(t *testing.T) {
+			o := newOfflineOutput(t, "idStrategy=hash,idHash="+tt.hash)
+			if got := o.config.opType(); got != opTypeCreate {
+				t.Errorf("got op type %s, want %s so that replays are skipped", got, opTypeCreate)
+			}
+			id := o.hashID(base)
+			if len(id) != tt.size {
+				t.Errorf("got id %q, want %d hex digits", id, tt.size)
+			}
+
+			// the same sample recorded again, or with another value
+			same := newTestSample(map[string]string{"status": "200", "method": "GET"})
+			same.Time = base.Time
+			same.Value = 42
+			if got := o.hashID(same); got != id {
+				t.Errorf("got id %s for an identical sample, want %s", got, id)
+			}
+
+			registry := metrics.NewRegistry()
+			differing := map[string]metrics.Sample{
+				"time": with(func(s *metrics.Sample) { s.Time = s.Time.Add(time.Nanosecond) }),
+				"tag value": with(func(s *metrics.Sample) {
+					s.Tags = s.Tags.With("status", "404")
+				}),
+				"additional tag": with(func(s *metrics.Sample) { s.Tags = s.Tags.With("group", "") }),
+				"metric": with(func(s *metrics.Sample) {
+					s.Metric = registry.MustNewMetric("other_counter", metrics.Counter)
+				}),
+				"separator in a value": with(func(s *metrics.Sample) {
+					s.Tags = s.Tags.Without("status").With("method", "GET\x00\"status\"=\"200\"")
+				}),
+			}
+			for name, sample := range differing {
+				if got := o.hashID(sample); got == id {
+					t.Errorf("%s: got the same id %s for a differing sample", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestGroupLevels(t *testing.T) {
+	tests := []struct {
+		name  string
+		arg   string
+		group string
+		// nil if the document has no levels
+		want []interface{}
+	}{
+		{name: "nested", arg: "groupLevels=true", group: "a::b::c", want: []interface{}{"a", "b", "c"}},
+		{name: "k6 path", arg: "groupLevels=true", group: "::checkout::pay", want: []interface{}{"checkout", "pay"}},
+		{name: "root group", arg: "groupLevels=true", group: ""},
+		{name: "disabled", arg: "groupLevels=false", group: "a::b::c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sample := newTestSample(map[string]string{"group": tt.group})
+			for _, format := range []string{"", ",ecs=true"} {
+				o := newOfflineOutput(t, tt.arg+format)
+				document := encodeDocument(t, o, sample)
+				levels, found := document["group_levels"]
+				var group interface{}
+				if format == "" {
+					group = document["Tags"].(map[string]interface{})["group"]
+				} else {
+					k6 := document["k6"].(map[string]interface{})
+					levels, found = k6["group_levels"]
+					group = document["labels"].(map[string]interface{})["group"]
+				}
+				if tt.want == nil {
+					if found {
+						t.Errorf("%q: got group levels %v, want none", format, levels)
+					}
+				} else if !reflect.DeepEqual(levels, tt.want) {
+					t.Errorf("%q: got group levels %v, want %v", format, levels, tt.want)
+				}
+				// the raw path is kept as well
+				if group != tt.group {
+					t.Errorf("%q: got group tag %v, want %q", format, group, tt.group)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxTagValueLength(t *testing.T) {
+	longURL := "https://test.k6.io/search?q=" + strings.Repeat("x", 500)
+	tests := []struct {
+		name  string
+		limit string
+		value string
+		want  string
+	}{
+		{name: "no limit", limit: "0", value: longURL, want: longURL},
+		{name: "short", limit: "40", value: "https://test.k6.io/", want: "https://test.k6.io/"},
+		{name: "exact", limit: "5", value: "abcde", want: "abcde"},
+		{name: "long", limit: "40", value: longURL, want: longURL[:39] + "…"},
+		// the limit counts characters, and multi-byte characters are not split
+		{name: "multi-byte", limit: "4", value: "grüße", want: "grü…"},
+		{name: "multi-byte within limit", limit: "5", value: "grüße", want: "grüße"},
+		{name: "one", limit: "1", value: "abc", want: "…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sample := newTestSample(map[string]string{"url": tt.value, "name": tt.value})
+			for _, format := range []string{"", ",tagsFormat=flat", ",ecs=true", ",promoteTags=name"} {
+				o := newOfflineOutput(t, "maxTagValueLength="+tt.limit+format)
+				document := encodeDocument(t, o, sample)
+				var url, name interface{}
+				switch format {
+				case ",tagsFormat=flat":
+					url, name = document["tag_url"], document["tag_name"]
+				case ",ecs=true":
+					labels := document["labels"].(map[string]interface{})
+					url, name = labels["url"], labels["name"]
+				case ",promoteTags=name":
+					url, name = document["Tags"].(map[string]interface{})["url"], document["name"]
+				default:
+					tags := document["Tags"].(map[string]interface{})
+					url, name = tags["url"], tags["name"]
+				}
+				if url != tt.want || name != tt.want {
+					t.Errorf("%q: got %v and %v, want %q", format, url, name, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckDocuments(t *testing.T) {
+	registry := metrics.NewRegistry()
+	checks := registry.MustNewMetric(metrics.ChecksName, metrics.Rate)
+	tests := []struct {
+		name  string
+		arg   string
+		tags  map[string]string
+		value float64
+		// the fields of the check, nil if none are expected
+		want map[string]interface{}
+	}{
+		{
+			name:  "passed",
+			tags:  map[string]string{"check": "status is 200", "group": "::login"},
+			value: 1,
+			want:  map[string]interface{}{"check_name": "status is 200", "passed": true, "group": "::login"},
+		},
+		{
+			name: "failed",
+			tags: map[string]string{"check": "status is 200", "group": ""},
+			want: map[string]interface{}{"check_name": "status is 200", "passed": false, "group": ""},
+		},
+		{
+			name:  "dropped tags",
+			arg:   "dropTags={check,group}",
+			tags:  map[string]string{"check": "body contains token", "group": "::login"},
+			value: 1,
+			want:  map[string]interface{}{"check_name": "body contains token", "passed": true, "group": "::login"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOfflineOutput(t, tt.arg)
+			sample := metrics.Sample{
+				TimeSeries: metrics.TimeSeries{Metric: checks, Tags: registry.RootTagSet().WithTagsFromMap(tt.tags)},
+				Time:       time.Now(),
+				Value:      tt.value,
+			}
+			document := encodeDocument(t, o, sample)
+			for field, want := range tt.want {
+				if got := document[field]; got != want {
+					t.Errorf("got %s %#v, want %#v", field, got, want)
+				}
+			}
+		})
+	}
+
+	// other metrics have none of the fields
+	document := encodeDocument(t, newOfflineOutput(t, ""), newTestSample(map[string]string{"check": "status is 200"}))
+	for _, field := range []string{"check_name", "passed", "group"} {
+		if got, found := document[field]; found {
+			t.Errorf("got %s %v for a counter, want none", field, got)
+		}
+	}
+}
+
+func TestValueAndMetricNameFields(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		want string
+	}{
+		{
+			name: "default",
+			want: `{"MetricName":"test_counter","MetricType":"counter","Value":2,"Tags":{"status":"200"},` +
+				`"Time":1709296496123,"test_run_id":"run-1"}`,
+		},
+		{
+			name: "dotted",
+			arg:  "valueField=metric.value,metricNameField=metric.name",
+			want: `{"metric.name":"test_counter","MetricType":"counter","metric.value":2,"Tags":{"status":"200"},` +
+				`"Time":1709296496123,"test_run_id":"run-1"}`,
+		},
+		{
+			name: "fast encoder",
+			arg:  "valueField=value,fastEncoder=true",
+			want: `{"MetricName":"test_counter","MetricType":"counter","value":2,"Tags":{"status":"200"},` +
+				`"Time":1709296496123,"test_run_id":"run-1"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOfflineOutput(t, "testRunId=run-1,"+tt.arg)
+			sample := newTestSample(map[string]string{"status": "200"})
+			sample.Time = time.UnixMilli(1709296496123)
+			sample.Value = 2
+			got, err := o.encode(o.newEntry(sample))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+
+	config := NewConfig()
+	config.ECSMode = null.BoolFrom(true)
+	config.ValueField = null.StringFrom("metric.value")
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "cannot be used in ECS mode") {
+		t.Errorf("got error %v, want the fields to be rejected in ECS mode", err)
+	}
+}
+
+func TestPromoteTags(t *testing.T) {
+	tags := map[string]string{"scenario": "checkout", "group": "::pay", "name": "https://test.k6.io/", "url": "x"}
+	allTags := make(map[string]interface{})
+	for name, value := range tags {
+		allTags[name] = value
+	}
+	tests := []struct {
+		name string
+		arg  string
+		// the top-level fields, and the tags and flat tag fields that are left
+		want, wantTags map[string]interface{}
+	}{
+		{
+			name:     "none",
+			wantTags: allTags,
+		},
+		{
+			name:     "scenario",
+			arg:      "promoteTags=scenario",
+			want:     map[string]interface{}{"scenario": "checkout"},
+			wantTags: map[string]interface{}{"group": "::pay", "name": "https://test.k6.io/", "url": "x"},
+		},
+		{
+			name:     "several",
+			arg:      "promoteTags={scenario,group,name}",
+			want:     map[string]interface{}{"scenario": "checkout", "group": "::pay", "name": "https://test.k6.io/"},
+			wantTags: map[string]interface{}{"url": "x"},
+		},
+		{
+			name:     "flat",
+			arg:      "promoteTags=scenario,tagsFormat=flat",
+			want:     map[string]interface{}{"scenario": "checkout"},
+			wantTags: map[string]interface{}{"tag_group": "::pay", "tag_name": "https://test.k6.io/", "tag_url": "x"},
+		},
+		{
+			// promoted tags are kept even if they are dropped otherwise
+			name:     "dropped",
+			arg:      "promoteTags=scenario,dropTags={scenario,name}",
+			want:     map[string]interface{}{"scenario": "checkout"},
+			wantTags: map[string]interface{}{"group": "::pay", "url": "x"},
+		},
+		{
+			name:     "missing",
+			arg:      "promoteTags=vu_pool",
+			wantTags: allTags,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOfflineOutput(t, tt.arg)
+			document := encodeDocument(t, o, newTestSample(tags))
+			for name, want := range tt.want {
+				if got := document[name]; got != want {
+					t.Errorf("got %s %v, want %q", name, got, want)
+				}
+			}
+			if _, found := document["vu_pool"]; found {
+				t.Errorf("got vu_pool %v, want no field for a missing tag", document["vu_pool"])
+			}
+			gotTags := make(map[string]interface{})
+			if o.config.TagsFormat.String == "flat" {
+				for name, value := range document {
+					if strings.HasPrefix(name, tagFieldPrefix) {
+						gotTags[name] = value
+					}
+				}
+			} else {
+				gotTags, _ = document["Tags"].(map[string]interface{})
+			}
+			if !reflect.DeepEqual(gotTags, tt.wantTags) {
+				t.Errorf("got tags %v, want %v", gotTags, tt.wantTags)
+			}
+		})
+	}
+
+	for arg, wantErr := range map[string]string{
+		"promoteTags=scenario,ecs=true":               "promoteTags cannot be used in ECS mode",
+		"promoteTags=MetricName":                      `promoted tag "MetricName" collides with a field`,
+		"promoteTags=team,customFields.team=payments": `promoted tag "team" collides with a custom field`,
+	} {
+		config, err := GetConsolidatedConfig(nil, map[string]string{}, arg)
+		if err == nil {
+			err = config.Validate()
+		}
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: got error %v, want one containing %q", arg, err, wantErr)
+		}
+	}
+}
+
+func TestMetricNames(t *testing.T) {
+	registry := metrics.NewRegistry()
+	tests := []struct {
+		name   string
+		arg    string
+		env    map[string]string
+		metric string
+		want   string
+	}{
+		{name: "unchanged", metric: "http_req_duration", want: "http_req_duration"},
+		{name: "prefix", arg: "metricPrefix=k6.", metric: "http_req_duration", want: "k6.http_req_duration"},
+		{
+			name:   "prefix from env",
+			env:    map[string]string{"K6_ELASTICSEARCH_METRIC_PREFIX": "loadtest_"},
+			metric: "http_req_duration",
+			want:   "loadtest_http_req_duration",
+		},
+		{name: "dots kept", metric: "checkout.cart_size", want: "checkout.cart_size"},
+		{name: "dots replaced", arg: "replaceDots=true", metric: "checkout.cart_size", want: "checkout_cart_size"},
+		{
+			// the dots of the prefix are kept
+			name:   "prefix and dots replaced",
+			arg:    "metricPrefix=k6.,replaceDots=true",
+			metric: "checkout.cart.size",
+			want:   "k6.checkout_cart_size",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := tt.env
+			if env == nil {
+				env = map[string]string{}
+			}
+			// the registry of k6 rejects names with dots, so the metric is created directly
+			metric := &metrics.Metric{Name: tt.metric, Type: metrics.Gauge}
+			sample := metrics.Sample{
+				TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()},
+				Time:       time.Now(),
+			}
+			for _, format := range []string{"", "ecs=true"} {
+				arg := tt.arg
+				if format != "" {
+					arg = strings.TrimPrefix(arg+","+format, ",")
+				}
+				logger, _ := test.NewNullLogger()
+				out, err := New(output.Params{Logger: logger, ConfigArgument: arg, Environment: env})
+				if err != nil {
+					t.Fatal(err)
+				}
+				document := encodeDocument(t, out.(*Output), sample)
+				got := document["MetricName"]
+				if format != "" {
+					got = document["k6"].(map[string]interface{})["metric"].(map[string]interface{})["name"]
+				}
+				if got != tt.want {
+					t.Errorf("%q: got metric name %v, want %q", format, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTypedTags(t *testing.T) {
+	tags := map[string]string{"status": "200", "expected_response": "true", "method": "GET"}
+	tests := []struct {
+		name string
+		arg  string
+		// parts of the encoded document
+		want []string
+	}{
+		{name: "strings", want: []string{`"status":"200"`, `"expected_response":"true"`}},
+		{
+			name: "numeric and boolean",
+			arg:  "numericTags=status,booleanTags=expected_response",
+			want: []string{`"status":200`, `"expected_response":true`, `"method":"GET"`},
+		},
+		{name: "flat", arg: "numericTags=status,tagsFormat=flat", want: []string{`"tag_status":200`}},
+		{name: "promoted", arg: "numericTags=status,promoteTags=status", want: []string{`"status":200`}},
+		{name: "fast encoder", arg: "numericTags=status,fastEncoder=true", want: []string{`"status":200`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOfflineOutput(t, tt.arg)
+			data, err := o.encode(o.newEntry(newTestSample(tags)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(data), want) {
+					t.Errorf("got document %s, want it to contain %s", data, want)
+				}
+			}
+		})
+	}
+
+	// values that cannot be converted would be rejected once the field is mapped as a number or boolean
+	o := newOfflineOutput(t, "numericTags={status,duration},booleanTags=expected_response")
+	typed := o.typedTags(map[string]string{"status": "", "duration": "1.5", "expected_response": "maybe"})
+	want := map[string]interface{}{"status": nil, "duration": 1.5, "expected_response": nil}
+	if !reflect.DeepEqual(typed, want) {
+		t.Errorf("got tags %v, want %v", typed, want)
+	}
+}
+
+func TestPromoteVUFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		arg      string
+		metadata map[string]string
+		want     map[string]interface{}
+	}{
+		{name: "disabled", metadata: map[string]string{"vu": "3", "iter": "17"}},
+		{
+			name:     "enabled",
+			arg:      "promoteVUFields=true",
+			metadata: map[string]string{"vu": "3", "iter": "17"},
+			want:     map[string]interface{}{"vu": float64(3), "iteration": float64(17)},
+		},
+		{
+			name:     "without iteration",
+			arg:      "promoteVUFields=true",
+			metadata: map[string]string{"vu": "0"},
+			want:     map[string]interface{}{"vu": float64(0)},
+		},
+		{name: "invalid", arg: "promoteVUFields=true", metadata: map[string]string{"vu": "x", "iter": "1.5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOfflineOutput(t, tt.arg)
+			sample := newTestSample(nil)
+			sample.Metadata = tt.metadata
+			document := encodeDocument(t, o, sample)
+			got := make(map[string]interface{})
+			for _, field := range []string{"vu", "iteration"} {
+				if value, found := document[field]; found {
+					got[field] = value
+				}
+			}
+			if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("got fields %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSystemTags(t *testing.T) {
+	tags := map[string]string{"status": "200", "method": "GET", "url": "https://test.k6.io/", "name": "home",
+		"team": "payments"}
+	tests := []struct {
+		name       string
+		systemTags *metrics.SystemTagSet
+		arg        string
+		want       []string
+	}{
+		{name: "default", want: []string{"method", "name", "status", "team", "url"}},
+		{
+			// tags that are not system tags, like the custom tags of the script, are always written
+			name:       "restricted",
+			systemTags: metrics.ToSystemTagSet([]string{"status", "method"}),
+			want:       []string{"method", "status", "team"},
+		},
+		{
+			name:       "restricted and kept",
+			systemTags: metrics.ToSystemTagSet([]string{"status", "url"}),
+			arg:        "keepTags={status,method,team}",
+			want:       []string{"status", "team"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, _ := test.NewNullLogger()
+			params := output.Params{Logger: logger, ConfigArgument: tt.arg, Environment: map[string]string{}}
+			params.ScriptOptions.SystemTags = tt.systemTags
+			out, err := New(params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			document := encodeDocument(t, out.(*Output), newTestSample(tags))
+			var got []string
+			for name := range document["Tags"].(map[string]interface{}) {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got tags %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricMetadata(t *testing.T) {
+	registry := metrics.NewRegistry()
+	tests := []struct {
+		metric                 *metrics.Metric
+		wantContains, wantUnit string
+	}{
+		{registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time), "time", "ms"},
+		{registry.MustNewMetric("data_received", metrics.Counter, metrics.Data), "data", "bytes"},
+		{registry.MustNewMetric("vus", metrics.Gauge), "default", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.metric.Name, func(t *testing.T) {
+			sample := metrics.Sample{
+				TimeSeries: metrics.TimeSeries{Metric: tt.metric, Tags: registry.RootTagSet()},
+				Time:       time.Now(),
+				Value:      1,
+			}
+			for _, arg := range []string{"metricMetadata=true", "metricMetadata=true,ecs=true", ""} {
+				document := encodeDocument(t, newOfflineOutput(t, arg), sample)
+				contains, unit := document["metric_contains"], document["metric_unit"]
+				if arg == "metricMetadata=true,ecs=true" {
+					metric := document["k6"].(map[string]interface{})["metric"].(map[string]interface{})
+					contains, unit = metric["contains"], metric["unit"]
+				}
+				wantContains, wantUnit := interface{}(tt.wantContains), interface{}(tt.wantUnit)
+				if arg == "" {
+					wantContains, wantUnit = nil, nil
+				} else if tt.wantUnit == "" {
+					// there is no unit for plain numbers
+					wantUnit = nil
+				}
+				if contains != wantContains || unit != wantUnit {
+					t.Errorf("%q: got contains %v and unit %v, want %v and %v", arg, contains, unit, wantContains,
+						wantUnit)
+				}
+			}
+		})
+	}
+}
+
+func TestDocTypeField(t *testing.T) {
+	registry := metrics.NewRegistry()
+	checks := registry.MustNewMetric(metrics.ChecksName, metrics.Rate)
+	duration := registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time)
+	check := metrics.Sample{
+		TimeSeries: metrics.TimeSeries{Metric: checks, Tags: registry.RootTagSet().With("check", "status is 200")},
+		Time:       time.Now(),
+		Value:      1,
+	}
+	series := metrics.TimeSeries{Metric: duration, Tags: registry.RootTagSet()}
+	documents := map[string]func(o *Output) elasticMetricEntry{
+		docTypeMetric: func(o *Output) elasticMetricEntry { return o.newEntry(newTestSample(nil)) },
+		docTypeCheck:  func(o *Output) elasticMetricEntry { return o.newEntry(check) },
+		docTypeSummary: func(o *Output) elasticMetricEntry {
+			return o.newSummaryEntry(trendAggregate{series: series, time: time.Now()})
+		},
+		"end-of-test " + docTypeSummary: func(o *Output) elasticMetricEntry {
+			entry, _ := o.newSummaryDocument(metricSummary{series: series, value: 12}, time.Now())
+			return entry
+		},
+		docTypeMarker: func(o *Output) elasticMetricEntry { return o.newMarker(markerTestStart, time.Now()) },
+	}
+	for _, arg := range []string{"docTypeField=doc_type", "docTypeField=doc_type,ecs=true", "docTypeField=kind", ""} {
+		o := newOfflineOutput(t, arg)
+		field := o.config.DocTypeField.String
+		for name, document := range documents {
+			data, err := o.encode(document(o))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded map[string]interface{}
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			want := strings.TrimPrefix(name, "end-of-test ")
+			if field == "" {
+				if _, found := decoded["doc_type"]; found {
+					t.Errorf("%q, %s: got doc_type %v, want none", arg, name, decoded["doc_type"])
+				}
+			} else if got := decoded[field]; got != want {
+				t.Errorf("%q, %s: got %s %v, want %q", arg, name, field, got, want)
+			}
+		}
+	}
+}
+
+func TestTestRunID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	tests := []struct {
+		name string
+		arg  string
+		env  map[string]string
+		// empty for a generated id
+		want string
+	}{
+		{name: "arg", arg: "testRunId=nightly-42", want: "nightly-42"},
+		{name: "env", env: map[string]string{"K6_ELASTICSEARCH_TEST_RUN_ID": "nightly-43"}, want: "nightly-43"},
+		{name: "generated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := tt.env
+			if env == nil {
+				env = map[string]string{}
+			}
+			var ids []string
+			for i := 0; i < 2; i++ {
+				logger, _ := test.NewNullLogger()
+				out, err := New(output.Params{Logger: logger, ConfigArgument: tt.arg, Environment: env})
+				if err != nil {
+					t.Fatal(err)
+				}
+				o := out.(*Output)
+				id := o.config.TestRunID.String
+				if got := encodeDocument(t, o, newTestSample(nil))["test_run_id"]; got != id {
+					t.Errorf("got test_run_id %v in the document, want %s", got, id)
+				}
+				if !strings.Contains(o.Description(), "test run id: "+id) {
+					t.Errorf("got description %q, want it to contain the test run id %s", o.Description(), id)
+				}
+				ids = append(ids, id)
+			}
+			if tt.want != "" {
+				if ids[0] != tt.want || ids[1] != tt.want {
+					t.Errorf("got test run ids %v, want %s", ids, tt.want)
+				}
+				return
+			}
+			if !uuid.MatchString(ids[0]) {
+				t.Errorf("got generated test run id %q, want a random UUID", ids[0])
+			}
+			if ids[0] == ids[1] {
+				t.Errorf("got the test run id %s for two outputs, want a new one for each", ids[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// documentEncoder encodes a document for the body of a bulk request.
+type documentEncoder func(entry elasticMetricEntry) ([]byte, error)
+
+// newDocumentEncoder returns the encoder selected with fastEncoder.
+func newDocumentEncoder(c Config) documentEncoder {
+	if c.FastEncoder.Bool {
+		return encodeFast
+	}
+	return encodeStandard
+}
+
+// encodeStandard encodes a document with encoding/json.
+func encodeStandard(entry elasticMetricEntry) ([]byte, error) {
+	return json.Marshal(entry)
+}
+
+// encodeFast produces the same bytes as encodeStandard, but appends the values that documents usually consist of
+// directly to a buffer instead of going through reflection. Other values, like summaries, fall back to
+// encoding/json.
+func encodeFast(entry elasticMetricEntry) ([]byte, error) {
+	buf := make([]byte, 0, 256)
+	buf = append(buf, '{')
+	for i, field := range entry {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, field.Name)
+		buf = append(buf, ':')
+		var err error
+		if buf, err = appendJSONValue(buf, field.Value); err != nil {
+			return nil, err
+		}
+	}
+	return append(buf, '}'), nil
+}
+
+func appendJSONValue(buf []byte, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, "null"...), nil
+	case string:
+		return appendJSONString(buf, v), nil
+	case bool:
+		return strconv.AppendBool(buf, v), nil
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10), nil
+	case int64:
+		return strconv.AppendInt(buf, v, 10), nil
+	case float64:
+		return appendJSONFloat(buf, v)
+	case time.Time:
+		data, err := v.MarshalJSON()
+		if err != nil {
+			// for the same error as encoding/json
+			return nil, jsonError(v)
+		}
+		return append(buf, data...), nil
+	case []string:
+		if v == nil {
+			return append(buf, "null"...), nil
+		}
+		buf = append(buf, '[')
+		for i, s := range v {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, s)
+		}
+		return append(buf, ']'), nil
+	case map[string]string:
+		if v == nil {
+			return append(buf, "null"...), nil
+		}
+		buf = append(buf, '{')
+		for i, key := range sortedKeys(v) {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, key)
+			buf = append(buf, ':')
+			buf = appendJSONString(buf, v[key])
+		}
+		return append(buf, '}'), nil
+	case map[string]interface{}:
+		if v == nil {
+			return append(buf, "null"...), nil
+		}
+		buf = append(buf, '{')
+		for i, key := range sortedKeys(v) {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, key)
+			buf = append(buf, ':')
+			var err error
+			if buf, err = appendJSONValue(buf, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, '}'), nil
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, data...), nil
+	}
+}
+
+// jsonError returns the error of encoding/json for a value that cannot be encoded.
+func jsonError(value interface{}) error {
+	_, err := json.Marshal(value)
+	return err
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// appendJSONFloat formats like encoding/json, which uses exponents only for very small and very large numbers.
+func appendJSONFloat(buf []byte, f float64) ([]byte, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, jsonError(f)
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	buf = strconv.AppendFloat(buf, f, format, -1, 64)
+	if format == 'e' {
+		// e-09 becomes e-9
+		if n := len(buf); n >= 4 && buf[n-4] == 'e' && buf[n-3] == '-' && buf[n-2] == '0' {
+			buf[n-2] = buf[n-1]
+			buf = buf[:n-1]
+		}
+	}
+	return buf, nil
+}
+
+// The escape sequences are taken from encoding/json itself, since e.g. the short forms of some control characters
+// and the replacement of invalid UTF-8 differ between Go versions.
+var (
+	// the escape sequence of every ASCII character that encoding/json escapes
+	asciiEscapes = func() (escapes [utf8.RuneSelf]string) {
+		for b := 0; b < utf8.RuneSelf; b++ {
+			if escaped := jsonEscape(string(rune(b))); escaped != string(rune(b)) {
+				escapes[b] = escaped
+			}
+		}
+		return escapes
+	}()
+	invalidUTF8Escape   = jsonEscape("\xff")
+	lineSeparatorEscape = jsonEscape("\u2028")
+	paraSeparatorEscape = jsonEscape("\u2029")
+)
+
+// jsonEscape returns s as encoding/json encodes it, without the quotes.
+func jsonEscape(s string) string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return s
+	}
+	return string(data[1 : len(data)-1])
+}
+
+// appendJSONString quotes s like encoding/json, including the escaping of HTML characters, U+2028 and U+2029 and
+// the replacement of invalid UTF-8.
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if asciiEscapes[b] != "" {
+				buf = append(buf, s[start:i]...)
+				buf = append(buf, asciiEscapes[b]...)
+				start = i + 1
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		escaped := s[i : i+size]
+		switch {
+		case r == utf8.RuneError && size == 1:
+			escaped = invalidUTF8Escape
+		case r == '\u2028':
+			escaped = lineSeparatorEscape
+		case r == '\u2029':
+			escaped = paraSeparatorEscape
+		}
+		if escaped != s[i:i+size] {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, escaped...)
+			start = i + size
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
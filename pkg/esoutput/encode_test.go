@@ -0,0 +1,166 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"go.k6.io/k6/metrics"
+)
+
+// testEntries returns documents with the values the fast encoder handles itself and some it leaves to
+// encoding/json.
+func testEntries() map[string]elasticMetricEntry {
+	at := time.Date(2024, time.March, 1, 12, 34, 56, 123456789, time.FixedZone("CET", 60*60))
+	return map[string]elasticMetricEntry{
+		"scalars": {
+			{"nil", nil}, {"true", true}, {"false", false}, {"int", 42}, {"int64", int64(-7)},
+			{"time", at}, {"time utc", at.UTC()},
+		},
+		"floats": {
+			{"zero", 0.0}, {"negative zero", math.Copysign(0, -1)}, {"fraction", 123.456}, {"integral", 1e20},
+			{"large", 1e21}, {"small", 1e-6}, {"tiny", 1.5e-7}, {"negative tiny", -2e-9}, {"max", math.MaxFloat64},
+			{"smallest", math.SmallestNonzeroFloat64}, {"third", 1.0 / 3},
+		},
+		"strings": {
+			{"empty", ""}, {"html", `<a href="x">&</a>`}, {"controls", "tab\tnewline\nnull\x00bell\x07\x1f"},
+			{"backslash", `C:\k6\"quoted"`}, {"unicode", "grüße, 负载, 🚀"}, {"separators", "a\u2028b\u2029c"},
+			{"invalid utf8", "bad\xffbyte\xc3"}, {"escaped name <&>", "value"},
+		},
+		"collections": {
+			{"strings", []string{"a", "<b>", ""}}, {"no strings", []string(nil)}, {"empty strings", []string{}},
+			{"string map", map[string]string{"z": "1", "a": "2", "m": "\u2028"}}, {"no string map", map[string]string(nil)},
+			{"nested", map[string]interface{}{
+				"b": map[string]interface{}{"c": 1.5, "a": []string{"x"}},
+				"a": nil,
+				"t": at,
+			}},
+		},
+		"fallback": {
+			{"struct", check{Name: "status is 200", Passed: true, Group: "::a"}},
+			{"int slice", []int{1, 2, 3}},
+			{"float32", float32(0.1)},
+		},
+	}
+}
+
+func TestFastEncoderMatchesStandard(t *testing.T) {
+	for name, entry := range testEntries() {
+		t.Run(name, func(t *testing.T) {
+			want, err := encodeStandard(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := encodeFast(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestFastEncoderMatchesStandardForSamples(t *testing.T) {
+	registry := metrics.NewRegistry()
+	checks := registry.MustNewMetric(metrics.ChecksName, metrics.Rate)
+	duration := registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time)
+	samples := []metrics.Sample{
+		newTestSample(nil),
+		newTestSample(map[string]string{
+			"method": "GET", "url": "https://test.k6.io/?q=<script>&x=1", "status": "200", "group": "::a::b",
+		}),
+		{
+			TimeSeries: metrics.TimeSeries{Metric: checks, Tags: registry.RootTagSet().WithTagsFromMap(
+				map[string]string{"check": "body contains \"ok\"", "group": ""})},
+			Time:     time.Now(),
+			Value:    1,
+			Metadata: map[string]string{"vu": "3", "iter": "12"},
+		},
+		{
+			TimeSeries: metrics.TimeSeries{Metric: duration, Tags: registry.RootTagSet().With("name", "grüße")},
+			Time:       time.Now(),
+			Value:      12.345678,
+		},
+	}
+	for _, arg := range []string{
+		"", "tagsFormat=flat", "ecs=true", "groupLevels=true,metricMetadata=true", "timestampPrecision=ns",
+		"customFields.env=staging,numericTags=status,dropTags=url",
+	} {
+		o := newOfflineOutput(t, arg)
+		for i, sample := range samples {
+			entry := o.newEntry(sample)
+			want, err := encodeStandard(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := encodeFast(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("%q, sample %d: got\n%s\nwant\n%s", arg, i, got, want)
+			}
+		}
+	}
+}
+
+func TestFastEncoderErrors(t *testing.T) {
+	for name, value := range map[string]interface{}{
+		"nan":         math.NaN(),
+		"infinity":    math.Inf(1),
+		"nested nan":  map[string]interface{}{"a": math.Inf(-1)},
+		"year 10000":  time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC),
+		"unsupported": make(chan int),
+	} {
+		entry := elasticMetricEntry{{"Value", value}}
+		_, wantErr := encodeStandard(entry)
+		_, err := encodeFast(entry)
+		if err == nil || wantErr == nil {
+			t.Errorf("%s: got errors %v and %v, want both encoders to fail", name, err, wantErr)
+		}
+	}
+}
+
+func BenchmarkEncoders(b *testing.B) {
+	o := newOfflineOutput(b, "")
+	entry := o.newEntry(newTestSample(map[string]string{
+		"method": "GET", "url": "https://test.k6.io/contacts.php", "status": "200", "name": "contacts",
+		"scenario": "default", "group": "::contacts", "proto": "HTTP/1.1", "expected_response": "true",
+	}))
+	for name, encode := range map[string]documentEncoder{"standard": encodeStandard, "fast": encodeFast} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := encode(entry); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
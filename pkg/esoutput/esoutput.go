@@ -27,42 +27,143 @@ package esoutput
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	mathrand "math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"runtime"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	es "github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"github.com/guregu/null/v5"
 	"github.com/sirupsen/logrus"
+	"go.k6.io/k6/lib/types"
+	"go.k6.io/k6/metrics"
 	"go.k6.io/k6/output"
 )
 
-type elasticMetricEntry struct {
-	MetricName string
-	MetricType string
-	Value      float64
-	Tags       map[string]string
-	Time       time.Time
-}
-
 type Output struct {
 	config Config
 
-	client          *es.Client
-	bulkIndexer     esutil.BulkIndexer
-	periodicFlusher *output.PeriodicFlusher
-	output.SampleBuffer
+	client      *es.Client
+	bulkIndexer esutil.BulkIndexer
+	// Flush replaces the bulk indexer, whose statistics are still counted once it is retired
+	newBulkIndexer  func() (esutil.BulkIndexer, error)
+	retiredIndexers []esutil.BulkIndexer
+	indexerMu       sync.RWMutex
+	buffer          *sampleBuffer
+	// whether the buffer has been full, to warn only once
+	bufferFull int32
+
+	// a single goroutine flushes after flushPeriod or once maxBatchSize samples are buffered, whichever comes first
+	flushSignal chan struct{}
+	flushDone   chan struct{}
+	flushWG     sync.WaitGroup
+	// held while documents are added to the bulk indexer, Flush may run concurrently with the flush loop
+	flushMu sync.Mutex
+	// Stop and a SIGTERM both stop the output, whichever comes first, samples are ignored afterwards
+	stopOnce sync.Once
+	stopped  int32
+
+	// metric names to ship (if not empty) and to filter out
+	includeMetrics map[string]bool
+	excludeMetrics map[string]bool
+	// metric types to ship (if not empty) and to filter out
+	includeMetricTypes map[metrics.MetricType]bool
+	excludeMetricTypes map[metrics.MetricType]bool
+
+	// tags to write (if not empty) and to leave out of the documents
+	keepTags map[string]bool
+	dropTags map[string]bool
+	// system tags that are disabled with the systemTags option of k6
+	disabledSystemTags map[string]bool
+	// tags whose values are converted to numbers and booleans
+	numericTags map[string]bool
+	booleanTags map[string]bool
+
+	stats       *sampleStats
+	itemErrors  *itemErrors
+	performance *outputStats
+	// nil without a fallback cluster
+	failover *failover
+	// nil without circuitBreakerAfter
+	breaker *circuitBreaker
+	// returns a random number in [0.0,1.0) to decide which samples are kept with sampleRate
+	random func() float64
+	// the thresholds by metric name, submetrics included, for onlyBreaches
+	thresholds map[string][]*metrics.Threshold
+	// aborts the test run, set by k6 and used by failOnDrop
+	stopTestRun     func(error)
+	testRunStopOnce sync.Once
+
+	// aggregates all samples in summaryOnly mode instead of buffering them
+	summary *testSummary
+
+	// encodes the documents, selected with fastEncoder
+	encode documentEncoder
+
+	// the mapping of created indices
+	mapping []byte
+	// indices that have already been created, only used for date-based and routed index names
+	createdIndices map[string]bool
+
+	// the name of the script, stored in the markers
+	testName string
+
+	// the file the bulk requests are written to in a dry run
+	dryRunFile *os.File
+	// the file the accepted bulk requests are written to, nil without fileOutput
+	fileOutput *rotatingFile
 
 	logger logrus.FieldLogger
 }
 
+// Version is the version of the extension, sent in the User-Agent header. It is set at build time with
+// -ldflags "-X github.com/elastic/xk6-output-elasticsearch/pkg/esoutput.Version=<version>".
+var Version = "dev"
+
+// the API version sent to serverless projects, currently the only one available
+const serverlessAPIVersion = "2023-10-31"
+
+// Policies for a panic while flushing.
+const (
+	// log the panic and continue with the next flush
+	panicPolicyRecover = "recover"
+	// let the panic crash k6, e.g. to debug it
+	panicPolicyCrash = "crash"
+)
+
+// Triggers for a flush of the buffer, see the README for how they interact with the size limits.
+const (
+	// flush every flushPeriod or once maxBatchSize samples are buffered, whichever comes first
+	flushTriggerAny = "any"
+	// flush every flushPeriod only, and send the bulk requests at the same interval
+	flushTriggerTime = "time"
+	// flush once maxBatchSize samples are buffered, at the latest after maxFlushDelay
+	flushTriggerCount = "count"
+	// flush every flushPeriod, but only send bulk requests once they reach maxBatchBytes
+	flushTriggerBytes = "bytes"
+)
+
+// the longest samples wait in the buffer with the count trigger, and in the bulk indexer unless the time trigger
+// is used. It is the default flush interval of the bulk indexer.
+const maxFlushDelay = 30 * time.Second
+
 const hasPrivilegesBody = `{
   "index": [
     {
@@ -76,7 +177,11 @@ const hasPrivilegesBody = `{
   ]
 }`
 
-var _ output.Output = new(Output)
+var (
+	_ output.Output          = new(Output)
+	_ output.WithThresholds  = new(Output)
+	_ output.WithTestRunStop = new(Output)
+)
 
 //go:embed mapping.json
 var mapping []byte
@@ -88,8 +193,36 @@ func New(params output.Params) (output.Output, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	for _, conflict := range config.aliasConflicts {
+		params.Logger.Warnf("Elasticsearch: %s", conflict)
+	}
+	for _, name := range config.undefinedVars {
+		params.Logger.Warnf("Elasticsearch: the environment variable %s referenced in the configuration is not set, "+
+			"it is replaced by an empty string", name)
+	}
+	if config.CloudID.Valid && config.Url.String != NewConfig().Url.String {
+		params.Logger.Warn("Elasticsearch: both url and cloud-id are configured, the url is ignored")
+	}
+	if refresh := config.Refresh.String; refresh == "true" || refresh == "wait_for" {
+		params.Logger.Warnf("Elasticsearch: refresh=%s ties every bulk request to a refresh of the index, "+
+			"which severely limits the throughput, do not use it for load tests", refresh)
+	}
+	if time.Duration(config.FlushPeriod.Duration) < minFlushPeriod {
+		params.Logger.Warnf("Elasticsearch: flushPeriod %s is too short, using %s instead", config.FlushPeriod.Duration, minFlushPeriod)
+		config.FlushPeriod = types.NullDurationFrom(minFlushPeriod)
+	}
 
-	var addresses = []string{config.Url.ValueOrZero()}
+	if !config.TestRunID.Valid {
+		testRunID, err := newUUID()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate a test run id: %v", err)
+		}
+		config.TestRunID = null.StringFrom(testRunID)
+	}
+	params.Logger.Infof("Elasticsearch: test run id is %s", config.TestRunID.String)
 
 	var esConfig es.Config
 
@@ -97,7 +230,8 @@ func New(params output.Params) (output.Output, error) {
 	if config.CloudID.Valid {
 		esConfig.CloudID = config.CloudID.String
 	} else if config.Url.Valid {
-		esConfig.Addresses = strings.Split(strings.Join(addresses, ""), ",")
+		// a comma-separated list of node URLs, e.g. "http://es1:9200, http://es2:9200"
+		esConfig.Addresses = splitList(config.Url.String)
 	}
 	if config.User.Valid {
 		esConfig.Username = config.User.String
@@ -106,156 +240,1093 @@ func New(params output.Params) (output.Output, error) {
 		esConfig.Password = config.Password.String
 	}
 	if config.APIKey.Valid {
+		// the client prefers the API key over basic auth, make that visible to the user
+		if config.User.Valid || config.Password.Valid {
+			params.Logger.Warn("Elasticsearch: both an API key and user/password are configured, using the API key")
+		}
 		esConfig.APIKey = config.APIKey.String
 	}
 	if config.ServiceAccountToken.Valid {
 		esConfig.ServiceToken = config.ServiceAccountToken.String
 	}
-	if config.CACert.Valid {
-		cert, err := os.ReadFile(config.CACert.String)
-		if err != nil {
-			return nil, err
+
+	// tells the requests of k6 apart from other clients, e.g. in audit logs
+	esConfig.Header = http.Header{"User-Agent": []string{config.userAgent()}}
+	for name, value := range config.Headers {
+		esConfig.Header.Set(name, value)
+	}
+
+	// the client balances the requests across all nodes of the cluster it discovers
+	esConfig.DiscoverNodesOnStart = config.DiscoverNodesOnStart.Bool
+	esConfig.DiscoverNodesInterval = time.Duration(config.DiscoverNodesInterval.Duration)
+
+	if config.Serverless.Bool {
+		// serverless projects hide their nodes behind a single endpoint and version their API by date
+		esConfig.DiscoverNodesOnStart = false
+		esConfig.DiscoverNodesInterval = 0
+		esConfig.Header.Set("Elastic-Api-Version", serverlessAPIVersion)
+	}
+
+	// transient errors are retried by the client before the indexer gives up on a batch
+	if config.MaxRetries.Int64 == 0 {
+		esConfig.DisableRetry = true
+	} else {
+		esConfig.MaxRetries = int(config.MaxRetries.Int64)
+		esConfig.RetryOnStatus = config.RetryOnStatus
+		esConfig.RetryBackoff = retryBackoff(time.Duration(config.RetryBackoff.Duration), config.RetryJitter.Bool)
+	}
+
+	tlsConfig, err := newTLSConfig(config, params.Logger)
+	if err != nil {
+		return nil, err
+	}
+	httpTransport, err := newHTTPTransport(config, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var next http.RoundTripper = httpTransport
+	var dryRunFile *os.File
+	if config.DryRun.Bool {
+		// no connection is made at all, the connectivity check and index creation succeed trivially
+		dryRun := &dryRunTransport{logger: params.Logger}
+		if config.DryRunFile.Valid {
+			if dryRunFile, err = os.OpenFile(config.DryRunFile.String, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644); err != nil {
+				return nil, fmt.Errorf("cannot open dryRunFile: %v", err)
+			}
+			dryRun.out = dryRunFile
 		}
-		esConfig.CACert = cert
+		next = dryRun
+		params.Logger.Warn("Elasticsearch: dry run, no samples are sent to Elasticsearch")
 	}
 
-	var clientTLSCert tls.Certificate
-	if config.ClientCert.Valid && config.ClientKey.Valid {
-		clientTLSCert, err = tls.LoadX509KeyPair(config.ClientCert.String, config.ClientKey.String)
-		if err != nil {
+	// innermost, so that the bulk requests split up by the transports outside carry the parameters as well
+	if len(config.BulkParams) > 0 {
+		next = newBulkParamsTransport(next, config.BulkParams)
+	}
+
+	// with a date-based index name every item carries its own index
+	var bulkIndex string
+	if !isIndexTemplate(config.IndexName.String) {
+		bulkIndex = config.IndexName.String
+	}
+	// only uncompressed bodies are compacted, gzip takes care of the repetition otherwise
+	if !config.CompressRequestBody.Bool {
+		next = &compactBulkTransport{next: next, index: bulkIndex}
+	}
+	if config.BulkPerIndex.Bool {
+		next = &perIndexBulkTransport{next: next, level: int(config.CompressionLevel.Int64)}
+	}
+	// outside of the compaction, so that the file carries the index of every item that has its own
+	var fileOutput *rotatingFile
+	if config.FileOutput.Valid {
+		if fileOutput, err = openRotatingFile(config.FileOutput.String, config.FileMaxBytes.Int64); err != nil {
+			return nil, fmt.Errorf("cannot open fileOutput: %v", err)
+		}
+		next = &fileOutputTransport{next: next, out: fileOutput, index: bulkIndex, logger: params.Logger}
+	}
+
+	var failover *failover
+	if config.FallbackUrl.Valid || config.FallbackCloudID.Valid {
+		if failover, err = newFailover(config, params.Logger); err != nil {
 			return nil, err
 		}
+		next = &failoverTransport{next: next, failover: failover}
+	}
+	var breaker *circuitBreaker
+	if config.CircuitBreakerAfter.Int64 > 0 {
+		breaker = newCircuitBreaker(config, params.Logger)
+	}
+	if failover != nil || breaker != nil {
+		next = &flushResultTransport{next: next}
+	}
+	if breaker != nil {
+		next = &circuitBreakerTransport{next: next, breaker: breaker}
 	}
 
-	esConfig.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: config.InsecureSkipVerify.Bool,
-			Certificates:       []tls.Certificate{clientTLSCert},
-		},
+	esConfig.Transport = &timeoutTransport{
+		next:    next,
+		timeout: time.Duration(config.RequestTimeout.Duration),
 	}
+	if config.MaxInFlightRequests.Valid {
+		esConfig.Transport = &limitTransport{
+			next:  esConfig.Transport,
+			slots: make(chan struct{}, config.MaxInFlightRequests.Int64),
+		}
+	}
+	esConfig.Transport = &splitBulkTransport{
+		next:   esConfig.Transport,
+		logger: params.Logger,
+		level:  int(config.CompressionLevel.Int64),
+	}
+	esConfig.Transport = &opaqueIDTransport{
+		next:   esConfig.Transport,
+		prefix: config.OpaqueIDPrefix.String + config.TestRunID.String + "-",
+	}
+	// compressed here instead of by the client to apply the level, the inner transports see gzipped bodies either way
+	if config.CompressRequestBody.Bool {
+		esConfig.Transport = &gzipTransport{next: esConfig.Transport, level: int(config.CompressionLevel.Int64)}
+	}
+	if credentials := newCredentialTransport(esConfig.Transport, config, params.Logger); credentials != nil {
+		esConfig.Transport = credentials
+	}
+	if config.CompatibilityMode.Bool {
+		esConfig.Transport = &compatibilityTransport{next: esConfig.Transport}
+	}
+	if config.OpenSearchCompat.Bool || config.DisableProductCheck.Bool {
+		esConfig.Transport = &productHeaderTransport{next: esConfig.Transport}
+	}
+	// outermost, as the client retries by sending the request through the whole chain again
+	esConfig.Transport = &attemptCountTransport{next: esConfig.Transport}
 
 	client, err := es.NewClient(esConfig)
 	if err != nil {
 		return nil, err
 	}
-	// ensure basic connectivity
-	info, err := client.Info()
+
+	adaptedMapping, err := indexMapping(config)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error creating the index mapping: %v", err)
 	}
-	if info.StatusCode != 200 {
-		// The info API requires the 'monitor' privilege and the user might not have that. We can only get a 403 if
-		// security is configured on this cluster. Therefore, we call the has privilege API that is guaranteed to work
-		//for every user.
-		if info.StatusCode == 403 {
-			priv, err := client.Security.HasPrivileges(strings.NewReader(fmt.Sprintf(hasPrivilegesBody, config.IndexName.String)))
-			if err != nil {
-				return nil, err
+
+	performance := &outputStats{}
+	onFlushStart, onFlushEnd := performance.requestStarted, performance.requestFinished
+	if failover != nil || breaker != nil {
+		onFlushStart = func(ctx context.Context) context.Context {
+			return withFlushResult(performance.requestStarted(ctx))
+		}
+		onFlushEnd = func(ctx context.Context) {
+			performance.requestFinished(ctx)
+			if failover != nil {
+				failover.flushFinished(ctx)
 			}
-			if priv.StatusCode != 200 {
-				return nil, fmt.Errorf("cannot connect to Elasticsearch (status code %d)", priv.StatusCode)
+			if breaker != nil {
+				breaker.flushFinished(ctx)
 			}
-		} else {
-			return nil, fmt.Errorf("cannot connect to Elasticsearch (status code %d)", info.StatusCode)
 		}
 	}
+	// the names have been validated already
+	includeMetricTypes, _ := metricTypes(config.IncludeMetricTypes)
+	excludeMetricTypes, _ := metricTypes(config.ExcludeMetricTypes)
 
-	bulkIndexer, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
-		Index:  config.IndexName.String,
-		Client: client,
-		OnError: func(ctx context.Context, err error) {
-			// this happens usually due to permission issues
-			params.Logger.Errorf("Could not write metrics: %s", err)
-		},
-	})
+	o := &Output{
+		client:             client,
+		config:             config,
+		logger:             params.Logger,
+		includeMetrics:     toSet(config.IncludeMetrics),
+		excludeMetrics:     toSet(config.ExcludeMetrics),
+		includeMetricTypes: includeMetricTypes,
+		excludeMetricTypes: excludeMetricTypes,
+		keepTags:           toSet(config.KeepTags),
+		dropTags:           toSet(config.DropTags),
+		disabledSystemTags: disabledSystemTags(params.ScriptOptions.SystemTags),
+		numericTags:        toSet(config.NumericTags),
+		booleanTags:        toSet(config.BooleanTags),
+		buffer:             newSampleBuffer(config.MaxBufferedSamples.Int64, config.BufferOverflow.String),
+		stats:              newSampleStats(),
+		itemErrors:         newItemErrors(),
+		performance:        performance,
+		failover:           failover,
+		breaker:            breaker,
+		random:             mathrand.Float64,
+		dryRunFile:         dryRunFile,
+		fileOutput:         fileOutput,
+		encode:             newDocumentEncoder(config),
+		mapping:            adaptedMapping,
+		createdIndices:     make(map[string]bool),
+		testName:           testName(params),
+		flushSignal:        make(chan struct{}, 1),
+		flushDone:          make(chan struct{}),
+	}
+	o.newBulkIndexer = func() (esutil.BulkIndexer, error) {
+		return esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+			Index:  bulkIndex,
+			Client: client,
+			// the indexer sends a request as soon as its body reaches this size, documents are never split
+			FlushBytes:    int(config.MaxBatchBytes.Int64),
+			FlushInterval: bulkFlushInterval(config),
+			// each worker sends its own requests
+			NumWorkers: bulkWorkers(config),
+			Pipeline:   config.Pipeline.String,
+			Refresh:    config.Refresh.String,
+			// the number of copies of each shard that must be active before the items are written
+			WaitForActiveShards: config.WaitForActiveShards.String,
+			OnError: func(ctx context.Context, err error) {
+				if performance.inRequest(ctx) {
+					// a failed flush is reported from within the request and then again by the caller of the
+					// flush with a better message, only the latter is logged and counted
+					return
+				}
+				// this happens usually due to permission issues
+				params.Logger.Errorf("Could not write metrics: %s", err)
+				performance.requestFailed()
+				o.failOnDrop(fmt.Sprintf("a bulk request failed: %s", err))
+			},
+			OnFlushStart: onFlushStart,
+			OnFlushEnd:   onFlushEnd,
+		})
+	}
+	o.bulkIndexer, err = o.newBulkIndexer()
 	if err != nil {
 		return nil, fmt.Errorf("error creating the indexer: %v", err)
 	}
+	return o, nil
+}
+
+// testName returns the file name of the script, or an empty string if it is unknown.
+func testName(params output.Params) string {
+	if params.ScriptPath == nil {
+		return ""
+	}
+	return path.Base(params.ScriptPath.Path)
+}
+
+// newUUID generates a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
 
-	return &Output{
-		client:      client,
-		bulkIndexer: bulkIndexer,
-		config:      config,
-		logger:      params.Logger,
-	}, nil
+func (o *Output) Description() string {
+	return fmt.Sprintf("Output k6 metrics to Elasticsearch (test run id: %s)", o.config.TestRunID.String)
 }
 
-func (*Output) Description() string {
-	return "Output k6 metrics to Elasticsearch"
+// SetThresholds receives the thresholds of the test before the output is started. k6 updates their state while
+// the test runs.
+func (o *Output) SetThresholds(thresholds map[string]metrics.Thresholds) {
+	o.thresholds = make(map[string][]*metrics.Threshold, len(thresholds))
+	for name, t := range thresholds {
+		// the thresholds of a submetric like http_req_duration{status:200} apply to the samples of its metric
+		name, _, _ = strings.Cut(name, "{")
+		o.thresholds[name] = append(o.thresholds[name], t.Thresholds...)
+	}
+}
+
+// SetTestRunStopCallback receives the function that aborts the test run, which is called with failOnDrop as soon
+// as a sample is dropped.
+func (o *Output) SetTestRunStopCallback(stop func(error)) {
+	o.stopTestRun = stop
+}
+
+// failOnDrop aborts the test run once with failOnDrop enabled. Drops while the output stops, e.g. samples that
+// are abandoned by the final flush, are only counted.
+func (o *Output) failOnDrop(reason string) {
+	if !o.config.FailOnDrop.Bool || o.stopTestRun == nil || atomic.LoadInt32(&o.stopped) == 1 {
+		return
+	}
+	o.testRunStopOnce.Do(func() {
+		o.logger.Errorf("Elasticsearch: %s, aborting the test run as failOnDrop is enabled", reason)
+		o.stopTestRun(fmt.Errorf("output-elasticsearch dropped samples: %s", reason))
+	})
 }
 
 func (o *Output) Start() error {
+	if o.config.VerifyConnection.Bool {
+		if err := o.verifyConnection(); err != nil {
+			return err
+		}
+	}
+	if config, err := json.Marshal(o.config.Redacted()); err == nil {
+		o.logger.WithField("config", string(config)).Info("Elasticsearch: effective configuration")
+	}
+
+	if err := o.setUpIndices(); err != nil {
+		return err
+	}
+	if o.config.OnlyBreaches.Bool && len(o.thresholds) == 0 {
+		o.logger.Warn("Elasticsearch: onlyBreaches is enabled but the test has no thresholds, no samples are shipped")
+	}
+
+	o.indexMarker(context.Background(), markerTestStart)
+	if o.config.SummaryOnly.Bool {
+		o.summary = newTestSummary()
+	}
+	o.flushWG.Add(1)
+	go o.runFlushLoop()
+	go o.flushOnSignal()
+	if o.config.StatsInterval.Duration > 0 {
+		o.flushWG.Add(1)
+		go o.runStatsLoop()
+	}
+	o.logger.Debugf("Elasticsearch: starting writing to index %s", o.config.IndexName.String)
+
+	return nil
+}
+
+// setUpIndices puts the index template if enabled and creates the default index. Missing privileges for either
+// are only logged, as the service account may be allowed to write to indices set up by someone else.
+func (o *Output) setUpIndices() error {
 	indexName := o.config.IndexName.String
-	res, err := o.client.Indices.Create(indexName, o.client.Indices.Create.WithBody(bytes.NewReader(mapping)))
+	if o.config.EnsureIndexTemplate.Bool {
+		if err := o.putIndexTemplate(); errors.Is(err, errMissingPrivileges) {
+			o.logger.Warnf("Elasticsearch: %s, the index template must be set up separately", err)
+		} else if err != nil {
+			return err
+		}
+	}
+	// date-based and routed indices are created on demand when the first sample for them is flushed, data
+	// streams are created by Elasticsearch from a matching index template and aliases by whoever manages them
+	if o.config.CreateIndex.Bool && !isIndexTemplate(indexName) && !o.config.UseDataStream.Bool &&
+		!o.config.TargetIsAlias.Bool {
+		if err := o.createIndex(indexName); errors.Is(err, errMissingPrivileges) {
+			o.logger.Warnf("Elasticsearch: %s, the index must exist or be created automatically", err)
+		} else if err != nil {
+			return err
+		}
+		o.createdIndices[indexName] = true
+	}
+	return nil
+}
+
+// Stop flushes the remaining samples. It may have been started already by a SIGTERM, in which case it waits for
+// that to finish.
+func (o *Output) Stop() error {
+	o.stopOnce.Do(o.stop)
+	return nil
+}
+
+// flushOnSignal flushes the buffered samples as soon as the process receives SIGTERM, e.g. when Kubernetes
+// terminates a pod. k6 stops the outputs only after winding down the test, which may be too late before the process
+// is killed. The output keeps accepting samples until then.
+func (o *Output) flushOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	o.flushOnSignals(signals)
+}
+
+func (o *Output) flushOnSignals(signals <-chan os.Signal) {
+	timeout := time.Duration(o.config.ShutdownFlushTimeout.Duration)
+	for {
+		select {
+		case sig := <-signals:
+			o.logger.Warnf("Elasticsearch: received %s, flushing the buffered samples", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			if err := o.Flush(ctx); err != nil {
+				o.logger.Errorf("Elasticsearch: flushing after %s failed: %s", sig, err)
+			}
+			cancel()
+		case <-o.flushDone:
+			return
+		}
+	}
+}
+
+func (o *Output) stop() {
+	o.logger.Debug("Elasticsearch: stopping writing")
+	atomic.StoreInt32(&o.stopped, 1)
+	close(o.flushDone)
+
+	// a slow cluster must not keep k6 from exiting, the deadline also applies to the final bulk requests
+	timeout := time.Duration(o.config.ShutdownFlushTimeout.Duration)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	closed := make(chan error, 1)
+	go func() {
+		// waits for the final flush of the buffered samples and for a running Flush
+		o.flushWG.Wait()
+		o.flushMu.Lock()
+		defer o.flushMu.Unlock()
+		if left := int64(len(o.buffer.take())); left > 0 {
+			// the final flush was skipped by the open circuit breaker
+			o.stats.addTotal(left)
+			o.stats.drop(dropReasonCircuitOpen, left)
+		}
+		if o.summary != nil {
+			o.indexSummary()
+		}
+		err := o.bulkIndexer.Close(ctx)
+		if err == nil && ctx.Err() == nil {
+			// the end marker is indexed after all samples
+			o.indexMarker(ctx, markerTestEnd)
+		}
+		// the bulk requests write to the files until the indexer is closed, after a timeout they are left open
+		o.closeFiles()
+		closed <- err
+	}()
+	select {
+	case err := <-closed:
+		if err != nil && ctx.Err() == nil {
+			o.logger.Errorf("Elasticsearch: could not close the bulk indexer: %s", err)
+		}
+	case <-ctx.Done():
+	}
+	if ctx.Err() != nil {
+		o.abandon(timeout)
+	}
+
+	if summary, ok := o.itemErrors.summary(); ok {
+		o.logger.Errorf("Elasticsearch: %s", summary)
+	}
+	o.logger.Infof("Elasticsearch: %s", o.performance.summary())
+	o.stats.drop(dropReasonRequestFailed, o.failedRequestSamples())
+	if dropped, summary := o.stats.summary(); dropped > 0 {
+		o.logger.Warnf("Elasticsearch: %s", summary)
+		if byIndex, ok := o.stats.rejectedByIndex(); ok {
+			o.logger.Warnf("Elasticsearch: rejected documents by index: %s", byIndex)
+		}
+	} else {
+		o.logger.Infof("Elasticsearch: %s", summary)
+	}
+}
+
+// closeFiles closes the dryRunFile and the fileOutput if they are configured.
+func (o *Output) closeFiles() {
+	if o.dryRunFile != nil {
+		if err := o.dryRunFile.Close(); err != nil {
+			o.logger.Errorf("Elasticsearch: could not close dryRunFile: %s", err)
+		}
+	}
+	if o.fileOutput != nil {
+		if err := o.fileOutput.Close(); err != nil {
+			o.logger.Errorf("Elasticsearch: could not close fileOutput: %s", err)
+		}
+	}
+}
+
+// disabledSystemTags returns the names of the system tags that are not in the enabled set, none if it is not
+// set.
+func disabledSystemTags(enabled *metrics.SystemTagSet) map[string]bool {
+	if enabled == nil {
+		return nil
+	}
+	disabled := make(map[string]bool)
+	for _, tag := range metrics.SystemTagValues() {
+		if !enabled.Has(tag) {
+			disabled[tag.String()] = true
+		}
+	}
+	return disabled
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// retryBackoff returns the exponential backoff before retry attempt n. With jitter, a random duration up to this
+// backoff is used instead, so that many k6 instances hitting a throttled cluster don't retry at the same time.
+func retryBackoff(base time.Duration, jitter bool) func(int) time.Duration {
+	if !jitter {
+		return func(attempt int) time.Duration {
+			return base * time.Duration(1<<(attempt-1))
+		}
+	}
+	var mu sync.Mutex
+	random := mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
+	return func(attempt int) time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Duration(random.Int63n(int64(base*time.Duration(1<<(attempt-1))) + 1))
+	}
+}
+
+// newTLSConfig builds the TLS configuration of the connections to the cluster.
+func newTLSConfig(config Config, logger logrus.FieldLogger) (*tls.Config, error) {
+	if config.InsecureSkipVerify.Bool {
+		logger.Warn("Elasticsearch: TLS certificate verification is disabled, do not use this in production")
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify.Bool,
+		// the version and the cipher suites have been validated already, Go picks its defaults if they are not set
+		MinVersion: tlsVersions[config.TLSMinVersion.String],
+	}
+	if len(config.TLSCipherSuites) > 0 {
+		tlsConfig.CipherSuites, _ = cipherSuites(config.TLSCipherSuites)
+	}
+	if config.ClientCert.Valid && config.ClientKey.Valid {
+		clientTLSCert, err := tls.LoadX509KeyPair(config.ClientCert.String, config.ClientKey.String)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientTLSCert}
+	}
+	// The client can only apply es.Config.CACert to a plain http.Transport, so the pool is set up here instead.
+	var caCert []byte
+	if config.CACert.Valid {
+		if config.CACertPEM.Valid {
+			logger.Warn("Elasticsearch: both a CA certificate file and PEM are configured, using the file")
+		}
+		var err error
+		caCert, err = os.ReadFile(config.CACert.String)
+		if err != nil {
+			return nil, err
+		}
+	} else if config.CACertPEM.Valid {
+		caCert = []byte(config.CACertPEM.String)
+	}
+	if caCert != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if ok := tlsConfig.RootCAs.AppendCertsFromPEM(caCert); !ok {
+			return nil, errors.New("could not add CA certificate, it must be PEM-encoded")
+		}
+	}
+	return tlsConfig, nil
+}
+
+// newHTTPTransport builds the transport the client connects to the cluster with.
+func newHTTPTransport(config Config, tlsConfig *tls.Config) (*http.Transport, error) {
+	// without an explicit proxy, HTTPS_PROXY, HTTP_PROXY and NO_PROXY are respected
+	httpTransport := &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}
+	// keep a connection for every worker of the bulk indexer instead of just two per host
+	maxIdleConns := int(config.MaxIdleConns.Int64)
+	if !config.MaxIdleConns.Valid {
+		maxIdleConns = bulkWorkers(config)
+	}
+	httpTransport.MaxIdleConnsPerHost = maxIdleConns
+	httpTransport.IdleConnTimeout = time.Duration(config.IdleConnTimeout.Duration)
+	if config.Proxy.Valid {
+		proxy, err := proxyURL(config.Proxy.String)
+		if err != nil {
+			return nil, err
+		}
+		httpTransport.Proxy = http.ProxyURL(proxy)
+	}
+	return httpTransport, nil
+}
+
+// bulkWorkers returns the number of workers of the bulk indexer, which defaults to the number of CPUs.
+func bulkWorkers(config Config) int {
+	if config.Concurrency.Valid {
+		return int(config.Concurrency.Int64)
+	}
+	return runtime.NumCPU()
+}
+
+// verifyConnection makes sure that the cluster is reachable with the configured credentials before the test starts,
+// instead of failing with the first flush. Transient failures are retried startupRetries times.
+func (o *Output) verifyConnection() error {
+	delay := time.Duration(o.config.StartupRetryDelay.Duration)
+	for attempt := int64(0); ; attempt++ {
+		transient, err := o.checkConnection()
+		if err == nil || !transient || attempt >= o.config.StartupRetries.Int64 {
+			return err
+		}
+		o.logger.Warnf("Elasticsearch: %s, retrying in %s (%d of %d)",
+			err, delay, attempt+1, o.config.StartupRetries.Int64)
+		time.Sleep(delay)
+	}
+}
+
+// checkConnection checks once that the cluster is reachable and accepts the credentials. Connection errors and
+// server errors are transient, e.g. while the cluster is still starting, the others are not worth retrying.
+func (o *Output) checkConnection() (transient bool, err error) {
+	info, err := o.client.Info()
+	if err != nil {
+		var certErr *tls.CertificateVerificationError
+		if errors.As(err, &certErr) {
+			return false, fmt.Errorf("cannot connect to Elasticsearch, the TLS certificate of the cluster is not "+
+				"trusted (configure caCertFile or caCertPem): %v", err)
+		}
+		return true, fmt.Errorf("cannot connect to Elasticsearch, check url or cloud-id and the proxy settings: %v",
+			err)
+	}
+	defer info.Body.Close()
+
+	switch info.StatusCode {
+	case http.StatusOK:
+		return false, nil
+	case http.StatusUnauthorized:
+		return false, fmt.Errorf("cannot connect to Elasticsearch (status code %d), the credentials were rejected "+
+			"(check user and password, apiKey or serviceAccountToken)", info.StatusCode)
+	case http.StatusForbidden:
+		// The info API requires the 'monitor' privilege and the user might not have that. We can only get a 403 if
+		// security is configured on this cluster. Therefore, we call the has privilege API that is guaranteed to work
+		//for every user.
+		indexName := resolveIndexName(o.config.IndexName.String, time.Now())
+		priv, err := o.client.Security.HasPrivileges(strings.NewReader(fmt.Sprintf(hasPrivilegesBody, indexName)))
+		if err != nil {
+			return true, fmt.Errorf("cannot connect to Elasticsearch: %v", err)
+		}
+		defer priv.Body.Close()
+		if priv.StatusCode != http.StatusOK {
+			return false, fmt.Errorf("cannot connect to Elasticsearch (status code %d), the user lacks privileges "+
+				"(write and create_index on %s are required)", priv.StatusCode, indexName)
+		}
+		return false, nil
+	default:
+		return info.StatusCode >= http.StatusInternalServerError,
+			fmt.Errorf("cannot connect to Elasticsearch (status code %d)", info.StatusCode)
+	}
+}
+
+// abandon counts the samples that have not been indexed when the final flush timed out.
+func (o *Output) abandon(timeout time.Duration) {
+	buffered := int64(len(o.buffer.take()))
+	o.stats.addTotal(buffered)
+
+	stats := o.indexerStats()
+	abandoned := buffered + int64(stats.NumAdded) - int64(stats.NumFlushed) - int64(stats.NumFailed)
+	o.stats.drop(dropReasonShutdown, abandoned)
+	o.logger.Warnf("Elasticsearch: the final flush did not finish within %s, abandoning %d samples", timeout, abandoned)
+}
+
+// AddMetricSamples buffers the samples, dropping samples once maxBufferedSamples is reached, and requests an early
+// flush once maxBatchSize samples are buffered.
+func (o *Output) AddMetricSamples(samples []metrics.SampleContainer) {
+	if atomic.LoadInt32(&o.stopped) == 1 {
+		var n int64
+		for _, container := range samples {
+			n += int64(len(container.GetSamples()))
+		}
+		o.stats.addTotal(n)
+		o.stats.drop(dropReasonStopped, n)
+		return
+	}
+	samples = o.filterSamples(samples)
+	if o.summary != nil {
+		o.summary.add(samples)
+		return
+	}
+	buffered, dropped := o.buffer.add(samples)
+	if dropped > 0 {
+		o.stats.addTotal(int64(dropped))
+		o.stats.drop(dropReasonBufferFull, int64(dropped))
+		if atomic.CompareAndSwapInt32(&o.bufferFull, 0, 1) {
+			o.logger.Warnf("Elasticsearch: the buffer is full with %d samples, samples are dropped (%s) until Elasticsearch catches up",
+				o.config.MaxBufferedSamples.Int64, o.config.BufferOverflow.String)
+		}
+		o.failOnDrop(fmt.Sprintf("%d samples were dropped because the buffer is full", dropped))
+	}
+
+	maxBatchSize := o.config.MaxBatchSize.Int64
+	if maxBatchSize <= 0 || !countTriggers(o.config) {
+		return
+	}
+	if int64(buffered) >= maxBatchSize {
+		select {
+		case o.flushSignal <- struct{}{}:
+		default:
+			// a flush is already pending
+		}
+	}
+}
+
+// filterSamples drops all samples that should not be shipped, so that they are never buffered.
+func (o *Output) filterSamples(samplesContainers []metrics.SampleContainer) []metrics.SampleContainer {
+	if len(o.includeMetrics) == 0 && len(o.excludeMetrics) == 0 && len(o.includeMetricTypes) == 0 &&
+		len(o.excludeMetricTypes) == 0 && o.config.SampleRate.Float64 >= 1 && !o.config.OnlyBreaches.Bool {
+		return samplesContainers
+	}
+	var filtered metrics.Samples
+	for _, samplesContainer := range samplesContainers {
+		for _, sample := range samplesContainer.GetSamples() {
+			if o.shipMetric(sample.Metric.Name) && o.shipMetricType(sample.Metric.Type) && o.sampled(sample) &&
+				(!o.config.OnlyBreaches.Bool || o.breached(sample.Metric.Name)) {
+				filtered = append(filtered, sample)
+			}
+		}
+	}
+	if len(filtered) == 0 {
+		return nil
+	}
+	return []metrics.SampleContainer{filtered}
+}
+
+// sampled decides randomly whether to keep a sample according to sampleRate. Counters and gauges are always kept,
+// as totals and current values would be wrong otherwise.
+func (o *Output) sampled(sample metrics.Sample) bool {
+	switch sample.Metric.Type {
+	case metrics.Counter, metrics.Gauge:
+		return true
+	default:
+		return o.random() < o.config.SampleRate.Float64
+	}
+}
+
+// shipMetric applies the includeMetrics allowlist or, if that is empty, the excludeMetrics denylist.
+func (o *Output) shipMetric(name string) bool {
+	if len(o.includeMetrics) > 0 {
+		return o.includeMetrics[name]
+	}
+	return !o.excludeMetrics[name]
+}
+
+// shipMetricType applies the includeMetricTypes allowlist or, if that is empty, the excludeMetricTypes denylist.
+func (o *Output) shipMetricType(t metrics.MetricType) bool {
+	if len(o.includeMetricTypes) > 0 {
+		return o.includeMetricTypes[t]
+	}
+	return !o.excludeMetricTypes[t]
+}
+
+// breached reports whether a threshold of the metric or one of its submetrics failed when k6 last evaluated the
+// thresholds, which it does every few seconds.
+func (o *Output) breached(name string) bool {
+	for _, threshold := range o.thresholds[name] {
+		if threshold.LastFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// runFlushLoop flushes the buffer whenever flushPeriod has passed since the last flush or AddMetricSamples signals
+// that maxBatchSize has been reached. The remaining samples are flushed once flushDone is closed.
+func (o *Output) runFlushLoop() {
+	defer o.flushWG.Done()
+	period := flushLoopPeriod(o.config)
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+	statsTicker := time.NewTicker(statsLogInterval)
+	defer statsTicker.Stop()
+	for {
+		select {
+		case <-statsTicker.C:
+			o.logger.Debugf("Elasticsearch: %s", o.performance.summary())
+			continue
+		case <-timer.C:
+			o.flush()
+		case <-o.flushSignal:
+			o.flush()
+			// the period starts over after an early flush
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-o.flushDone:
+			o.flush()
+			return
+		}
+		timer.Reset(period)
+	}
+}
+
+// flushLoopPeriod is the time after which the buffer is flushed if nothing else has triggered a flush.
+func flushLoopPeriod(c Config) time.Duration {
+	if c.FlushTrigger.String == flushTriggerCount {
+		return maxFlushDelay
+	}
+	return time.Duration(c.FlushPeriod.Duration)
+}
+
+// countTriggers reports whether reaching maxBatchSize buffered samples flushes early.
+func countTriggers(c Config) bool {
+	return c.FlushTrigger.String == flushTriggerAny || c.FlushTrigger.String == flushTriggerCount
+}
+
+// bulkFlushInterval is the interval at which the bulk indexer sends the documents it has received, even if they
+// are short of maxBatchBytes.
+func bulkFlushInterval(c Config) time.Duration {
+	if c.FlushTrigger.String == flushTriggerTime {
+		return time.Duration(c.FlushPeriod.Duration)
+	}
+	return maxFlushDelay
+}
+
+// runStatsLoop logs the progress of the output every statsInterval until flushDone is closed, as a heartbeat for
+// long tests.
+func (o *Output) runStatsLoop() {
+	defer o.flushWG.Done()
+	ticker := time.NewTicker(time.Duration(o.config.StatsInterval.Duration))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			flushed, last := o.performance.flushedAndLast()
+			dropped := o.stats.droppedTotal() + o.failedRequestSamples()
+			o.logger.Infof("Elasticsearch: %d samples buffered, %d flushed, %d dropped, last bulk request took %s",
+				o.buffer.len(), flushed, dropped, last.Round(time.Millisecond))
+		case <-o.flushDone:
+			return
+		}
+	}
+}
+
+// failedRequestSamples returns the number of samples lost in failed bulk requests, which the indexer counts
+// together with rejected items.
+func (o *Output) failedRequestSamples() int64 {
+	failed := int64(o.indexerStats().NumFailed)
+	return failed - o.stats.droppedFor(dropReasonRejected) - o.stats.duplicateCount()
+}
+
+// putIndexTemplate creates or updates the index template, which is idempotent and thus safe for repeated runs.
+func (o *Output) putIndexTemplate() error {
+	templateName := o.config.IndexTemplateName.String
+	body, err := indexTemplate(o.config, o.mapping)
+	if err != nil {
+		return fmt.Errorf("could not build index template %s: %v", templateName, err)
+	}
+	res, err := o.client.Indices.PutIndexTemplate(templateName, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return fmt.Errorf("could not read response after failure to put index template %s: %v", templateName, err)
+		}
+		if res.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("could not put index template %s: %w: %s", templateName, errMissingPrivileges, body)
+		}
+		return fmt.Errorf("could not put index template %s: %s", templateName, body)
+	}
+	o.logger.Debugf("Elasticsearch: put index template %s", templateName)
+	return nil
+}
+
+// errMissingPrivileges is wrapped by the errors of setting up indices when Elasticsearch denied the request.
+var errMissingPrivileges = errors.New("missing privileges")
+
+func (o *Output) createIndex(indexName string) error {
+	res, err := o.client.Indices.Create(indexName, o.client.Indices.Create.WithBody(bytes.NewReader(o.mapping)))
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 	// 400 usually happens when the index already exists, which is ok for our purposes.
 	if res.StatusCode > 400 {
 		body, err := io.ReadAll(res.Body)
 		if err != nil {
 			return fmt.Errorf("could not read response after failure to create index %s: %v", indexName, err)
 		}
+		if res.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("could not create index %s: %w: %s", indexName, errMissingPrivileges, body)
+		}
 		return fmt.Errorf("could not create index %s: %s", indexName, body)
 	}
-	res.Body.Close()
+	return nil
+}
 
-	if periodicFlusher, err := output.NewPeriodicFlusher(time.Duration(o.config.FlushPeriod.Duration), o.flush); err != nil {
-		return err
-	} else {
-		o.periodicFlusher = periodicFlusher
+// indexFor returns the index a sample is written to, creating it if necessary. An empty name means that the sample
+// is written to the default index of the bulk indexer.
+func (o *Output) indexFor(sample metrics.Sample) string {
+	name := o.config.indexNameFor(sample.Metric.Name)
+	if name == o.config.IndexName.String && !isIndexTemplate(name) {
+		return ""
 	}
-	o.logger.Debugf("Elasticsearch: starting writing to index %s", indexName)
-
-	return nil
+	indexTime := sample.Time
+	if !o.config.UseSampleTimeForIndex.Bool {
+		indexTime = time.Now()
+	}
+	indexName := resolveIndexName(name, indexTime)
+	o.ensureIndex(indexName)
+	return indexName
 }
 
-func (o *Output) Stop() error {
-	o.logger.Debug("Elasticsearch: stopping writing")
-	o.periodicFlusher.Stop()
-	if err := o.bulkIndexer.Close(context.Background()); err != nil {
-		log.Fatalf("Elasticsearch: Could not close bulk indexer: %s", err)
+// ensureIndex creates an index on first use. It must not be called concurrently.
+func (o *Output) ensureIndex(indexName string) {
+	// data streams are created by Elasticsearch from a matching index template, an alias must exist already
+	if o.createdIndices[indexName] || !o.config.CreateIndex.Bool || o.config.UseDataStream.Bool ||
+		(o.config.TargetIsAlias.Bool && indexName == o.config.IndexName.String) {
+		return
 	}
-	return nil
+	if err := o.createIndex(indexName); err != nil {
+		o.logger.Errorf("Elasticsearch: %s", err)
+	}
+	o.createdIndices[indexName] = true
 }
 
 func (o *Output) blkItemErrHandler(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+	if err == nil && res.Status == http.StatusConflict && item.Action == opTypeCreate {
+		// the document has been indexed before, e.g. by a previous run with the same document ids
+		o.stats.duplicate()
+		return
+	}
+	index := item.Index
+	if index == "" {
+		index = o.config.IndexName.String
+	}
+	o.stats.reject(index)
+
+	var errorType, reason string
 	if err != nil {
-		o.logger.Errorf("%s", err)
+		errorType, reason = "local_error", err.Error()
 	} else {
-		o.logger.Errorf("%s: %s", res.Error.Type, res.Error.Reason)
+		errorType, reason = res.Error.Type, res.Error.Reason
+		if errorType == "" {
+			errorType = fmt.Sprintf("status_%d", res.Status)
+		}
 	}
+	if summary, ok := o.itemErrors.record(errorType, reason); ok {
+		o.logger.Errorf("Elasticsearch: %s", summary)
+	}
+	o.failOnDrop(fmt.Sprintf("a document was rejected (%s: %s)", errorType, reason))
 }
 
 func (o *Output) flush() {
-	samplesContainers := o.GetBufferedSamples()
-	for _, samplesContainer := range samplesContainers {
-		samples := samplesContainer.GetSamples()
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+	o.flushBuffer()
+}
 
+// Flush synchronously flushes the buffered samples and sends all documents the bulk indexer holds, independent
+// of the flush loop, e.g. for integration tests of a k6 binary that embeds the output. It returns an error if the
+// bulk requests did not finish in time or any document was not indexed.
+func (o *Output) Flush(ctx context.Context) error {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+	if atomic.LoadInt32(&o.stopped) == 1 {
+		return errors.New("the output has been stopped")
+	}
+	if o.breaker != nil && !o.breaker.allow() {
+		return errors.New("the circuit breaker is open, the samples stay buffered")
+	}
+	o.flushBuffer()
+
+	// the bulk indexer can only be drained by closing it, later samples go to a new one
+	next, err := o.newBulkIndexer()
+	if err != nil {
+		return fmt.Errorf("error creating the indexer: %v", err)
+	}
+	o.indexerMu.Lock()
+	previous := o.bulkIndexer
+	o.bulkIndexer = next
+	o.retiredIndexers = append(o.retiredIndexers, previous)
+	o.indexerMu.Unlock()
+
+	failedBefore := int64(previous.Stats().NumFailed) - o.stats.duplicateCount()
+	if err := previous.Close(ctx); err != nil {
+		return fmt.Errorf("could not send the bulk requests: %w", err)
+	}
+	if failed := int64(previous.Stats().NumFailed) - o.stats.duplicateCount() - failedBefore; failed > 0 {
+		return fmt.Errorf("%d documents could not be indexed", failed)
+	}
+	return nil
+}
+
+// indexerStats returns the statistics of the current and all retired bulk indexers.
+func (o *Output) indexerStats() esutil.BulkIndexerStats {
+	o.indexerMu.RLock()
+	defer o.indexerMu.RUnlock()
+	stats := o.bulkIndexer.Stats()
+	for _, retired := range o.retiredIndexers {
+		r := retired.Stats()
+		stats.NumAdded += r.NumAdded
+		stats.NumFlushed += r.NumFlushed
+		stats.NumFailed += r.NumFailed
+		stats.NumIndexed += r.NumIndexed
+		stats.NumCreated += r.NumCreated
+		stats.NumUpdated += r.NumUpdated
+		stats.NumDeleted += r.NumDeleted
+		stats.NumRequests += r.NumRequests
+	}
+	return stats
+}
+
+// flushBuffer adds the buffered samples to the bulk indexer, the caller holds flushMu.
+func (o *Output) flushBuffer() {
+	if o.failover != nil && o.failover.takeSwitch() {
+		// the fallback cluster knows none of the indices yet
+		o.createdIndices = make(map[string]bool)
+		if err := o.setUpIndices(); err != nil {
+			o.logger.Errorf("Elasticsearch: could not set up the indices on the fallback cluster: %s", err)
+		}
+	}
+	if o.breaker != nil && !o.breaker.allow() {
+		// the samples stay buffered until the cooldown has passed
+		return
+	}
+	samples := o.buffer.take()
+	progress := &flushProgress{samples: len(samples)}
+	if o.config.PanicPolicy.String == panicPolicyRecover {
+		defer o.recoverFlush(progress)
+	}
+	o.performance.flushed(int64(len(samples)))
+	index := func(entry elasticMetricEntry, sample metrics.Sample) {
+		o.index(entry, sample)
+		progress.indexed++
+	}
+	if !o.config.AggregateTrends.Bool {
+		progress.documents = len(samples)
+		o.stats.addTotal(int64(progress.documents))
 		for _, sample := range samples {
-			mappedEntry := elasticMetricEntry{
-				MetricName: sample.Metric.Name,
-				MetricType: sample.Metric.Type.String(),
-				Value:      sample.Value,
-				Tags:       sample.GetTags().Map(),
-				Time:       sample.Time,
-			}
-			data, err := json.Marshal(mappedEntry)
-			if err != nil {
-				o.logger.Fatalf("Cannot encode document: %s, %s", err, mappedEntry)
-			}
-			var item = esutil.BulkIndexerItem{
-				Action:    "create",
-				Body:      bytes.NewReader(data),
-				OnFailure: o.blkItemErrHandler,
-			}
-			err = o.bulkIndexer.Add(
-				context.Background(),
-				item,
-			)
-			if err != nil {
-				log.Fatalf("Unexpected error: %s", err)
-			}
+			index(o.newEntry(sample), sample)
 		}
+		return
+	}
+
+	// with aggregation, the statistics count documents instead of samples
+	samples, aggregates := aggregateTrends(samples)
+	progress.documents = len(samples) + len(aggregates)
+	o.stats.addTotal(int64(progress.documents))
+	for _, sample := range samples {
+		index(o.newEntry(sample), sample)
+	}
+	for _, aggregate := range aggregates {
+		sample := metrics.Sample{TimeSeries: aggregate.series, Time: aggregate.time}
+		index(o.newSummaryEntry(aggregate), sample)
+	}
+}
+
+// flushProgress tracks how far a flush got, so that the documents lost to a panic can be counted.
+type flushProgress struct {
+	samples int
+	// the documents of the batch, zero until they have been counted
+	documents int
+	indexed   int
+}
+
+// recoverFlush recovers from a panic while flushing, e.g. caused by a sample that cannot be mapped, so that the
+// test keeps running. The rest of the batch is lost and counted as dropped.
+func (o *Output) recoverFlush(progress *flushProgress) {
+	if r := recover(); r != nil {
+		lost := progress.documents - progress.indexed
+		if progress.documents == 0 {
+			// the batch had not been counted yet, e.g. during the aggregation
+			o.stats.addTotal(int64(progress.samples))
+			lost = progress.samples
+		}
+		o.logger.Errorf("Elasticsearch: recovered from a panic while flushing a batch of %d samples, "+
+			"%d documents of it are lost: %v\n%s", progress.samples, lost, r, debug.Stack())
+		o.stats.drop(dropReasonPanic, int64(lost))
+		o.failOnDrop("flushing a batch panicked")
+	}
+}
+
+// indexSummary indexes one document with the end-of-test summary per metric.
+func (o *Output) indexSummary() {
+	end := time.Now()
+	summaries := o.summary.summaries(end)
+	o.stats.addTotal(int64(len(summaries)))
+	for _, summary := range summaries {
+		o.index(o.newSummaryDocument(summary, end))
+	}
+	o.logger.Debugf("Elasticsearch: indexing the summary of %d metrics", len(summaries))
+}
+
+// index adds the document of a sample to the bulk indexer.
+func (o *Output) index(mappedEntry elasticMetricEntry, sample metrics.Sample) {
+	data, err := o.encode(mappedEntry)
+	if err != nil {
+		// e.g. a value of NaN or infinity, which JSON cannot represent
+		o.logger.Errorf("Elasticsearch: dropping a document for metric %s that cannot be encoded: %s",
+			sample.Metric.Name, err)
+		o.stats.drop(dropReasonEncodingFailed, 1)
+		o.failOnDrop(fmt.Sprintf("a document could not be encoded: %s", err))
+		return
+	}
+	if int64(len(data)) > o.config.MaxBatchBytes.Int64 {
+		o.logger.Errorf("Elasticsearch: dropping document of %d bytes for metric %s, it exceeds maxBatchBytes",
+			len(data), sample.Metric.Name)
+		o.stats.drop(dropReasonTooLarge, 1)
+		o.failOnDrop("a document exceeds maxBatchBytes")
+		return
+	}
+	var item = esutil.BulkIndexerItem{
+		Index:      o.indexFor(sample),
+		Action:     o.config.opType(),
+		DocumentID: o.documentID(mappedEntry, sample),
+		Routing:    o.routing(sample),
+		Body:       bytes.NewReader(data),
+		OnFailure:  o.blkItemErrHandler,
+	}
+	err = o.bulkIndexer.Add(
+		context.Background(),
+		item,
+	)
+	if err != nil {
+		o.logger.Errorf("Elasticsearch: dropping a document for metric %s, the bulk indexer rejected it: %s",
+			sample.Metric.Name, err)
+		o.stats.drop(dropReasonStopped, 1)
+		o.failOnDrop(fmt.Sprintf("a document could not be added to the bulk indexer: %s", err))
 	}
 }
@@ -0,0 +1,2066 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"github.com/guregu/null/v5"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"go.k6.io/k6/lib/types"
+	"go.k6.io/k6/metrics"
+	"go.k6.io/k6/output"
+)
+
+// fakeCluster stands in for Elasticsearch. Bulk requests succeed for all items unless bulk is set.
+type fakeCluster struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// the bodies of the bulk requests, their URLs and headers
+	bulkBodies  []string
+	bulkURLs    []string
+	bulkHeaders []http.Header
+	// bulk returns the status and body of the response to a bulk request, it is called with mu held
+	bulk func(body string) (int, string)
+	// the other requests, e.g. to set up indices
+	requests []fakeRequest
+	// respond returns the status and body of the response to the other requests, it is called with mu held
+	respond func(req fakeRequest) (int, string)
+}
+
+// fakeRequest is a request to a fakeCluster.
+type fakeRequest struct {
+	method, path, body string
+}
+
+func newFakeCluster(t *testing.T) *fakeCluster {
+	t.Helper()
+	c := &fakeCluster{}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.handle))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *fakeCluster) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	body, _ := io.ReadAll(r.Body)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+		req := fakeRequest{method: r.Method, path: r.URL.Path, body: string(body)}
+		c.requests = append(c.requests, req)
+		status, response := http.StatusOK, `{}`
+		if c.respond != nil {
+			status, response = c.respond(req)
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(response))
+		return
+	}
+	c.bulkBodies = append(c.bulkBodies, string(body))
+	c.bulkURLs = append(c.bulkURLs, r.URL.String())
+	c.bulkHeaders = append(c.bulkHeaders, r.Header.Clone())
+	status, response := http.StatusOK, acceptAll(string(body))
+	if c.bulk != nil {
+		status, response = c.bulk(string(body))
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(response))
+}
+
+// bulkRequests returns the bodies of the bulk requests received so far.
+func (c *fakeCluster) bulkRequests() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.bulkBodies...)
+}
+
+// request returns the last request with the method and path, if any.
+func (c *fakeCluster) request(method, path string) (fakeRequest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.requests) - 1; i >= 0; i-- {
+		if c.requests[i].method == method && c.requests[i].path == path {
+			return c.requests[i], true
+		}
+	}
+	return fakeRequest{}, false
+}
+
+// bulkLines returns the number of NDJSON lines the cluster received in bulk requests, two per document.
+func (c *fakeCluster) bulkLines() int {
+	return strings.Count(strings.Join(c.bulkRequests(), ""), "\n")
+}
+
+// acceptAll returns the response to a bulk request that indexed all of its items.
+func acceptAll(body string) string {
+	items := make([]string, len(bulkItems([]byte(body))))
+	for i := range items {
+		items[i] = `{"index":{"status":201}}`
+	}
+	return `{"errors":false,"items":[` + strings.Join(items, ",") + `]}`
+}
+
+// newTestOutput creates an output writing to the cluster with the given argument, e.g. "maxBatchSize=10".
+func newTestOutput(t *testing.T, cluster *fakeCluster, arg string) *Output {
+	t.Helper()
+	o, _ := newTestOutputWithLogs(t, cluster, arg)
+	return o
+}
+
+// newTestOutputWithLogs is newTestOutput with a hook recording the log entries of the output.
+func newTestOutputWithLogs(t *testing.T, cluster *fakeCluster, arg string) (*Output, *test.Hook) {
+	t.Helper()
+	logger, hook := test.NewNullLogger()
+	configArg := "url=" + cluster.URL
+	if arg != "" {
+		configArg += "," + arg
+	}
+	out, err := New(output.Params{Logger: logger, ConfigArgument: configArg, Environment: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.(*Output), hook
+}
+
+// newTestSamples returns n samples of a counter.
+func newTestSamples(n int) []metrics.SampleContainer {
+	registry := metrics.NewRegistry()
+	metric := registry.MustNewMetric("test_counter", metrics.Counter)
+	samples := make([]metrics.SampleContainer, n)
+	for i := range samples {
+		samples[i] = metrics.Sample{
+			TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet().With("i", "x")},
+			Time:       time.Now(),
+			Value:      float64(i),
+		}
+	}
+	return samples
+}
+
+func TestFlushDropsDocumentsThatCannotBeEncoded(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	samples := newTestSamples(3)
+	nan := samples[1].(metrics.Sample)
+	nan.Value = math.NaN()
+	samples[1] = nan
+	o.AddMetricSamples(samples)
+	if err := o.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := o.stats.droppedFor(dropReasonEncodingFailed); n != 1 {
+		t.Errorf("got %d documents dropped for encoding, want 1", n)
+	}
+	if got := cluster.bulkLines(); got != 4 {
+		t.Errorf("got %d bulk lines, want 4 for the other two samples", got)
+	}
+}
+
+func TestFlushRecoversFromPanic(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "")
+	encode := o.encode
+	o.encode = func(entry elasticMetricEntry) ([]byte, error) {
+		for _, field := range entry {
+			if field.Name == "Value" && field.Value == float64(1) {
+				panic("cannot encode")
+			}
+		}
+		return encode(entry)
+	}
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// the second sample panics, the third is lost with it
+	o.AddMetricSamples(newTestSamples(3))
+	o.flush()
+	// the output keeps running
+	o.AddMetricSamples(newTestSamples(1))
+	if err := o.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := o.stats.droppedFor(dropReasonPanic); n != 2 {
+		t.Errorf("got %d documents dropped for the panic, want 2", n)
+	}
+	if dropped, summary := o.stats.summary(); dropped != 2 {
+		t.Errorf("got summary %q, want 2 dropped", summary)
+	}
+	if got := cluster.bulkLines(); got != 4 {
+		t.Errorf("got %d bulk lines, want 4 for the first sample of each flush", got)
+	}
+}
+
+func TestFlushPanicsWithCrashPolicy(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "panicPolicy=crash")
+	o.encode = func(elasticMetricEntry) ([]byte, error) {
+		panic("cannot encode")
+	}
+	o.AddMetricSamples(newTestSamples(1))
+	defer func() {
+		if recover() == nil {
+			t.Error("the panic was recovered")
+		}
+	}()
+	o.flush()
+}
+
+func TestStopFlushesBufferedSamples(t *testing.T) {
+	cluster := newFakeCluster(t)
+	// neither the period nor the batch size trigger a flush before the stop
+	o := newTestOutput(t, cluster, "flushPeriod=1h,maxBatchSize=1000")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	o.AddMetricSamples(newTestSamples(3))
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := cluster.bulkLines(); got != 6 {
+		t.Errorf("got %d bulk lines, want 6 for 3 samples", got)
+	}
+	if dropped, summary := o.stats.summary(); dropped != 0 {
+		t.Errorf("got summary %q, want no dropped samples", summary)
+	}
+}
+
+func TestSignalFlushesAndKeepsAcceptingSamples(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "flushPeriod=1h,maxBatchSize=1000")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.flushOnSignals(signals)
+	}()
+	o.AddMetricSamples(newTestSamples(2))
+	signals <- syscall.SIGTERM
+	// the second signal is only received once the first flush has finished
+	signals <- syscall.SIGTERM
+	if got := cluster.bulkLines(); got != 4 {
+		t.Errorf("got %d bulk lines after the signal, want 4 for 2 samples", got)
+	}
+
+	// e.g. from the teardown
+	o.AddMetricSamples(newTestSamples(1))
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if got := cluster.bulkLines(); got != 6 {
+		t.Errorf("got %d bulk lines after the stop, want 6 for 3 samples", got)
+	}
+}
+
+func TestSamplesAfterStopAreCountedAsDropped(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	o.AddMetricSamples(newTestSamples(2))
+
+	if n := o.stats.droppedFor(dropReasonStopped); n != 2 {
+		t.Errorf("got %d samples dropped after the stop, want 2", n)
+	}
+}
+
+func TestMaxBatchSizeTriggersFlushes(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "flushPeriod=1h,maxBatchSize=5000")
+	// the flush loop is not started, the test flushes whenever AddMetricSamples signals it
+	samples := newTestSamples(12000)
+	signals := 0
+	for i := 0; i < len(samples); i += 1000 {
+		o.AddMetricSamples(samples[i : i+1000])
+		select {
+		case <-o.flushSignal:
+			signals++
+			o.flush()
+		default:
+		}
+	}
+	// the final flush of the remaining samples
+	o.flush()
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if signals != 2 {
+		t.Errorf("got %d early flushes, want 2", signals)
+	}
+	s := o.performance
+	if s.flushes != 3 || s.flushedSamples != 12000 || s.maxFlushSamples != 5000 {
+		t.Errorf("got %d flushes with %d samples (max %d), want 3 with 12000 (max 5000)",
+			s.flushes, s.flushedSamples, s.maxFlushSamples)
+	}
+	if got := cluster.bulkLines(); got != 24000 {
+		t.Errorf("got %d bulk lines, want 24000", got)
+	}
+}
+
+func TestMaxBatchBytesSplitsBulkRequests(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "maxBatchBytes=5000,concurrency=1")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// documents of more than 1000 bytes each, and one that is larger than maxBatchBytes on its own
+	samples := newTestSamples(11)
+	for i := range samples {
+		sample := samples[i].(metrics.Sample)
+		size := 1000
+		if i == 5 {
+			size = 6000
+		}
+		sample.Tags = sample.Tags.With("large", strings.Repeat("x", size))
+		samples[i] = sample
+	}
+	o.AddMetricSamples(samples)
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := o.stats.droppedFor(dropReasonTooLarge); n != 1 {
+		t.Errorf("got %d documents dropped as too large, want 1", n)
+	}
+	requests := cluster.bulkRequests()
+	if len(requests) < 2 {
+		t.Fatalf("got %d bulk requests, want the 10 documents split into at least 2", len(requests))
+	}
+	documents := 0
+	for i, body := range requests {
+		lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+		if len(lines)%2 != 0 {
+			t.Fatalf("bulk request %d has %d lines, a document was split", i, len(lines))
+		}
+		documents += len(lines) / 2
+		// a request is sent as soon as it reaches maxBatchBytes, so only its last document exceeds it
+		last := len(lines[len(lines)-2]) + len(lines[len(lines)-1]) + 2
+		if i < len(requests)-1 && (len(body) < 5000 || len(body)-last >= 5000) {
+			t.Errorf("bulk request %d of %d bytes was not sent when it reached maxBatchBytes", i, len(body))
+		}
+	}
+	if documents != 10 {
+		t.Errorf("got %d documents, want 10", documents)
+	}
+}
+
+func TestConcurrentBulkRequests(t *testing.T) {
+	const workers = 4
+	var mu sync.Mutex
+	var inFlight, maxInFlight, lines int
+	// a cluster that holds every bulk request until all workers have sent one, or for at most a second
+	allInFlight := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := io.ReadAll(r.Body)
+		if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+			if maxInFlight == workers {
+				close(allInFlight)
+			}
+		}
+		lines += strings.Count(string(body), "\n")
+		mu.Unlock()
+		select {
+		case <-allInFlight:
+		case <-time.After(time.Second):
+		}
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		_, _ = w.Write([]byte(acceptAll(string(body))))
+	}))
+	t.Cleanup(server.Close)
+
+	logger, _ := test.NewNullLogger()
+	out, err := New(output.Params{
+		Logger:         logger,
+		ConfigArgument: fmt.Sprintf("url=%s,concurrency=%d,maxBatchBytes=2000,flushPeriod=1h", server.URL, workers),
+		Environment:    map[string]string{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := out.(*Output)
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	o.AddMetricSamples(newTestSamples(400))
+	o.flush()
+	// Stop waits for all workers to send their documents
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxInFlight != workers {
+		t.Errorf("got at most %d bulk requests at once, want %d", maxInFlight, workers)
+	}
+	if lines != 800 {
+		t.Errorf("got %d bulk lines, want 800", lines)
+	}
+}
+
+func TestFailedBulkRequestsAreRetried(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries string
+		wantLines  int
+		wantFailed int64
+		// Flush reports the documents of the failed request
+		wantErr bool
+	}{
+		{name: "delivered", maxRetries: "3", wantLines: 6},
+		{name: "retries exhausted", maxRetries: "1", wantFailed: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			attempts := 0
+			delivered := 0
+			cluster.bulk = func(body string) (int, string) {
+				// the first two attempts fail
+				attempts++
+				switch attempts {
+				case 1:
+					return http.StatusServiceUnavailable, `{}`
+				case 2:
+					return http.StatusTooManyRequests, `{}`
+				}
+				delivered += strings.Count(body, "\n")
+				return http.StatusOK, acceptAll(body)
+			}
+			o := newTestOutput(t, cluster, "retryBackoff=1ms,maxRetries="+tt.maxRetries)
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			o.AddMetricSamples(newTestSamples(3))
+			if err := o.Flush(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v from Flush, want an error: %t", err, tt.wantErr)
+			}
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			if delivered != tt.wantLines {
+				t.Errorf("got %d bulk lines delivered, want %d", delivered, tt.wantLines)
+			}
+			if failed := o.performance.failedRequests; failed != tt.wantFailed {
+				t.Errorf("got %d failed bulk requests, want %d", failed, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestTimedOutFlushIsCountedAsDropped(t *testing.T) {
+	cluster := newFakeCluster(t)
+	cluster.bulk = func(body string) (int, string) {
+		time.Sleep(200 * time.Millisecond)
+		return http.StatusOK, acceptAll(body)
+	}
+	o := newTestOutput(t, cluster, "requestTimeout=20ms,maxRetries=0")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	o.AddMetricSamples(newTestSamples(3))
+	if err := o.Flush(context.Background()); err == nil {
+		t.Error("got no error from Flush, want the samples of the timed out request to be reported")
+	}
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := o.failedRequestSamples(); n != 3 {
+		t.Errorf("got %d samples of failed requests, want 3", n)
+	}
+	if n := o.performance.failedRequests; n != 1 {
+		t.Errorf("got %d failed bulk requests, want 1", n)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	cluster := newFakeCluster(t)
+	cluster.bulk = func(body string) (int, string) {
+		items := make([]string, len(bulkItems([]byte(body))))
+		for i := range items {
+			items[i] = `{"index":{"status":400,"error":{"type":"illegal_argument_exception",` +
+				`"reason":"pipeline with id [geoip] does not exist"}}}`
+		}
+		return http.StatusOK, `{"errors":true,"items":[` + strings.Join(items, ",") + `]}`
+	}
+	o, hook := newTestOutputWithLogs(t, cluster, "pipeline=geoip")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	o.AddMetricSamples(newTestSamples(2))
+	_ = o.Flush(context.Background())
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	cluster.mu.Lock()
+	if u, _ := url.Parse(cluster.bulkURLs[0]); u.Query().Get("pipeline") != "geoip" {
+		t.Errorf("got bulk request %s, want the pipeline geoip", cluster.bulkURLs[0])
+	}
+	cluster.mu.Unlock()
+	logged := false
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.ErrorLevel && strings.Contains(entry.Message, "pipeline with id [geoip] does not exist") {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Error("the errors of the missing pipeline were not logged")
+	}
+}
+
+func TestFilterMetricsByName(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		want []string
+	}{
+		{name: "all", want: []string{"http_req_duration", "http_reqs", "vus"}},
+		{name: "include", arg: "includeMetrics={http_reqs,vus}", want: []string{"http_reqs", "vus"}},
+		{name: "exclude", arg: "excludeMetrics=vus", want: []string{"http_req_duration", "http_reqs"}},
+		{
+			// the allowlist takes precedence
+			name: "include and exclude",
+			arg:  "includeMetrics={http_reqs,vus},excludeMetrics={vus,http_req_duration}",
+			want: []string{"http_reqs", "vus"},
+		},
+	}
+	registry := metrics.NewRegistry()
+	var samples []metrics.SampleContainer
+	for _, m := range []*metrics.Metric{
+		registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time),
+		registry.MustNewMetric("http_reqs", metrics.Counter),
+		registry.MustNewMetric("vus", metrics.Gauge),
+	} {
+		samples = append(samples, metrics.Sample{
+			TimeSeries: metrics.TimeSeries{Metric: m, Tags: registry.RootTagSet()},
+			Time:       time.Now(),
+			Value:      1,
+		})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOfflineOutput(t, tt.arg)
+			o.AddMetricSamples(samples)
+			var got []string
+			for _, sample := range o.buffer.take() {
+				got = append(got, sample.Metric.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got the samples of %v buffered, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterMetricsByType(t *testing.T) {
+	tests := []struct {
+		name    string
+		arg     string
+		env     map[string]string
+		want    []string
+		wantErr string
+	}{
+		{name: "all", want: []string{"http_req_duration", "http_req_failed", "http_reqs", "vus"}},
+		{
+			name: "exclude gauges",
+			arg:  "excludeMetricTypes=gauge",
+			want: []string{"http_req_duration", "http_req_failed", "http_reqs"},
+		},
+		{name: "include", arg: "includeMetricTypes={counter,trend}", want: []string{"http_req_duration", "http_reqs"}},
+		{
+			name: "exclude from env",
+			env:  map[string]string{"K6_ELASTICSEARCH_EXCLUDE_METRIC_TYPES": "gauge,rate"},
+			want: []string{"http_req_duration", "http_reqs"},
+		},
+		{
+			// the allowlist takes precedence
+			name: "include and exclude",
+			arg:  "includeMetricTypes={counter,gauge},excludeMetricTypes=gauge",
+			want: []string{"http_reqs", "vus"},
+		},
+		{name: "unknown", arg: "excludeMetricTypes=histogram", wantErr: `unknown metric type "histogram"`},
+	}
+	registry := metrics.NewRegistry()
+	var samples []metrics.SampleContainer
+	for _, m := range []*metrics.Metric{
+		registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time),
+		registry.MustNewMetric("http_req_failed", metrics.Rate),
+		registry.MustNewMetric("http_reqs", metrics.Counter),
+		registry.MustNewMetric("vus", metrics.Gauge),
+	} {
+		samples = append(samples, metrics.Sample{
+			TimeSeries: metrics.TimeSeries{Metric: m, Tags: registry.RootTagSet()},
+			Time:       time.Now(),
+			Value:      1,
+		})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := tt.env
+			if env == nil {
+				env = map[string]string{}
+			}
+			logger, _ := test.NewNullLogger()
+			out, err := New(output.Params{Logger: logger, ConfigArgument: tt.arg, Environment: env})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			o := out.(*Output)
+			o.AddMetricSamples(samples)
+			var got []string
+			for _, sample := range o.buffer.take() {
+				got = append(got, sample.Metric.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got the samples of %v buffered, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnlyBreaches(t *testing.T) {
+	registry := metrics.NewRegistry()
+	duration := registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time)
+	reqs := registry.MustNewMetric("http_reqs", metrics.Counter)
+	samples := []metrics.SampleContainer{metrics.Samples{
+		{TimeSeries: metrics.TimeSeries{Metric: duration, Tags: registry.RootTagSet()}, Time: time.Now(), Value: 900},
+		{TimeSeries: metrics.TimeSeries{Metric: reqs, Tags: registry.RootTagSet()}, Time: time.Now(), Value: 1},
+	}}
+	// k6 evaluates the threshold periodically and records the result in it
+	threshold := &metrics.Threshold{Source: "p(95)<500"}
+
+	o := newOfflineOutput(t, "onlyBreaches=true")
+	o.SetThresholds(map[string]metrics.Thresholds{
+		"http_req_duration{status:200}": {Thresholds: []*metrics.Threshold{threshold}},
+	})
+	for i, breached := range []bool{false, true, true, false} {
+		threshold.LastFailed = breached
+		o.AddMetricSamples(samples)
+		var got []string
+		for _, sample := range o.buffer.take() {
+			got = append(got, sample.Metric.Name)
+		}
+		// the counter has no threshold that could fail
+		want := []string(nil)
+		if breached {
+			want = []string{"http_req_duration"}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d: got the samples of %v buffered while breached: %t, want %v", i, got, breached, want)
+		}
+	}
+
+	// without thresholds nothing would ever be shipped
+	cluster := newFakeCluster(t)
+	o, hook := newTestOutputWithLogs(t, cluster, "onlyBreaches=true")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	warned := false
+	for _, entry := range hook.AllEntries() {
+		warned = warned || (entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "no thresholds"))
+	}
+	if !warned {
+		t.Error("got no warning about the missing thresholds")
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	const n = 2000
+	registry := metrics.NewRegistry()
+	metricsByType := map[metrics.MetricType]*metrics.Metric{
+		metrics.Trend:   registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time),
+		metrics.Rate:    registry.MustNewMetric("http_req_failed", metrics.Rate),
+		metrics.Counter: registry.MustNewMetric("http_reqs", metrics.Counter),
+		metrics.Gauge:   registry.MustNewMetric("vus", metrics.Gauge),
+	}
+	var samples metrics.Samples
+	for _, metric := range metricsByType {
+		for i := 0; i < n; i++ {
+			samples = append(samples, metrics.Sample{
+				TimeSeries: metrics.TimeSeries{Metric: metric, Tags: registry.RootTagSet()},
+				Time:       time.Now(),
+				Value:      1,
+			})
+		}
+	}
+	for _, rate := range []float64{0, 0.1, 0.5, 1} {
+		t.Run(strconv.FormatFloat(rate, 'g', -1, 64), func(t *testing.T) {
+			o := newOfflineOutput(t, "sampleRate="+strconv.FormatFloat(rate, 'g', -1, 64))
+			o.random = rand.New(rand.NewSource(1)).Float64
+			kept := make(map[metrics.MetricType]int)
+			for _, container := range o.filterSamples([]metrics.SampleContainer{samples}) {
+				for _, sample := range container.GetSamples() {
+					kept[sample.Metric.Type]++
+				}
+			}
+			// totals and current values would be wrong without every sample of counters and gauges
+			for _, exempt := range []metrics.MetricType{metrics.Counter, metrics.Gauge} {
+				if kept[exempt] != n {
+					t.Errorf("kept %d samples of the %s, want all %d", kept[exempt], exempt, n)
+				}
+			}
+			for _, sampled := range []metrics.MetricType{metrics.Trend, metrics.Rate} {
+				if got := float64(kept[sampled]) / n; math.Abs(got-rate) > 0.03 {
+					t.Errorf("kept %.3f of the samples of the %s, want about %g", got, sampled, rate)
+				}
+			}
+		})
+	}
+}
+
+func TestStopReturnsWithinShutdownFlushTimeout(t *testing.T) {
+	cluster := newFakeCluster(t)
+	// the cluster hangs until the test has finished
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	cluster.bulk = func(body string) (int, string) {
+		<-release
+		return http.StatusOK, acceptAll(body)
+	}
+	o := newTestOutput(t, cluster, "flushPeriod=1h,shutdownFlushTimeout=100ms")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	o.AddMetricSamples(newTestSamples(3))
+	start := time.Now()
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Stop took %s despite a shutdownFlushTimeout of 100ms", d)
+	}
+	if n := o.stats.droppedFor(dropReasonShutdown); n != 3 {
+		t.Errorf("got %d samples abandoned at shutdown, want 3", n)
+	}
+}
+
+// rejectingIndexer is a bulk indexer that fails to add any item, as one does once its context is done.
+type rejectingIndexer struct {
+	esutil.BulkIndexer
+}
+
+func (rejectingIndexer) Add(context.Context, esutil.BulkIndexerItem) error {
+	return context.Canceled
+}
+
+func TestIndexDropsItemsTheIndexerRejects(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "flushPeriod=1h")
+	o.bulkIndexer = rejectingIndexer{o.bulkIndexer}
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	o.AddMetricSamples(newTestSamples(3))
+	if err := o.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := o.stats.droppedFor(dropReasonStopped); n != 3 {
+		t.Errorf("got %d samples dropped as the output stopped, want 3", n)
+	}
+	if got := cluster.bulkLines(); got != 0 {
+		t.Errorf("got %d bulk lines, want none", got)
+	}
+}
+
+func TestOpTypeAndDocumentID(t *testing.T) {
+	tests := []struct {
+		name   string
+		arg    string
+		action string
+		id     string
+	}{
+		{name: "default", action: "index"},
+		{name: "create", arg: "opType=create", action: "create"},
+		{name: "id from a tag", arg: "opType=create,documentIdField=i", action: "create", id: "x"},
+		{name: "id from a field", arg: "opType=index,documentIdField=Value", action: "index", id: "0"},
+		{name: "data stream", arg: "useDataStream=true", action: "create"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			o := newTestOutput(t, cluster, tt.arg)
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			o.AddMetricSamples(newTestSamples(1))
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			requests := cluster.bulkRequests()
+			if len(requests) != 1 {
+				t.Fatalf("got %d bulk requests, want 1", len(requests))
+			}
+			var action map[string]struct {
+				ID string `json:"_id"`
+			}
+			line, _, _ := strings.Cut(requests[0], "\n")
+			if err := json.Unmarshal([]byte(line), &action); err != nil {
+				t.Fatal(err)
+			}
+			meta, ok := action[tt.action]
+			if len(action) != 1 || !ok {
+				t.Fatalf("got action line %s, want the action %s", line, tt.action)
+			}
+			if meta.ID != tt.id {
+				t.Errorf("got _id %q, want %q", meta.ID, tt.id)
+			}
+		})
+	}
+}
+
+func TestDataStream(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "useDataStream=true,indexName=metrics-k6-default,createIndex=true")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	o.AddMetricSamples(newTestSamples(2))
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Elasticsearch creates the data stream from its index template
+	if _, ok := cluster.request(http.MethodPut, "/metrics-k6-default"); ok {
+		t.Error("the data stream was created as an index")
+	}
+	requests := cluster.bulkRequests()
+	if len(requests) != 1 {
+		t.Fatalf("got %d bulk requests, want 1", len(requests))
+	}
+	cluster.mu.Lock()
+	path, _, _ := strings.Cut(cluster.bulkURLs[0], "?")
+	cluster.mu.Unlock()
+	if path != "/metrics-k6-default/_bulk" {
+		t.Errorf("got bulk request to %s, want /metrics-k6-default/_bulk", path)
+	}
+	lines := strings.Split(strings.TrimSuffix(requests[0], "\n"), "\n")
+	for i := 0; i < len(lines); i += 2 {
+		if lines[i] != `{"create":{}}` {
+			t.Errorf("got action line %s, want create without an id", lines[i])
+		}
+		var document map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[i+1]), &document); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := document["@timestamp"]; !ok {
+			t.Errorf("got document %s, want one with @timestamp", lines[i+1])
+		}
+	}
+
+	logger, _ := test.NewNullLogger()
+	_, err := New(output.Params{
+		Logger: logger, ConfigArgument: "useDataStream=true,opType=index", Environment: map[string]string{},
+	})
+	if err == nil || !strings.Contains(err.Error(), "data streams only accept the create opType") {
+		t.Errorf("got error %v, want the index opType to be rejected", err)
+	}
+}
+
+func TestDuplicatesAreSkipped(t *testing.T) {
+	cluster := newFakeCluster(t)
+	cluster.bulk = func(body string) (int, string) {
+		return http.StatusOK, `{"errors":true,"items":[{"create":{"status":409,` +
+			`"error":{"type":"version_conflict_engine_exception","reason":"document already exists"}}}]}`
+	}
+	o := newTestOutput(t, cluster, "opType=create,documentIdField=i")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	o.AddMetricSamples(newTestSamples(1))
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := o.stats.duplicateCount(); n != 1 {
+		t.Errorf("got %d duplicates, want 1", n)
+	}
+	if n := o.stats.droppedTotal(); n != 0 {
+		t.Errorf("got %d dropped samples, want the duplicate not to count as dropped", n)
+	}
+}
+
+// eventually reports whether cond is met within timeout, checking it every 10ms.
+func eventually(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func TestFlushLoopTriggers(t *testing.T) {
+	flushed := func(o *Output, n int64) func() bool {
+		return func() bool {
+			samples, _ := o.performance.flushedAndLast()
+			return samples == n
+		}
+	}
+
+	t.Run("time", func(t *testing.T) {
+		o := newTestOutput(t, newFakeCluster(t), "flushPeriod=100ms,maxBatchSize=1000")
+		if err := o.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = o.Stop() }()
+		o.AddMetricSamples(newTestSamples(3))
+		if !eventually(2*time.Second, flushed(o, 3)) {
+			t.Error("the samples were not flushed after flushPeriod")
+		}
+	})
+
+	t.Run("size", func(t *testing.T) {
+		o := newTestOutput(t, newFakeCluster(t), "flushPeriod=1h,maxBatchSize=5")
+		if err := o.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = o.Stop() }()
+		o.AddMetricSamples(newTestSamples(4))
+		if eventually(200*time.Millisecond, flushed(o, 4)) {
+			t.Error("the samples were flushed before maxBatchSize was reached")
+		}
+		o.AddMetricSamples(newTestSamples(1))
+		if !eventually(2*time.Second, flushed(o, 5)) {
+			t.Error("the samples were not flushed once maxBatchSize was reached")
+		}
+	})
+
+	t.Run("combined", func(t *testing.T) {
+		o := newTestOutput(t, newFakeCluster(t), "flushPeriod=1s,maxBatchSize=5")
+		if err := o.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = o.Stop() }()
+		start := time.Now()
+		o.AddMetricSamples(newTestSamples(5))
+		if !eventually(500*time.Millisecond, flushed(o, 5)) {
+			t.Fatal("the samples were not flushed once maxBatchSize was reached")
+		}
+		// the period starts over after the early flush
+		o.AddMetricSamples(newTestSamples(2))
+		if !eventually(3*time.Second, flushed(o, 7)) {
+			t.Fatal("the remaining samples were not flushed after flushPeriod")
+		}
+		if d := time.Since(start); d < time.Second {
+			t.Errorf("the remaining samples were flushed after %s, before flushPeriod had passed", d)
+		}
+	})
+
+	t.Run("time trigger", func(t *testing.T) {
+		cluster := newFakeCluster(t)
+		o := newTestOutput(t, cluster, "flushTrigger=time,flushPeriod=300ms,maxBatchSize=5")
+		if err := o.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = o.Stop() }()
+		start := time.Now()
+		o.AddMetricSamples(newTestSamples(10))
+		if eventually(100*time.Millisecond, flushed(o, 10)) {
+			t.Error("the samples were flushed when maxBatchSize was reached")
+		}
+		// the bulk indexer sends them at the same interval
+		if !eventually(2*time.Second, func() bool { return cluster.bulkLines() == 20 }) {
+			t.Fatal("the samples were not sent after flushPeriod")
+		}
+		if d := time.Since(start); d < 300*time.Millisecond {
+			t.Errorf("the samples were sent after %s, before flushPeriod had passed", d)
+		}
+	})
+
+	t.Run("count trigger", func(t *testing.T) {
+		o := newTestOutput(t, newFakeCluster(t), "flushTrigger=count,flushPeriod=100ms,maxBatchSize=5")
+		if err := o.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = o.Stop() }()
+		o.AddMetricSamples(newTestSamples(4))
+		if eventually(300*time.Millisecond, flushed(o, 4)) {
+			t.Error("the samples were flushed after flushPeriod")
+		}
+		o.AddMetricSamples(newTestSamples(1))
+		if !eventually(2*time.Second, flushed(o, 5)) {
+			t.Error("the samples were not flushed once maxBatchSize was reached")
+		}
+	})
+
+	t.Run("bytes trigger", func(t *testing.T) {
+		cluster := newFakeCluster(t)
+		o := newTestOutput(t, cluster, "flushTrigger=bytes,flushPeriod=100ms,maxBatchBytes=3000,concurrency=1")
+		if err := o.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = o.Stop() }()
+		o.AddMetricSamples(newTestSamples(2))
+		if !eventually(2*time.Second, flushed(o, 2)) {
+			t.Fatal("the samples were not flushed to the bulk indexer after flushPeriod")
+		}
+		time.Sleep(200 * time.Millisecond)
+		if n := len(cluster.bulkRequests()); n != 0 {
+			t.Errorf("got %d bulk requests before maxBatchBytes was reached, want none", n)
+		}
+		o.AddMetricSamples(newTestSamples(50))
+		if !eventually(2*time.Second, func() bool { return len(cluster.bulkRequests()) > 0 }) {
+			t.Error("no bulk request was sent once maxBatchBytes was reached")
+		}
+	})
+}
+
+func TestFlushTriggerSettings(t *testing.T) {
+	tests := []struct {
+		trigger           string
+		wantLoopPeriod    time.Duration
+		wantCountTriggers bool
+		wantBulkInterval  time.Duration
+	}{
+		{
+			trigger:           flushTriggerAny,
+			wantLoopPeriod:    2 * time.Second,
+			wantCountTriggers: true,
+			wantBulkInterval:  maxFlushDelay,
+		},
+		{trigger: flushTriggerTime, wantLoopPeriod: 2 * time.Second, wantBulkInterval: 2 * time.Second},
+		{
+			trigger:           flushTriggerCount,
+			wantLoopPeriod:    maxFlushDelay,
+			wantCountTriggers: true,
+			wantBulkInterval:  maxFlushDelay,
+		},
+		{trigger: flushTriggerBytes, wantLoopPeriod: 2 * time.Second, wantBulkInterval: maxFlushDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.trigger, func(t *testing.T) {
+			c := NewConfig()
+			c.FlushTrigger = null.StringFrom(tt.trigger)
+			c.FlushPeriod = types.NullDurationFrom(2 * time.Second)
+			if err := c.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if got := flushLoopPeriod(c); got != tt.wantLoopPeriod {
+				t.Errorf("got flush loop period %s, want %s", got, tt.wantLoopPeriod)
+			}
+			if got := countTriggers(c); got != tt.wantCountTriggers {
+				t.Errorf("got count triggers %t, want %t", got, tt.wantCountTriggers)
+			}
+			if got := bulkFlushInterval(c); got != tt.wantBulkInterval {
+				t.Errorf("got bulk flush interval %s, want %s", got, tt.wantBulkInterval)
+			}
+		})
+	}
+}
+
+// bulkActions returns the metadata of the action lines of a bulk request body by action.
+func bulkActions(t *testing.T, body string) []map[string]map[string]interface{} {
+	t.Helper()
+	var actions []map[string]map[string]interface{}
+	for i, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if i%2 != 0 {
+			continue
+		}
+		var action map[string]map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &action); err != nil {
+			t.Fatalf("invalid action line %s: %v", line, err)
+		}
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+// bulkDocuments returns the documents of all bulk requests the cluster received so far.
+func bulkDocuments(t *testing.T, cluster *fakeCluster) []map[string]interface{} {
+	t.Helper()
+	var documents []map[string]interface{}
+	for _, body := range cluster.bulkRequests() {
+		for i, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+			if i%2 == 0 {
+				continue
+			}
+			var document map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &document); err != nil {
+				t.Fatalf("invalid document %s: %v", line, err)
+			}
+			documents = append(documents, document)
+		}
+	}
+	return documents
+}
+
+func TestRoutingField(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "routingField=test_run,concurrency=1")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	samples := newTestSamples(2)
+	routed := samples[0].(metrics.Sample)
+	routed.Tags = routed.Tags.With("test_run", "run-1")
+	samples[0] = routed
+	o.AddMetricSamples(samples)
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	actions := bulkActions(t, strings.Join(cluster.bulkRequests(), ""))
+	if len(actions) != 2 {
+		t.Fatalf("got %d actions, want 2", len(actions))
+	}
+	if got := actions[0]["index"]["routing"]; got != "run-1" {
+		t.Errorf("got routing %v, want the value of the tag", got)
+	}
+	if got, ok := actions[1]["index"]["routing"]; ok {
+		t.Errorf("got routing %v for a sample without the tag, want none", got)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	cluster := newFakeCluster(t)
+	file := filepath.Join(t.TempDir(), "dry-run.ndjson")
+	o := newTestOutput(t, cluster, "dryRun=true,dryRunFile="+file+",testRunId=run-1,concurrency=1")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	samples := newTestSamples(2)
+	for i := range samples {
+		sample := samples[i].(metrics.Sample)
+		sample.Time = time.UnixMilli(1709296496123)
+		samples[i] = sample
+	}
+	o.AddMetricSamples(samples)
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	cluster.mu.Lock()
+	if len(cluster.requests) != 0 || len(cluster.bulkBodies) != 0 {
+		t.Errorf("got %d requests and %d bulk requests in a dry run, want none",
+			len(cluster.requests), len(cluster.bulkBodies))
+	}
+	cluster.mu.Unlock()
+	got, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"index":{}}` + "\n" +
+		`{"MetricName":"test_counter","MetricType":"counter","Value":0,"Tags":{"i":"x"},"Time":1709296496123,` +
+		`"test_run_id":"run-1"}` + "\n" +
+		`{"index":{}}` + "\n" +
+		`{"MetricName":"test_counter","MetricType":"counter","Value":1,"Tags":{"i":"x"},"Time":1709296496123,` +
+		`"test_run_id":"run-1"}` + "\n"
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestStartVerifiesConnection(t *testing.T) {
+	tests := []struct {
+		name       string
+		arg        string
+		info       int
+		privileges int
+		wantErr    string
+	}{
+		{name: "ok", info: http.StatusOK},
+		{name: "unauthorized", info: http.StatusUnauthorized, wantErr: "(status code 401), the credentials were rejected"},
+		{name: "no monitor privilege", info: http.StatusForbidden, privileges: http.StatusOK},
+		{
+			name:       "no index privileges",
+			info:       http.StatusForbidden,
+			privileges: http.StatusForbidden,
+			wantErr:    "(status code 403), the user lacks privileges",
+		},
+		{name: "unavailable", arg: "startupRetries=0", info: http.StatusServiceUnavailable, wantErr: "status code 503"},
+		{name: "disabled", arg: "verifyConnection=false", info: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			cluster.respond = func(req fakeRequest) (int, string) {
+				switch req.path {
+				case "/":
+					return tt.info, `{}`
+				case "/_security/user/_has_privileges":
+					return tt.privileges, `{}`
+				}
+				return http.StatusOK, `{}`
+			}
+			o := newTestOutput(t, cluster, "maxRetries=0,"+tt.arg)
+			err := o.Start()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = o.Stop()
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStartFailsForUnreachableCluster(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "maxRetries=0,startupRetries=0")
+	cluster.Close()
+	if err := o.Start(); err == nil || !strings.Contains(err.Error(), "check url or cloud-id") {
+		t.Errorf("got error %v, want a hint at the url", err)
+	}
+}
+
+func TestStartupRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		retries   int
+		failures  []int
+		wantPings int
+		wantErr   string
+	}{
+		{
+			name:      "recovers",
+			retries:   3,
+			failures:  []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			wantPings: 3,
+		},
+		{
+			name:      "too few retries",
+			retries:   1,
+			failures:  []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			wantPings: 2,
+			wantErr:   "status code 503",
+		},
+		{
+			name:      "not transient",
+			retries:   3,
+			failures:  []int{http.StatusUnauthorized},
+			wantPings: 1,
+			wantErr:   "status code 401",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			pings := 0
+			cluster.respond = func(req fakeRequest) (int, string) {
+				if req.path != "/" {
+					return http.StatusOK, `{}`
+				}
+				pings++
+				if pings <= len(tt.failures) {
+					return tt.failures[pings-1], `{}`
+				}
+				return http.StatusOK, `{}`
+			}
+			o, hook := newTestOutputWithLogs(t, cluster,
+				fmt.Sprintf("maxRetries=0,startupRetries=%d,startupRetryDelay=10ms", tt.retries))
+			err := o.Start()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = o.Stop()
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+
+			cluster.mu.Lock()
+			defer cluster.mu.Unlock()
+			if pings != tt.wantPings {
+				t.Errorf("got %d pings, want %d", pings, tt.wantPings)
+			}
+			retries := 0
+			for _, entry := range hook.AllEntries() {
+				if strings.Contains(entry.Message, "retrying in 10ms") {
+					retries++
+				}
+			}
+			if retries != tt.wantPings-1 {
+				t.Errorf("got %d retries logged, want %d", retries, tt.wantPings-1)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	backoff := retryBackoff(100*time.Millisecond, false)
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		if got := backoff(attempt + 1); got != want {
+			t.Errorf("attempt %d: got backoff %s, want %s", attempt+1, got, want)
+		}
+	}
+
+	backoff = retryBackoff(100*time.Millisecond, true)
+	durations := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		for attempt := 1; attempt <= 3; attempt++ {
+			d := backoff(attempt)
+			if limit := 100 * time.Millisecond * time.Duration(1<<(attempt-1)); d < 0 || d > limit {
+				t.Fatalf("attempt %d: got backoff %s, want at most %s", attempt, d, limit)
+			}
+			durations[d] = true
+		}
+	}
+	if len(durations) < 2 {
+		t.Errorf("got %d distinct backoffs in 60 retries, want them to differ", len(durations))
+	}
+}
+
+func TestURLWithBasePath(t *testing.T) {
+	for _, basePath := range []string{"/es", "/es/"} {
+		t.Run(basePath, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			logger, _ := test.NewNullLogger()
+			out, err := New(output.Params{
+				Logger:         logger,
+				ConfigArgument: "url=" + cluster.URL + basePath + ",index=k6-metrics,maxRetries=0,startupRetries=0",
+				Environment:    map[string]string{},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			o := out.(*Output)
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			o.AddMetricSamples(newTestSamples(3))
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok := cluster.request(http.MethodGet, "/es/"); !ok {
+				t.Error("the connection was not verified below the base path")
+			}
+			cluster.mu.Lock()
+			defer cluster.mu.Unlock()
+			if len(cluster.bulkURLs) == 0 {
+				t.Fatal("got no bulk requests")
+			}
+			for _, u := range cluster.bulkURLs {
+				if path := strings.SplitN(u, "?", 2)[0]; path != "/es/k6-metrics/_bulk" {
+					t.Errorf("got bulk request to %s, want /es/k6-metrics/_bulk", path)
+				}
+			}
+		})
+	}
+}
+
+func TestFailoverToFallbackCluster(t *testing.T) {
+	primary, fallback := newFakeCluster(t), newFakeCluster(t)
+	primary.bulk = func(body string) (int, string) {
+		return http.StatusServiceUnavailable, `{"error":"unavailable"}`
+	}
+	o, hook := newTestOutputWithLogs(t, primary,
+		"fallbackUrl="+fallback.URL+",failoverAfter=2,maxRetries=0,flushPeriod=1h,concurrency=1")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		o.AddMetricSamples(newTestSamples(5))
+		err := o.Flush(context.Background())
+		if i <= 2 && err == nil {
+			t.Errorf("flush %d: got no error although the primary cluster is unavailable", i)
+		}
+		if i == 3 && err != nil {
+			t.Errorf("flush %d: %v", i, err)
+		}
+	}
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(primary.bulkRequests()); n != 2 {
+		t.Errorf("got %d bulk requests to the primary cluster, want 2", n)
+	}
+	if got := fallback.bulkLines(); got != 10 {
+		t.Errorf("got %d bulk lines on the fallback cluster, want the 10 of the third batch", got)
+	}
+	switched := false
+	for _, entry := range hook.AllEntries() {
+		switched = switched || strings.Contains(entry.Message, "switching to the fallback cluster")
+	}
+	if !switched {
+		t.Error("the switch to the fallback cluster was not logged")
+	}
+}
+
+func TestCompressRequestBody(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(strconv.FormatBool(compress), func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			o := newTestOutput(t, cluster, "concurrency=1,compressRequestBody="+strconv.FormatBool(compress))
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			o.AddMetricSamples(newTestSamples(10))
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			requests := cluster.bulkRequests()
+			if len(requests) != 1 {
+				t.Fatalf("got %d bulk requests, want 1", len(requests))
+			}
+			cluster.mu.Lock()
+			encoding := cluster.bulkHeaders[0].Get("Content-Encoding")
+			cluster.mu.Unlock()
+			body := requests[0]
+			if compress {
+				if encoding != "gzip" {
+					t.Fatalf("got Content-Encoding %q, want gzip", encoding)
+				}
+				zr, err := gzip.NewReader(strings.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(data) <= len(body) {
+					t.Errorf("got %d compressed bytes for a body of %d bytes", len(body), len(data))
+				}
+				body = string(data)
+			} else if encoding != "" {
+				t.Errorf("got Content-Encoding %q, want none", encoding)
+			}
+			if n := strings.Count(body, "\n"); n != 20 {
+				t.Errorf("got %d lines in the bulk request, want 20", n)
+			}
+		})
+	}
+}
+
+func TestCompressionLevelIsApplied(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "compressRequestBody=true,compressionLevel=9,concurrency=1")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	o.AddMetricSamples(newTestSamples(10))
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := cluster.bulkRequests()
+	if len(requests) == 0 {
+		t.Fatal("got no bulk requests")
+	}
+	for _, header := range cluster.bulkHeaders {
+		if encoding := header.Get("Content-Encoding"); encoding != "gzip" {
+			t.Errorf("got Content-Encoding %q, want gzip", encoding)
+		}
+	}
+	// the extra flags of the gzip header are 2 for the best compression
+	for _, body := range requests {
+		if len(body) < 10 || body[8] != 2 {
+			t.Errorf("the bulk request was not compressed at level 9")
+		}
+	}
+}
+
+func TestFlushSendsBufferedSamples(t *testing.T) {
+	cluster := newFakeCluster(t)
+	// neither the flush loop nor the bulk indexer would send the samples on their own during the test
+	o := newTestOutput(t, cluster, "flushPeriod=1h,maxBatchSize=1000")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{3, 2} {
+		before := cluster.bulkLines()
+		o.AddMetricSamples(newTestSamples(n))
+		if err := o.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := cluster.bulkLines() - before; got != 2*n {
+			t.Errorf("got %d bulk lines when Flush returned, want %d", got, 2*n)
+		}
+	}
+	// the output keeps working after Flush
+	o.AddMetricSamples(newTestSamples(1))
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cluster.bulkLines(); got != 12 {
+		t.Errorf("got %d bulk lines after Stop, want 12", got)
+	}
+	if err := o.Flush(context.Background()); err == nil || !strings.Contains(err.Error(), "stopped") {
+		t.Errorf("got error %v after Stop, want one that the output has been stopped", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cluster := newFakeCluster(t)
+	healthy := false
+	cluster.bulk = func(body string) (int, string) {
+		if !healthy {
+			return http.StatusServiceUnavailable, `{"error":"unavailable"}`
+		}
+		return http.StatusOK, acceptAll(body)
+	}
+	o, hook := newTestOutputWithLogs(t, cluster,
+		"circuitBreakerAfter=2,circuitBreakerCooldown=300ms,maxRetries=0,flushPeriod=1h,concurrency=1")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = o.Stop() }()
+	for i := 0; i < 2; i++ {
+		o.AddMetricSamples(newTestSamples(1))
+		if err := o.Flush(context.Background()); err == nil {
+			t.Fatalf("flush %d: got no error although the cluster is unavailable", i+1)
+		}
+	}
+	if n := len(cluster.bulkRequests()); n != 2 {
+		t.Fatalf("got %d bulk requests, want 2 before the breaker opens", n)
+	}
+
+	// nothing is sent during the cooldown, the samples stay buffered
+	cluster.mu.Lock()
+	healthy = true
+	cluster.mu.Unlock()
+	opened := time.Now()
+	o.AddMetricSamples(newTestSamples(3))
+	o.flush()
+	if err := o.Flush(context.Background()); err == nil || !strings.Contains(err.Error(), "circuit breaker is open") {
+		t.Errorf("got error %v during the cooldown, want the open breaker", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	o.flush()
+	if time.Since(opened) < 300*time.Millisecond {
+		if n := len(cluster.bulkRequests()); n != 2 {
+			t.Errorf("got %d bulk requests during the cooldown, want none after the first 2", n-2)
+		}
+		if n := o.buffer.len(); n != 3 {
+			t.Errorf("got %d buffered samples during the cooldown, want 3", n)
+		}
+	}
+
+	// the test flush after the cooldown closes the breaker again
+	time.Sleep(300 * time.Millisecond)
+	if err := o.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := cluster.bulkLines(); got != 2*2+2*3 {
+		t.Errorf("got %d bulk lines, want the 3 buffered samples to be sent after the cooldown", got)
+	}
+	var states []string
+	for _, entry := range hook.AllEntries() {
+		for _, state := range []string{breakerOpen, breakerHalfOpen, breakerClosed} {
+			if strings.Contains(entry.Message, "circuit breaker "+state+" ") ||
+				strings.Contains(entry.Message, "circuit breaker "+state+",") {
+				states = append(states, state)
+			}
+		}
+	}
+	if got := strings.Join(states, ","); got != "open,half-open,closed" {
+		t.Errorf("got the breaker states %s logged, want open,half-open,closed", got)
+	}
+}
+
+func TestBulkParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		arg     string
+		env     string
+		want    url.Values
+		wantErr string
+	}{
+		{
+			name: "arg",
+			arg:  "bulkParams.require_alias=false,bulkParams.timeout=30s,pipeline=k6",
+			want: url.Values{"require_alias": {"false"}, "timeout": {"30s"}, "pipeline": {"k6"}},
+		},
+		{
+			name: "env",
+			env:  `{"routing":"user 1&2","list_executed_pipelines":"true"}`,
+			want: url.Values{"routing": {"user 1&2"}, "list_executed_pipelines": {"true"}},
+		},
+		{name: "reserved", arg: "bulkParams.pipeline=other", wantErr: "use pipeline instead"},
+		{name: "response filter", arg: "bulkParams.filter_path=items", wantErr: "the output needs the whole response"},
+		{name: "invalid name", env: `{"a=b":"c"}`, wantErr: `invalid parameter name "a=b"`},
+		{name: "control characters", env: `{"routing":"a\nb"}`, wantErr: "contains control characters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			env := map[string]string{}
+			if tt.env != "" {
+				env["K6_ELASTICSEARCH_BULK_PARAMS"] = tt.env
+			}
+			logger, _ := test.NewNullLogger()
+			arg := "url=" + cluster.URL
+			if tt.arg != "" {
+				arg += "," + tt.arg
+			}
+			out, err := New(output.Params{Logger: logger, ConfigArgument: arg, Environment: env})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			o := out.(*Output)
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			o.AddMetricSamples(newTestSamples(1))
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			cluster.mu.Lock()
+			defer cluster.mu.Unlock()
+			if len(cluster.bulkURLs) == 0 {
+				t.Fatal("got no bulk requests")
+			}
+			u, err := url.Parse(cluster.bulkURLs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := u.Query()
+			for name, want := range tt.want {
+				if got := query[name]; !reflect.DeepEqual(got, want) {
+					t.Errorf("got %s=%v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWaitForActiveShards(t *testing.T) {
+	tests := []struct {
+		name    string
+		arg     string
+		env     string
+		want    []string
+		wantErr string
+	}{
+		{name: "default"},
+		{name: "number", arg: "waitForActiveShards=1", want: []string{"1"}},
+		{name: "all", arg: "waitForActiveShards=all", want: []string{"all"}},
+		{name: "env", env: "2", want: []string{"2"}},
+		{name: "zero", arg: "waitForActiveShards=0", wantErr: "must be all or a positive number"},
+		{name: "invalid", env: "some", wantErr: "must be all or a positive number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			env := map[string]string{}
+			if tt.env != "" {
+				env["K6_ELASTICSEARCH_WAIT_FOR_ACTIVE_SHARDS"] = tt.env
+			}
+			logger, _ := test.NewNullLogger()
+			arg := "url=" + cluster.URL
+			if tt.arg != "" {
+				arg += "," + tt.arg
+			}
+			out, err := New(output.Params{Logger: logger, ConfigArgument: arg, Environment: env})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			o := out.(*Output)
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			o.AddMetricSamples(newTestSamples(1))
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			cluster.mu.Lock()
+			defer cluster.mu.Unlock()
+			if len(cluster.bulkURLs) == 0 {
+				t.Fatal("got no bulk requests")
+			}
+			u, err := url.Parse(cluster.bulkURLs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			// without the parameter, Elasticsearch waits for the primary shard only
+			if got := u.Query()["wait_for_active_shards"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got wait_for_active_shards %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	tests := []struct {
+		name        string
+		arg         string
+		env         string
+		want        []string
+		wantWarning bool
+		wantErr     string
+	}{
+		{name: "default"},
+		{name: "true", arg: "refresh=true", want: []string{"true"}, wantWarning: true},
+		{name: "false", arg: "refresh=false", want: []string{"false"}},
+		{name: "wait_for", arg: "refresh=wait_for", want: []string{"wait_for"}, wantWarning: true},
+		{name: "env", env: "wait_for", want: []string{"wait_for"}, wantWarning: true},
+		{name: "invalid", arg: "refresh=now", wantErr: "refresh must be true, false or wait_for"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			env := map[string]string{}
+			if tt.env != "" {
+				env["K6_ELASTICSEARCH_REFRESH"] = tt.env
+			}
+			logger, hook := test.NewNullLogger()
+			arg := "url=" + cluster.URL
+			if tt.arg != "" {
+				arg += "," + tt.arg
+			}
+			out, err := New(output.Params{Logger: logger, ConfigArgument: arg, Environment: env})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			o := out.(*Output)
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			o.AddMetricSamples(newTestSamples(1))
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			warned := false
+			for _, entry := range hook.AllEntries() {
+				warned = warned || (entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "refresh="))
+			}
+			if warned != tt.wantWarning {
+				t.Errorf("got a warning about the throughput: %t, want one: %t", warned, tt.wantWarning)
+			}
+			cluster.mu.Lock()
+			defer cluster.mu.Unlock()
+			if len(cluster.bulkURLs) == 0 {
+				t.Fatal("got no bulk requests")
+			}
+			u, err := url.Parse(cluster.bulkURLs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.Query()["refresh"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got refresh %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummaryOnly(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "summaryOnly=true,flushPeriod=1h")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	registry := metrics.NewRegistry()
+	duration := registry.MustNewMetric("http_req_duration", metrics.Trend, metrics.Time)
+	for _, value := range []float64{100, 200, 600} {
+		o.AddMetricSamples([]metrics.SampleContainer{metrics.Sample{
+			TimeSeries: metrics.TimeSeries{Metric: duration, Tags: registry.RootTagSet().With("name", "login")},
+			Time:       time.Now(),
+			Value:      value,
+		}})
+	}
+	// the counter has the values 0 to 9
+	o.AddMetricSamples(newTestSamples(10))
+	o.flush()
+	if err := o.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cluster.bulkRequests()); n != 0 {
+		t.Fatalf("got %d bulk requests during the test, want none", n)
+	}
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	documents := bulkDocuments(t, cluster)
+	if len(documents) != 2 {
+		t.Fatalf("got %d documents, want one summary per metric", len(documents))
+	}
+	tests := []struct {
+		metric  string
+		value   float64
+		summary map[string]float64
+	}{
+		{metric: "http_req_duration", value: 300, summary: map[string]float64{"count": 3, "min": 100, "max": 600}},
+		{metric: "test_counter", value: 45, summary: map[string]float64{"count": 45}},
+	}
+	for i, tt := range tests {
+		document := documents[i]
+		if document["MetricName"] != tt.metric || document["Value"] != tt.value {
+			t.Errorf("got %v %v, want the summary of %s with %g", document["MetricName"], document["Value"], tt.metric,
+				tt.value)
+		}
+		summary, ok := document["Summary"].(map[string]interface{})
+		if !ok {
+			t.Errorf("got the summary %v of %s, want an object", document["Summary"], tt.metric)
+			continue
+		}
+		for name, want := range tt.summary {
+			if summary[name] != want {
+				t.Errorf("got the %s %v of %s, want %g", name, summary[name], tt.metric, want)
+			}
+		}
+	}
+}
+
+func TestMarkers(t *testing.T) {
+	tests := []struct {
+		name      string
+		arg       string
+		wantIndex string
+	}{
+		{name: "index", arg: "indexName=k6-load-tests", wantIndex: "k6-load-tests"},
+		{name: "marker index", arg: "markerIndex=k6-markers", wantIndex: "k6-markers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			logger, _ := test.NewNullLogger()
+			out, err := New(output.Params{
+				Logger:         logger,
+				ConfigArgument: "url=" + cluster.URL + ",testRunId=run-1," + tt.arg,
+				Environment:    map[string]string{},
+				ScriptPath:     &url.URL{Path: "/scripts/login.js"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			o := out.(*Output)
+			// markers returns the event types of the markers indexed so far
+			markers := func() []string {
+				cluster.mu.Lock()
+				defer cluster.mu.Unlock()
+				var eventTypes []string
+				for _, req := range cluster.requests {
+					if req.method != http.MethodPost || req.path != "/"+tt.wantIndex+"/_doc" {
+						continue
+					}
+					var marker map[string]interface{}
+					if err := json.Unmarshal([]byte(req.body), &marker); err != nil {
+						t.Fatalf("invalid marker %s: %v", req.body, err)
+					}
+					if marker["test_run_id"] != "run-1" || marker["test_name"] != "login.js" {
+						t.Errorf("got marker %s, want the test run run-1 of login.js", req.body)
+					}
+					if _, ok := marker["Time"].(float64); !ok {
+						t.Errorf("got marker %s, want its time", req.body)
+					}
+					eventTypes = append(eventTypes, marker["event_type"].(string))
+				}
+				return eventTypes
+			}
+
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			// the markers are indexed synchronously
+			if got := markers(); !reflect.DeepEqual(got, []string{markerTestStart}) {
+				t.Errorf("got markers %v after Start, want %s", got, markerTestStart)
+			}
+			o.AddMetricSamples(newTestSamples(1))
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+			if got := markers(); !reflect.DeepEqual(got, []string{markerTestStart, markerTestEnd}) {
+				t.Errorf("got markers %v after Stop, want %s and %s", got, markerTestStart, markerTestEnd)
+			}
+		})
+	}
+}
+
+func TestNodeDiscovery(t *testing.T) {
+	tests := []struct {
+		name      string
+		arg       string
+		env       map[string]string
+		wantNodes bool
+		wantErr   string
+	}{
+		{name: "disabled"},
+		{name: "on start", arg: "discoverNodesOnStart=true", wantNodes: true},
+		{name: "interval", env: map[string]string{"K6_ELASTICSEARCH_DISCOVER_INTERVAL": "50ms"}, wantNodes: true},
+		{name: "env", env: map[string]string{"K6_ELASTICSEARCH_DISCOVER_NODES": "true"}, wantNodes: true},
+		{
+			name:    "serverless",
+			arg:     "discoverNodesOnStart=true,serverless=true,apiKey=c2VjcmV0",
+			wantErr: "node discovery cannot be used with serverless projects or a cloud-id",
+		},
+		{
+			name:    "negative interval",
+			arg:     "discoverNodesInterval=-1s",
+			wantErr: "discoverNodesInterval must not be negative",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			// the cluster consists of a single node, which is reachable at the same address
+			cluster.respond = func(req fakeRequest) (int, string) {
+				if req.path != "/_nodes/http" {
+					return http.StatusOK, `{}`
+				}
+				return http.StatusOK, `{"nodes":{"node-1":{"roles":["data","ingest"],` +
+					`"http":{"publish_address":"` + strings.TrimPrefix(cluster.URL, "http://") + `"}}}}`
+			}
+			env := tt.env
+			if env == nil {
+				env = map[string]string{}
+			}
+			logger, _ := test.NewNullLogger()
+			out, err := New(output.Params{
+				Logger:         logger,
+				ConfigArgument: "url=" + cluster.URL + "," + tt.arg,
+				Environment:    env,
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			o := out.(*Output)
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			// the client discovers the nodes in the background, shortly after Start
+			timeout := time.Second
+			if !tt.wantNodes {
+				timeout = 200 * time.Millisecond
+			}
+			discovered := eventually(timeout, func() bool {
+				_, ok := cluster.request(http.MethodGet, "/_nodes/http")
+				return ok
+			})
+			o.AddMetricSamples(newTestSamples(1))
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			if discovered != tt.wantNodes {
+				t.Errorf("got the nodes discovered: %t, want them discovered: %t", discovered, tt.wantNodes)
+			}
+			// the samples are sent to the discovered node
+			if n := cluster.bulkLines(); n != 2 {
+				t.Errorf("got %d bulk lines, want 2", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// failover switches all requests to the fallback cluster once failoverAfter flushes in a row have failed. The
+// bulk indexer cannot change its client, so the switch happens in failoverTransport below the client.
+type failover struct {
+	after    int64
+	fallback *url.URL
+	// the path prefix of every primary node by host, which is replaced by the path of the fallback
+	primaryPaths map[string]string
+	logger       logrus.FieldLogger
+
+	// the number of flushes that have failed in a row
+	failures int64
+	// set once the fallback is used
+	active int32
+	// set when the fallback has become active until the indices have been set up there
+	switched int32
+}
+
+func newFailover(config Config, logger logrus.FieldLogger) (*failover, error) {
+	fallback, err := fallbackURL(config)
+	if err != nil {
+		return nil, err
+	}
+	f := &failover{
+		after:        config.FailoverAfter.Int64,
+		fallback:     fallback,
+		primaryPaths: make(map[string]string),
+		logger:       logger,
+	}
+	if !config.CloudID.Valid {
+		for _, address := range splitList(config.Url.String) {
+			if u, err := url.Parse(address); err == nil {
+				f.primaryPaths[u.Host] = strings.TrimSuffix(u.Path, "/")
+			}
+		}
+	}
+	return f, nil
+}
+
+// flushFinished is used in OnFlushEnd of the bulk indexer. It counts the failed flushes and switches to the
+// fallback once there are enough of them in a row.
+func (f *failover) flushFinished(ctx context.Context) {
+	sent, failed := flushOutcome(ctx)
+	if !sent {
+		return
+	}
+	if !failed {
+		atomic.StoreInt64(&f.failures, 0)
+		return
+	}
+	failures := atomic.AddInt64(&f.failures, 1)
+	if failures >= f.after && atomic.CompareAndSwapInt32(&f.active, 0, 1) {
+		f.logger.Warnf("Elasticsearch: %d flushes in a row failed, switching to the fallback cluster at %s",
+			failures, redactURL(f.fallback.String()))
+		atomic.StoreInt32(&f.switched, 1)
+	}
+}
+
+// takeSwitch reports whether the fallback has become active since the last call.
+func (f *failover) takeSwitch() bool {
+	return atomic.CompareAndSwapInt32(&f.switched, 1, 0)
+}
+
+// failoverTransport sends all requests to the fallback cluster once it is active.
+type failoverTransport struct {
+	next     http.RoundTripper
+	failover *failover
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt32(&t.failover.active) == 1 {
+		fallback := t.failover.fallback
+		path := strings.TrimPrefix(req.URL.Path, t.failover.primaryPaths[req.URL.Host])
+		req = req.Clone(req.Context())
+		req.URL.Scheme = fallback.Scheme
+		req.URL.Host = fallback.Host
+		req.URL.Path = strings.TrimSuffix(fallback.Path, "/") + path
+		req.URL.RawPath = ""
+		req.Host = ""
+		if fallback.User != nil {
+			password, _ := fallback.User.Password()
+			req.SetBasicAuth(fallback.User.Username(), password)
+		}
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,171 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// rotatingFile writes to path and moves it aside to path.1, path.2 and so on before it would exceed maxBytes. Each
+// write goes to a single file, so that bulk requests are never split across files.
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// the number of files moved aside
+	rotated int
+}
+
+func openRotatingFile(path string, maxBytes int64) (*rotatingFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &rotatingFile{path: path, maxBytes: maxBytes, file: file}, nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.rotated++
+	if err := os.Rename(f.path, fmt.Sprintf("%s.%d", f.path, f.rotated)); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	f.file, f.size = file, 0
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// fileOutputTransport writes the bodies of accepted bulk requests to fileOutput, e.g. to ship them later. Only
+// accepted requests are written, since the client sends failed requests again. Every action line carries its index,
+// so that the file can be sent to /_bulk as it is.
+type fileOutputTransport struct {
+	next http.RoundTripper
+	out  io.Writer
+	// the index in the path of bulk requests, empty if there is none
+	index  string
+	logger logrus.FieldLogger
+}
+
+func (t *fileOutputTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.GetBody == nil || !strings.HasSuffix(req.URL.Path, "/_bulk") {
+		return t.next.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.next.RoundTrip(withBody(req, body))
+	if err != nil || res.StatusCode >= 300 {
+		return res, err
+	}
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body, err = io.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	}
+	if t.index != "" && strings.HasSuffix(req.URL.Path, "/"+t.index+"/_bulk") {
+		if body, err = withItemIndex(body, t.index); err != nil {
+			t.logger.Errorf("Elasticsearch: could not write to fileOutput: %s", err)
+			return res, nil
+		}
+	}
+	// the documents have been indexed already, so the request must not fail and be sent again
+	if _, err := t.out.Write(body); err != nil {
+		t.logger.Errorf("Elasticsearch: could not write to fileOutput: %s", err)
+	}
+	return res, nil
+}
+
+// withItemIndex sets _index in the action lines of a bulk body that have none to the index of the request.
+func withItemIndex(body []byte, index string) ([]byte, error) {
+	name, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	for _, item := range bulkItems(body) {
+		lines := bytes.SplitAfterN(item, []byte("\n"), 2)
+		var action map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(lines[0], &action); err != nil {
+			return nil, fmt.Errorf("invalid action line in bulk request: %w", err)
+		}
+		for _, meta := range action {
+			if _, ok := meta["_index"]; !ok {
+				meta["_index"] = name
+			}
+		}
+		line, err := json.Marshal(action)
+		if err != nil {
+			return nil, err
+		}
+		out = append(append(out, line...), '\n')
+		if len(lines) > 1 {
+			out = append(out, lines[1]...)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,150 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// roundTripFunc stubs the next transport of the transport under test.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// newBulkRequest returns a bulk request with the given body as sent by the client.
+func newBulkRequest(t *testing.T, path, body string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:9200"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func respondWith(status int) roundTripFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(`{"errors":false,"items":[]}`)),
+			Request:    req,
+		}, nil
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.ndjson")
+	f, err := openRotatingFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddddddddddd\n"} {
+		if _, err := f.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a write is never split, even if it is larger than maxBytes on its own
+	want := map[string]string{
+		path + ".1": "aaaa\nbbbb\n",
+		path + ".2": "cccc\n",
+		path:        "dddddddddddd\n",
+	}
+	for name, content := range want {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("%s: got %q, want %q", filepath.Base(name), got, content)
+		}
+	}
+}
+
+func TestFileOutputTransport(t *testing.T) {
+	body := `{"index":{}}` + "\n" + `{"Value":1}` + "\n" +
+		`{"create":{"_index":"other","_id":"x"}}` + "\n" + `{"Value":2}` + "\n"
+
+	tests := []struct {
+		name   string
+		path   string
+		index  string
+		status int
+		want   string
+	}{
+		{
+			name:   "index in path",
+			path:   "/k6-metrics/_bulk",
+			index:  "k6-metrics",
+			status: http.StatusOK,
+			want: `{"index":{"_index":"k6-metrics"}}` + "\n" + `{"Value":1}` + "\n" +
+				`{"create":{"_id":"x","_index":"other"}}` + "\n" + `{"Value":2}` + "\n",
+		},
+		{
+			name:   "no index in path",
+			path:   "/_bulk",
+			status: http.StatusOK,
+			want:   body,
+		},
+		{
+			name:   "rejected request",
+			path:   "/k6-metrics/_bulk",
+			index:  "k6-metrics",
+			status: http.StatusTooManyRequests,
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			logger, _ := test.NewNullLogger()
+			transport := &fileOutputTransport{next: respondWith(tt.status), out: &out, index: tt.index, logger: logger}
+			req := newBulkRequest(t, tt.path, body)
+			res, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", res.StatusCode, tt.status)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
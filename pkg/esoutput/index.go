@@ -0,0 +1,273 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// dateTokens maps the supported date pattern tokens to a formatter. Longer tokens must come first so that e.g.
+// "yyyy" is not consumed as two "yy" tokens.
+var dateTokens = []struct {
+	token  string
+	format func(t time.Time) string
+}{
+	{"yyyy", func(t time.Time) string { return fmt.Sprintf("%04d", t.Year()) }},
+	{"yy", func(t time.Time) string { return fmt.Sprintf("%02d", t.Year()%100) }},
+	{"MM", func(t time.Time) string { return fmt.Sprintf("%02d", int(t.Month())) }},
+	{"dd", func(t time.Time) string { return fmt.Sprintf("%02d", t.Day()) }},
+	{"HH", func(t time.Time) string { return fmt.Sprintf("%02d", t.Hour()) }},
+}
+
+// isIndexTemplate returns whether the index name contains a date pattern, e.g. "k6-metrics-{yyyy.MM.dd}".
+func isIndexTemplate(name string) bool {
+	return strings.Contains(name, "{") && strings.Contains(name, "}")
+}
+
+// resolveIndexName expands all date patterns enclosed in curly braces with the (UTC) date of t. Names without a
+// pattern are returned unchanged.
+func resolveIndexName(template string, t time.Time) string {
+	t = t.UTC()
+	return replacePatterns(template, func(pattern string) string {
+		return expandDatePattern(pattern, t)
+	})
+}
+
+// replacePatterns replaces every part of name enclosed in curly braces with the result of replace.
+func replacePatterns(name string, replace func(pattern string) string) string {
+	if !isIndexTemplate(name) {
+		return name
+	}
+	var b strings.Builder
+	rest := name
+	for {
+		start := strings.Index(rest, "{")
+		end := strings.Index(rest, "}")
+		if start < 0 || end < start {
+			b.WriteString(rest)
+			return b.String()
+		}
+		b.WriteString(rest[:start])
+		b.WriteString(replace(rest[start+1 : end]))
+		rest = rest[end+1:]
+	}
+}
+
+func expandDatePattern(pattern string, t time.Time) string {
+	var b strings.Builder
+	for len(pattern) > 0 {
+		matched := false
+		for _, dt := range dateTokens {
+			if strings.HasPrefix(pattern, dt.token) {
+				b.WriteString(dt.format(t))
+				pattern = pattern[len(dt.token):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			b.WriteByte(pattern[0])
+			pattern = pattern[1:]
+		}
+	}
+	return b.String()
+}
+
+// indexMapping adapts the embedded mapping to the configured document fields.
+func indexMapping(config Config) ([]byte, error) {
+	var body map[string]interface{}
+	if err := json.Unmarshal(mapping, &body); err != nil {
+		return nil, err
+	}
+	properties := body["mappings"].(map[string]interface{})["properties"].(map[string]interface{})
+	timestampMapping := properties[defaultTimestampField].(map[string]interface{})
+	switch config.TimestampPrecision.String {
+	case timestampMicros, timestampNanos:
+		timestampMapping["type"] = "date_nanos"
+	case timestampSeconds:
+		// numbers are read as epoch milliseconds otherwise
+		timestampMapping["format"] = "epoch_second"
+	}
+	delete(properties, defaultTimestampField)
+	properties[config.timestampField()] = timestampMapping
+	var summaryMapping map[string]interface{}
+	if config.AggregateTrends.Bool || config.SummaryOnly.Bool {
+		// the fields of the summary would otherwise be mapped as long if their first value has no fraction
+		summaryProperties := map[string]interface{}{"count": map[string]string{"type": "long"}}
+		for _, name := range []string{"min", "max", "avg", "p50", "p90", "p95", "p99"} {
+			summaryProperties[name] = properties["Value"]
+		}
+		if config.SummaryOnly.Bool {
+			// the count of a counter is its total, which may have a fraction
+			for _, name := range []string{"count", "rate", "value"} {
+				summaryProperties[name] = properties["Value"]
+			}
+			summaryProperties["passes"] = map[string]string{"type": "long"}
+			summaryProperties["fails"] = map[string]string{"type": "long"}
+		}
+		summaryMapping = map[string]interface{}{"properties": summaryProperties}
+	}
+	if config.ECSMode.Bool {
+		metricProperties := map[string]interface{}{"value": properties["Value"]}
+		if summaryMapping != nil {
+			metricProperties["summary"] = summaryMapping
+		}
+		properties["k6"] = map[string]interface{}{
+			"properties": map[string]interface{}{
+				"metric": map[string]interface{}{"properties": metricProperties},
+			},
+		}
+		delete(properties, "Value")
+	} else {
+		properties[config.ValueField.String] = properties[defaultValueField]
+		if config.ValueField.String != defaultValueField {
+			delete(properties, defaultValueField)
+		}
+		if summaryMapping != nil {
+			properties["Summary"] = summaryMapping
+		}
+	}
+	if len(config.SourceExclude) > 0 {
+		// the fields are still indexed and can be searched and aggregated, but are not returned with the documents
+		source := body["mappings"].(map[string]interface{})["_source"].(map[string]interface{})
+		source["excludes"] = config.SourceExclude
+	}
+	if config.Serverless.Bool {
+		// serverless projects manage shards themselves and reject the setting
+		delete(body, "settings")
+	}
+	return json.Marshal(body)
+}
+
+// indexPattern returns the pattern matching all indices the configured index name resolves to.
+func indexPattern(name string) string {
+	return replacePatterns(name, func(string) string { return "*" })
+}
+
+// indexTemplate builds a composable index template applying the mapping to all indices written by this output.
+func indexTemplate(config Config, mapping []byte) ([]byte, error) {
+	var template map[string]interface{}
+	if err := json.Unmarshal(mapping, &template); err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, name := range config.indexNames() {
+		if pattern := indexPattern(name); !contains(patterns, pattern) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	body := map[string]interface{}{
+		"index_patterns": patterns,
+		"template":       template,
+		// higher than the priority of the built-in templates, e.g. for metrics-*-*
+		"priority": 200,
+		"_meta": map[string]string{
+			"description": "Mapping of k6 metrics written by xk6-output-elasticsearch",
+		},
+	}
+	if config.UseDataStream.Bool {
+		body["data_stream"] = map[string]interface{}{}
+	}
+	return json.Marshal(body)
+}
+
+// indexRoute sends the samples of the metrics matching a glob like http_* to another index.
+type indexRoute struct {
+	Metric string `json:"metric"`
+	Index  string `json:"index"`
+}
+
+// indexRoutes are ordered, the first matching route wins.
+type indexRoutes []indexRoute
+
+// UnmarshalJSON accepts an object like {"http_*": "k6-http"}, keeping the order of its keys, as well as a list of
+// routes.
+func (r *indexRoutes) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return json.Unmarshal(data, (*[]indexRoute)(r))
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if t, err := decoder.Token(); err != nil {
+		return err
+	} else if t != json.Delim('{') {
+		return errors.New("indexRouting must be a JSON object mapping metric names to indices")
+	}
+	routes := indexRoutes{}
+	for decoder.More() {
+		var metric, index string
+		t, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		metric = t.(string)
+		if err := decoder.Decode(&index); err != nil {
+			return err
+		}
+		routes = append(routes, indexRoute{Metric: metric, Index: index})
+	}
+	*r = routes
+	return nil
+}
+
+// parseIndexRoutes parses routes in the form metric:index, e.g. http_*:k6-http.
+func parseIndexRoutes(values []string) (indexRoutes, error) {
+	routes := make(indexRoutes, 0, len(values))
+	for _, value := range values {
+		metric, index, ok := strings.Cut(value, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid index route %q, it must look like metric:index", value)
+		}
+		routes = append(routes, indexRoute{Metric: strings.TrimSpace(metric), Index: strings.TrimSpace(index)})
+	}
+	return routes, nil
+}
+
+// indexNameFor returns the (possibly date-based) name of the index for a metric.
+func (c Config) indexNameFor(metric string) string {
+	for _, route := range c.IndexRouting {
+		if ok, _ := path.Match(route.Metric, metric); ok {
+			return route.Index
+		}
+	}
+	return c.IndexName.String
+}
+
+// indexNames returns all configured index names.
+func (c Config) indexNames() []string {
+	names := []string{c.IndexName.String}
+	for _, route := range c.IndexRouting {
+		names = append(names, route.Index)
+	}
+	if c.MarkerIndex.Valid {
+		names = append(names, c.MarkerIndex.String)
+	}
+	return names
+}
@@ -0,0 +1,518 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.k6.io/k6/metrics"
+)
+
+func TestResolveIndexName(t *testing.T) {
+	// late in the evening in New York is the next day in UTC
+	at := time.Date(2024, time.January, 14, 22, 30, 0, 0, time.FixedZone("EST", -5*60*60))
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"k6-metrics-{yyyy.MM.dd}", "k6-metrics-2024.01.15"},
+		{"k6-metrics-{yyyy.MM}", "k6-metrics-2024.01"},
+		{"k6-{yy}-{MM}-{dd}-{HH}", "k6-24-01-15-03"},
+		{"k6-metrics", "k6-metrics"},
+		{"k6-{week}", "k6-week"},
+	}
+	for _, tt := range tests {
+		if got := resolveIndexName(tt.template, at); got != tt.want {
+			t.Errorf("resolveIndexName(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestIsIndexTemplate(t *testing.T) {
+	for name, want := range map[string]bool{
+		"k6-metrics":              false,
+		"k6-metrics-{yyyy.MM.dd}": true,
+		"k6-metrics-{":            false,
+	} {
+		if got := isIndexTemplate(name); got != want {
+			t.Errorf("isIndexTemplate(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestEnsureIndexTemplate(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "ensureIndexTemplate=true,indexName=k6-{yyyy.MM.dd}")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, ok := cluster.request(http.MethodPut, "/_index_template/k6-metrics")
+	if !ok {
+		t.Fatal("the index template was not put")
+	}
+	var template struct {
+		IndexPatterns []string `json:"index_patterns"`
+		Template      struct {
+			Mappings struct {
+				DynamicTemplates []map[string]struct {
+					Mapping struct {
+						Type string `json:"type"`
+					} `json:"mapping"`
+				} `json:"dynamic_templates"`
+				Properties map[string]struct {
+					Type string `json:"type"`
+				} `json:"properties"`
+			} `json:"mappings"`
+		} `json:"template"`
+	}
+	if err := json.Unmarshal([]byte(req.body), &template); err != nil {
+		t.Fatal(err)
+	}
+	if len(template.IndexPatterns) != 1 || template.IndexPatterns[0] != "k6-*" {
+		t.Errorf("got index patterns %v, want [k6-*]", template.IndexPatterns)
+	}
+	mappings := template.Template.Mappings
+	if got := mappings.Properties["Value"].Type; got != "double" {
+		t.Errorf("got Value mapped as %q, want double", got)
+	}
+	if got := mappings.Properties["Time"].Type; got != "date" {
+		t.Errorf("got Time mapped as %q, want date", got)
+	}
+	if len(mappings.DynamicTemplates) == 0 || mappings.DynamicTemplates[0]["strings"].Mapping.Type != "keyword" {
+		t.Errorf("got dynamic templates %+v, want strings like tags mapped as keyword", mappings.DynamicTemplates)
+	}
+}
+
+func TestSourceExclude(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		// the request creating the mapping
+		path string
+		// the path of the mappings in its body
+		mappings []string
+	}{
+		{
+			name:     "index",
+			arg:      "createIndex=true,indexName=k6-load-tests",
+			path:     "/k6-load-tests",
+			mappings: []string{"mappings"},
+		},
+		{
+			name:     "index template",
+			arg:      "ensureIndexTemplate=true,indexName=k6-{yyyy.MM.dd}",
+			path:     "/_index_template/k6-metrics",
+			mappings: []string{"template", "mappings"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			o := newTestOutput(t, cluster, tt.arg+",sourceExclude={Tags.url,Tags.error}")
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			req, ok := cluster.request(http.MethodPut, tt.path)
+			if !ok {
+				t.Fatalf("got no request to %s", tt.path)
+			}
+			var body map[string]interface{}
+			if err := json.Unmarshal([]byte(req.body), &body); err != nil {
+				t.Fatal(err)
+			}
+			mappings := body
+			for _, name := range tt.mappings {
+				mappings, _ = mappings[name].(map[string]interface{})
+			}
+			source, _ := mappings["_source"].(map[string]interface{})
+			if got := source["excludes"]; !reflect.DeepEqual(got, []interface{}{"Tags.url", "Tags.error"}) {
+				t.Errorf("got _source %v, want Tags.url and Tags.error excluded", source)
+			}
+			// the fields are still indexed
+			if _, ok := mappings["properties"]; !ok {
+				t.Errorf("got mappings %v, want the properties to be kept", mappings)
+			}
+		})
+	}
+
+	for _, fields := range [][]string{{}, {"Tags.url", " "}} {
+		config := NewConfig()
+		config.SourceExclude = fields
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "sourceExclude must") {
+			t.Errorf("got error %v for sourceExclude %q, want it to be rejected", err, fields)
+		}
+	}
+}
+
+func TestTargetIsAlias(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "targetIsAlias=true,indexName=k6-metrics-write,createIndex=true")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	o.AddMetricSamples(newTestSamples(2))
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the alias and its backing indices are managed by someone else, e.g. ILM
+	cluster.mu.Lock()
+	for _, req := range cluster.requests {
+		if req.method == http.MethodPut {
+			t.Errorf("got a request to put %s, want none for an alias", req.path)
+		}
+	}
+	cluster.mu.Unlock()
+	if got := documentIndices(t, cluster); !reflect.DeepEqual(got, []string{"k6-metrics-write", "k6-metrics-write"}) {
+		t.Errorf("got the documents written to %v, want the alias", got)
+	}
+	// Elasticsearch writes the documents to the write index of the alias, create is only needed for data streams
+	for _, body := range cluster.bulkRequests() {
+		for _, action := range bulkActions(t, body) {
+			if _, ok := action[opTypeIndex]; !ok {
+				t.Errorf("got action %v, want %s", action, opTypeIndex)
+			}
+		}
+	}
+
+	for arg, wantErr := range map[string]string{
+		"useDataStream=true":        "targetIsAlias and useDataStream cannot be combined",
+		"indexName=k6-{yyyy.MM.dd}": "the name of an alias must not contain a date pattern",
+		"ensureIndexTemplate=true":  "ensureIndexTemplate cannot be used with targetIsAlias",
+	} {
+		config, err := GetConsolidatedConfig(nil, map[string]string{}, "targetIsAlias=true,"+arg)
+		if err == nil {
+			err = config.Validate()
+		}
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: got error %v, want one containing %q", arg, err, wantErr)
+		}
+	}
+}
+
+func TestBootstrapWithoutPrivileges(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		// the status of the responses to putting the template and creating the index
+		status      int
+		wantPuts    int
+		wantWarning string
+		wantErr     string
+	}{
+		{name: "disabled by default", status: http.StatusForbidden},
+		{
+			name:        "template forbidden",
+			arg:         "ensureIndexTemplate=true",
+			status:      http.StatusForbidden,
+			wantPuts:    1,
+			wantWarning: "the index template must be set up separately",
+		},
+		{
+			name:        "index forbidden",
+			arg:         "createIndex=true",
+			status:      http.StatusForbidden,
+			wantPuts:    1,
+			wantWarning: "the index must exist or be created automatically",
+		},
+		{
+			name:     "template fails",
+			arg:      "ensureIndexTemplate=true",
+			status:   http.StatusInternalServerError,
+			wantPuts: 1,
+			wantErr:  "could not put index template k6-metrics",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			cluster.respond = func(req fakeRequest) (int, string) {
+				if req.method == http.MethodPut {
+					return tt.status, `{"error":{"type":"security_exception","reason":"action is unauthorized"}}`
+				}
+				return http.StatusOK, `{}`
+			}
+			o, hook := newTestOutputWithLogs(t, cluster, "maxRetries=0,"+tt.arg)
+			err := o.Start()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("the run did not start: %v", err)
+			}
+			o.AddMetricSamples(newTestSamples(1))
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			cluster.mu.Lock()
+			puts := 0
+			for _, req := range cluster.requests {
+				if req.method == http.MethodPut {
+					puts++
+				}
+			}
+			cluster.mu.Unlock()
+			if puts != tt.wantPuts {
+				t.Errorf("got %d bootstrap requests, want %d", puts, tt.wantPuts)
+			}
+			if got := cluster.bulkLines(); got != 2 {
+				t.Errorf("got %d bulk lines, want the sample to be written", got)
+			}
+			var warnings []string
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "missing privileges") {
+					warnings = append(warnings, entry.Message)
+				}
+			}
+			switch {
+			case tt.wantWarning == "" && len(warnings) > 0:
+				t.Errorf("got warnings %q, want none", warnings)
+			case tt.wantWarning != "" && (len(warnings) != 1 || !strings.Contains(warnings[0], tt.wantWarning)):
+				t.Errorf("got warnings %q, want one containing %q", warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestIndexRouting(t *testing.T) {
+	sources := []struct {
+		name string
+		env  map[string]string
+		arg  string
+	}{
+		{
+			name: "env",
+			env: map[string]string{
+				"K6_ELASTICSEARCH_INDEX_ROUTING": `{"http_req_*":"k6-http-timings","http_*":"k6-http","checkout_*":"k6-business"}`,
+			},
+		},
+		{name: "arg", arg: "indexRouting={http_req_*:k6-http-timings,http_*:k6-http,checkout_*:k6-business}"},
+	}
+	tests := []struct {
+		metric string
+		want   string
+	}{
+		// the first matching route wins
+		{"http_req_duration", "k6-http-timings"},
+		{"http_reqs", "k6-http"},
+		{"checkout_orders", "k6-business"},
+		{"vus", "k6-metrics"},
+	}
+	for _, source := range sources {
+		t.Run(source.name, func(t *testing.T) {
+			env := source.env
+			if env == nil {
+				env = map[string]string{}
+			}
+			config, err := GetConsolidatedConfig(nil, env, source.arg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := config.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			for _, tt := range tests {
+				if got := config.indexNameFor(tt.metric); got != tt.want {
+					t.Errorf("got index %s for %s, want %s", got, tt.metric, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRoutedSamplesAreWrittenToTheirIndex(t *testing.T) {
+	cluster := newFakeCluster(t)
+	o := newTestOutput(t, cluster, "indexRouting=test_*:k6-test,concurrency=1")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	registry := metrics.NewRegistry()
+	vus := registry.MustNewMetric("vus", metrics.Gauge)
+	samples := append(newTestSamples(1), metrics.Sample{
+		TimeSeries: metrics.TimeSeries{Metric: vus, Tags: registry.RootTagSet()},
+		Time:       time.Now(),
+		Value:      1,
+	})
+	o.AddMetricSamples(samples)
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if indices := documentIndices(t, cluster); strings.Join(indices, ",") != "k6-test,k6-metrics" {
+		t.Errorf("got the documents written to %v, want [k6-test k6-metrics]", indices)
+	}
+}
+
+// documentIndices returns the index of every document the cluster received in bulk requests.
+func documentIndices(t *testing.T, cluster *fakeCluster) []string {
+	t.Helper()
+	var indices []string
+	for i, body := range cluster.bulkRequests() {
+		cluster.mu.Lock()
+		path, _, _ := strings.Cut(cluster.bulkURLs[i], "?")
+		cluster.mu.Unlock()
+		for _, action := range bulkActions(t, body) {
+			var index string
+			for _, meta := range action {
+				index, _ = meta["_index"].(string)
+			}
+			if index == "" {
+				// the index of the request
+				index = strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/_bulk")
+			}
+			indices = append(indices, index)
+		}
+	}
+	return indices
+}
+
+func TestSampleTimeSelectsTheIndex(t *testing.T) {
+	today := resolveIndexName("k6-{yyyy.MM.dd}", time.Now())
+	tests := []struct {
+		name string
+		arg  string
+		want string
+	}{
+		{name: "sample time", want: "k6-2024.03.01,k6-2024.03.01,k6-2024.03.02,k6-2024.03.02"},
+		{
+			name: "wall clock",
+			arg:  ",useSampleTimeForIndex=false",
+			want: strings.Join([]string{today, today, today, today}, ","),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			o := newTestOutput(t, cluster, "indexName=k6-{yyyy.MM.dd},flushPeriod=1h,concurrency=1"+tt.arg)
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			// samples of a backfill from just before and after midnight
+			samples := newTestSamples(4)
+			midnight := time.Date(2024, time.March, 2, 0, 0, 0, 0, time.UTC)
+			for i, offset := range []time.Duration{-2 * time.Hour, -time.Second, time.Second, 2 * time.Hour} {
+				sample := samples[i].(metrics.Sample)
+				sample.Time = midnight.Add(offset)
+				samples[i] = sample
+			}
+			o.AddMetricSamples(samples)
+			if err := o.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			if o.performance.flushes != 1 {
+				t.Errorf("got %d flushes, want 1", o.performance.flushes)
+			}
+			if got := strings.Join(documentIndices(t, cluster), ","); got != tt.want {
+				t.Errorf("got the documents written to %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBulkPerIndex(t *testing.T) {
+	cluster := newFakeCluster(t)
+	cluster.bulk = func(body string) (int, string) {
+		if !strings.Contains(body, `"MetricName":"metric_b"`) {
+			return http.StatusOK, acceptAll(body)
+		}
+		// all documents of k6-b are rejected
+		items := make([]string, len(bulkItems([]byte(body))))
+		for i := range items {
+			items[i] = `{"create":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"bad"}}}`
+		}
+		return http.StatusOK, `{"errors":true,"items":[` + strings.Join(items, ",") + `]}`
+	}
+	o := newTestOutput(t, cluster,
+		"bulkPerIndex=true,indexRouting={metric_a:k6-a,metric_b:k6-b},flushPeriod=1h,concurrency=1")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	registry := metrics.NewRegistry()
+	metricsByIndex := map[string]*metrics.Metric{
+		"k6-a":       registry.MustNewMetric("metric_a", metrics.Counter),
+		"k6-b":       registry.MustNewMetric("metric_b", metrics.Counter),
+		"k6-metrics": registry.MustNewMetric("metric_c", metrics.Counter),
+	}
+	// the indices are interleaved in the buffer
+	var samples []metrics.SampleContainer
+	for i, index := range []string{"k6-a", "k6-b", "k6-metrics", "k6-b", "k6-a", "k6-b", "k6-b", "k6-metrics", "k6-a",
+		"k6-b"} {
+		samples = append(samples, metrics.Sample{
+			TimeSeries: metrics.TimeSeries{Metric: metricsByIndex[index], Tags: registry.RootTagSet()},
+			Time:       time.Now(),
+			Value:      float64(i),
+		})
+	}
+	o.AddMetricSamples(samples)
+	_ = o.Flush(context.Background())
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := cluster.bulkRequests()
+	if len(requests) != 3 {
+		t.Fatalf("got %d bulk requests, want one for each of the 3 indices", len(requests))
+	}
+	counts := map[string]int{}
+	for i, body := range requests {
+		cluster.mu.Lock()
+		path, _, _ := strings.Cut(cluster.bulkURLs[i], "?")
+		cluster.mu.Unlock()
+		// the index is only in the path
+		if strings.Contains(body, `"_index"`) {
+			t.Errorf("bulk request %d to %s has the index in its action lines", i, path)
+		}
+		counts[strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/_bulk")] += len(bulkItems([]byte(body)))
+	}
+	if want := map[string]int{"k6-a": 3, "k6-b": 5, "k6-metrics": 2}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got documents by index %v, want %v", counts, want)
+	}
+	if n := o.stats.droppedFor(dropReasonRejected); n != 5 {
+		t.Errorf("got %d rejected documents, want the 5 of k6-b", n)
+	}
+}
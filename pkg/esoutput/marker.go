@@ -0,0 +1,102 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// The events marking the start and the end of a test.
+const (
+	markerTestStart = "test_start"
+	markerTestEnd   = "test_end"
+)
+
+// newMarker returns the document marking an event of the test run, e.g. to annotate charts in Kibana.
+func (o *Output) newMarker(eventType string, t time.Time) elasticMetricEntry {
+	var entry elasticMetricEntry
+	if o.config.ECSMode.Bool {
+		entry = elasticMetricEntry{
+			{"@timestamp", o.timestamp(t)},
+			{"event", map[string]string{"dataset": "k6", "kind": "event", "action": eventType}},
+			{"k6", map[string]interface{}{"test_run_id": o.config.TestRunID.String, "test_name": o.testName}},
+		}
+	} else {
+		entry = elasticMetricEntry{
+			{"event_type", eventType},
+			{o.config.timestampField(), o.timestamp(t)},
+		}
+		// data streams require this field
+		if o.config.UseDataStream.Bool && o.config.timestampField() != "@timestamp" {
+			entry = append(entry, documentField{"@timestamp", o.timestamp(t)})
+		}
+		entry = append(entry,
+			documentField{"test_run_id", o.config.TestRunID.String},
+			documentField{"test_name", o.testName})
+	}
+	entry = append(entry, o.docTypeFields(docTypeMarker)...)
+	return append(entry, o.customFields()...)
+}
+
+// indexMarker indexes a marker document right away, bypassing the bulk indexer, so that it is present once the
+// method returns. Failures are logged as markers are not essential to the test.
+func (o *Output) indexMarker(ctx context.Context, eventType string) {
+	now := time.Now()
+	name := o.config.IndexName.String
+	if o.config.MarkerIndex.Valid {
+		name = o.config.MarkerIndex.String
+	}
+	indexName := resolveIndexName(name, now)
+	o.ensureIndex(indexName)
+
+	data, err := json.Marshal(o.newMarker(eventType, now))
+	if err != nil {
+		o.logger.Errorf("Elasticsearch: cannot encode the %s marker: %s", eventType, err)
+		return
+	}
+	index := o.client.Index
+	options := []func(*esapi.IndexRequest){index.WithContext(ctx), index.WithOpType(o.config.opType())}
+	if o.config.Pipeline.Valid {
+		options = append(options, index.WithPipeline(o.config.Pipeline.String))
+	}
+	res, err := index(indexName, bytes.NewReader(data), options...)
+	if err != nil {
+		o.logger.Errorf("Elasticsearch: could not index the %s marker: %s", eventType, err)
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		body, _ := io.ReadAll(res.Body)
+		o.logger.Errorf("Elasticsearch: could not index the %s marker: %s", eventType, body)
+		return
+	}
+	o.logger.Debugf("Elasticsearch: indexed the %s marker into %s", eventType, indexName)
+}
@@ -0,0 +1,343 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons for samples not being indexed.
+const (
+	dropReasonRejected       = "rejected by Elasticsearch"
+	dropReasonRequestFailed  = "bulk request failed"
+	dropReasonTooLarge       = "document exceeds maxBatchBytes"
+	dropReasonBufferFull     = "buffer full"
+	dropReasonShutdown       = "final flush timed out"
+	dropReasonCircuitOpen    = "circuit breaker open at the end"
+	dropReasonEncodingFailed = "document could not be encoded"
+	dropReasonPanic          = "flush panicked"
+	dropReasonStopped        = "emitted after the output stopped"
+)
+
+// sampleStats counts the processed samples and the ones that were dropped, broken down by reason.
+type sampleStats struct {
+	mu      sync.Mutex
+	total   int64
+	dropped map[string]int64
+	// documents that already existed with the create action, those are expected when a test run is repeated
+	duplicates int64
+	// the rejected documents by index
+	rejected map[string]int64
+}
+
+func newSampleStats() *sampleStats {
+	return &sampleStats{dropped: make(map[string]int64), rejected: make(map[string]int64)}
+}
+
+func (s *sampleStats) addTotal(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total += n
+}
+
+func (s *sampleStats) drop(reason string, n int64) {
+	if n <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped[reason] += n
+}
+
+// reject counts a document rejected by Elasticsearch for the index it was written to.
+func (s *sampleStats) reject(index string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped[dropReasonRejected]++
+	s.rejected[index]++
+}
+
+// rejectedByIndex returns a description like "k6-business: 1, k6-http: 3" of the rejected documents if they were
+// written to more than one index.
+func (s *sampleStats) rejectedByIndex() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.rejected) <= 1 {
+		return "", false
+	}
+	counts := make([]string, 0, len(s.rejected))
+	for index, n := range s.rejected {
+		counts = append(counts, fmt.Sprintf("%s: %d", index, n))
+	}
+	sort.Strings(counts)
+	return strings.Join(counts, ", "), true
+}
+
+func (s *sampleStats) duplicate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.duplicates++
+}
+
+func (s *sampleStats) duplicateCount() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.duplicates
+}
+
+// droppedTotal returns the number of dropped samples for all reasons.
+func (s *sampleStats) droppedTotal() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var dropped int64
+	for _, n := range s.dropped {
+		dropped += n
+	}
+	return dropped
+}
+
+func (s *sampleStats) droppedFor(reason string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped[reason]
+}
+
+// summary returns the number of dropped samples and a description like "1234 of 98765 samples were not indexed
+// (bulk request failed: 1000, rejected by Elasticsearch: 234)".
+func (s *sampleStats) summary() (int64, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var dropped int64
+	reasons := make([]string, 0, len(s.dropped))
+	for reason, n := range s.dropped {
+		dropped += n
+		reasons = append(reasons, fmt.Sprintf("%s: %d", reason, n))
+	}
+	sort.Strings(reasons)
+	var duplicates string
+	if s.duplicates > 0 {
+		duplicates = fmt.Sprintf(", %d duplicates were skipped", s.duplicates)
+	}
+	if dropped == 0 {
+		return 0, fmt.Sprintf("all %d samples were indexed%s", s.total, duplicates)
+	}
+	return dropped, fmt.Sprintf("%d of %d samples were not indexed (%s)%s", dropped, s.total, strings.Join(reasons, ", "), duplicates)
+}
+
+const (
+	// itemErrorsLogInterval limits how often rejected documents are logged
+	itemErrorsLogInterval = 10 * time.Second
+	// itemErrorsSampleSize is the number of distinct reasons kept per error type
+	itemErrorsSampleSize = 3
+)
+
+// itemErrors aggregates the errors of rejected documents by type, so that they can be logged as a rate-limited
+// summary instead of one line per document.
+type itemErrors struct {
+	mu      sync.Mutex
+	counts  map[string]int64
+	reasons map[string][]string
+	lastLog time.Time
+}
+
+func newItemErrors() *itemErrors {
+	return &itemErrors{
+		counts:  make(map[string]int64),
+		reasons: make(map[string][]string),
+		lastLog: time.Now(),
+	}
+}
+
+// record adds an error and returns a summary of all errors since the last one, once that is due.
+func (e *itemErrors) record(errorType, reason string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.counts[errorType]++
+	if samples := e.reasons[errorType]; len(samples) < itemErrorsSampleSize && !contains(samples, reason) {
+		e.reasons[errorType] = append(samples, reason)
+	}
+	if time.Since(e.lastLog) < itemErrorsLogInterval {
+		return "", false
+	}
+	return e.summaryLocked(), true
+}
+
+// summary returns the summary of all errors that have not been logged yet.
+func (e *itemErrors) summary() (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.counts) == 0 {
+		return "", false
+	}
+	return e.summaryLocked(), true
+}
+
+func (e *itemErrors) summaryLocked() string {
+	var total int64
+	types := make([]string, 0, len(e.counts))
+	for errorType, n := range e.counts {
+		total += n
+		types = append(types, errorType)
+	}
+	sort.Strings(types)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d documents were rejected", total)
+	for i, errorType := range types {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s: %d (e.g. %s)", errorType, e.counts[errorType], strings.Join(e.reasons[errorType], "; "))
+	}
+
+	e.counts = make(map[string]int64)
+	e.reasons = make(map[string][]string)
+	e.lastLog = time.Now()
+	return b.String()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// statsLogInterval is how often the performance of the output is logged at debug level.
+const statsLogInterval = 30 * time.Second
+
+// outputStats measures the performance of the output itself: how many samples are flushed at once, how long
+// the bulk requests take and how often they are retried.
+type outputStats struct {
+	mu              sync.Mutex
+	flushes         int64
+	flushedSamples  int64
+	maxFlushSamples int64
+	requests        int64
+	failedRequests  int64
+	retries         int64
+	requestTime     time.Duration
+	maxRequestTime  time.Duration
+	lastRequestTime time.Duration
+}
+
+// bulkRequest tracks a bulk request of the indexer from OnFlushStart to OnFlushEnd.
+type bulkRequest struct {
+	start time.Time
+	// the number of times the request was sent, counted by attemptCountTransport
+	attempts int32
+}
+
+type bulkRequestKey struct{}
+
+// flushed records a flush of the buffer with n samples, flushes of an empty buffer are ignored.
+func (s *outputStats) flushed(n int64) {
+	if n == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushes++
+	s.flushedSamples += n
+	if n > s.maxFlushSamples {
+		s.maxFlushSamples = n
+	}
+}
+
+// requestStarted is used as OnFlushStart of the bulk indexer to time the bulk requests.
+func (s *outputStats) requestStarted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bulkRequestKey{}, &bulkRequest{start: time.Now()})
+}
+
+// requestFinished is used as OnFlushEnd of the bulk indexer.
+func (s *outputStats) requestFinished(ctx context.Context) {
+	req, ok := ctx.Value(bulkRequestKey{}).(*bulkRequest)
+	if !ok {
+		return
+	}
+	d := time.Since(req.start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if attempts := atomic.LoadInt32(&req.attempts); attempts > 1 {
+		s.retries += int64(attempts - 1)
+	}
+	s.requestTime += d
+	s.lastRequestTime = d
+	if d > s.maxRequestTime {
+		s.maxRequestTime = d
+	}
+}
+
+// inRequest reports whether ctx is the context of a bulk request, as returned by requestStarted.
+func (s *outputStats) inRequest(ctx context.Context) bool {
+	_, ok := ctx.Value(bulkRequestKey{}).(*bulkRequest)
+	return ok
+}
+
+func (s *outputStats) requestFailed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failedRequests++
+}
+
+// summary returns a description like "12 flushes with 410 samples on average (max 5000), 8 bulk requests
+// taking 35ms on average (max 120ms), 1 failed, 2 retries".
+func (s *outputStats) summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var avgSamples int64
+	if s.flushes > 0 {
+		avgSamples = s.flushedSamples / s.flushes
+	}
+	var avgRequestTime time.Duration
+	if s.requests > 0 {
+		avgRequestTime = s.requestTime / time.Duration(s.requests)
+	}
+	return fmt.Sprintf("%d flushes with %d samples on average (max %d), %d bulk requests taking %s on average (max %s), "+
+		"%d failed, %d retries", s.flushes, avgSamples, s.maxFlushSamples, s.requests,
+		avgRequestTime.Round(time.Millisecond), s.maxRequestTime.Round(time.Millisecond), s.failedRequests, s.retries)
+}
+
+// flushedAndLast returns the number of samples flushed so far and the duration of the last bulk request.
+func (s *outputStats) flushedAndLast() (int64, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushedSamples, s.lastRequestTime
+}
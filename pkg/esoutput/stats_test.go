@@ -0,0 +1,315 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestOutputStatsCountFlushesAndRetries(t *testing.T) {
+	cluster := newFakeCluster(t)
+	attempts := 0
+	cluster.bulk = func(body string) (int, string) {
+		// every bulk request is throttled once
+		attempts++
+		if attempts%2 == 1 {
+			return http.StatusTooManyRequests, `{}`
+		}
+		return http.StatusOK, acceptAll(body)
+	}
+	o := newTestOutput(t, cluster, "retryBackoff=1ms")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{3, 5} {
+		o.AddMetricSamples(newTestSamples(n))
+		if err := o.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := o.performance
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flushes != 2 || s.flushedSamples != 8 || s.maxFlushSamples != 5 {
+		t.Errorf("got %d flushes with %d samples (max %d), want 2 with 8 (max 5)",
+			s.flushes, s.flushedSamples, s.maxFlushSamples)
+	}
+	if s.requests != 2 || s.retries != 2 || s.failedRequests != 0 {
+		t.Errorf("got %d bulk requests with %d retries and %d failed, want 2 with 2 retries and none failed",
+			s.requests, s.retries, s.failedRequests)
+	}
+}
+
+// rejectAll returns the response to a bulk request that rejected all of its items.
+func rejectAll(body string) (int, string) {
+	items := make([]string, len(bulkItems([]byte(body))))
+	for i := range items {
+		items[i] = `{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}`
+	}
+	return http.StatusOK, `{"errors":true,"items":[` + strings.Join(items, ",") + `]}`
+}
+
+func TestDroppedSamplesAreCountedByReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		arg    string
+		bulk   func(body string) (int, string)
+		reason string
+	}{
+		{name: "rejected", bulk: rejectAll, reason: dropReasonRejected},
+		{
+			name:   "request failed",
+			arg:    "maxRetries=0",
+			bulk:   func(string) (int, string) { return http.StatusInternalServerError, `{}` },
+			reason: dropReasonRequestFailed,
+		},
+		{name: "too large", arg: "maxBatchBytes=100", reason: dropReasonTooLarge},
+		{
+			name: "shutdown timed out",
+			arg:  "shutdownFlushTimeout=50ms",
+			bulk: func(body string) (int, string) {
+				time.Sleep(300 * time.Millisecond)
+				return http.StatusOK, acceptAll(body)
+			},
+			reason: dropReasonShutdown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			cluster.bulk = tt.bulk
+			o, hook := newTestOutputWithLogs(t, cluster, "flushPeriod=1h,"+tt.arg)
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			o.AddMetricSamples(newTestSamples(3))
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			if n := o.stats.droppedFor(tt.reason); n != 3 || o.stats.droppedTotal() != 3 {
+				t.Errorf("got %d samples dropped for %s and %d in total, want 3", n, tt.reason, o.stats.droppedTotal())
+			}
+			want := "3 of 3 samples were not indexed (" + tt.reason + ": 3)"
+			if entry := hook.LastEntry(); entry == nil || !strings.Contains(entry.Message, want) {
+				t.Errorf("got last log entry %v, want the summary %q", entry, want)
+			}
+		})
+	}
+}
+
+func TestFailOnDrop(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		bulk func(body string) (int, string)
+		// a part of the error the test run is aborted with, empty if it isn't
+		wantErr string
+	}{
+		{name: "no drops", arg: "failOnDrop=true"},
+		{name: "disabled", arg: "maxBufferedSamples=2", bulk: rejectAll},
+		{
+			name:    "buffer full",
+			arg:     "failOnDrop=true,maxBufferedSamples=2",
+			wantErr: "samples were dropped because the buffer is full",
+		},
+		{name: "rejected", arg: "failOnDrop=true", bulk: rejectAll, wantErr: "a document was rejected"},
+		{
+			name:    "request failed",
+			arg:     "failOnDrop=true,maxRetries=0",
+			bulk:    func(string) (int, string) { return http.StatusInternalServerError, `{}` },
+			wantErr: "a bulk request failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			cluster.bulk = tt.bulk
+			o := newTestOutput(t, cluster, "flushPeriod=1h,"+tt.arg)
+			var errs []error
+			var mu sync.Mutex
+			o.SetTestRunStopCallback(func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err)
+			})
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				o.AddMetricSamples(newTestSamples(3))
+				_ = o.Flush(context.Background())
+			}
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.wantErr == "" {
+				if len(errs) != 0 {
+					t.Errorf("got the test run aborted with %v, want it to continue", errs)
+				}
+				return
+			}
+			// the test run is aborted once
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.wantErr) {
+				t.Errorf("got the test run aborted with %v, want it aborted once with %q", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRejectedItemsAreSummarized(t *testing.T) {
+	cluster := newFakeCluster(t)
+	cluster.bulk = func(body string) (int, string) {
+		// every second item is rejected
+		items := make([]string, len(bulkItems([]byte(body))))
+		for i := range items {
+			switch {
+			case i%2 == 0:
+				items[i] = `{"index":{"status":201}}`
+			case i%4 == 1:
+				items[i] = `{"index":{"status":400,"error":{"type":"mapper_parsing_exception",` +
+					`"reason":"failed to parse field [Value]"}}}`
+			default:
+				items[i] = `{"index":{"status":400,"error":{"type":"illegal_argument_exception",` +
+					`"reason":"limit of total fields exceeded"}}}`
+			}
+		}
+		return http.StatusOK, `{"errors":true,"items":[` + strings.Join(items, ",") + `]}`
+	}
+	o, hook := newTestOutputWithLogs(t, cluster, "")
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	o.AddMetricSamples(newTestSamples(8))
+	if err := o.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := o.stats.droppedFor(dropReasonRejected); n != 4 {
+		t.Errorf("got %d rejected documents, want 4", n)
+	}
+	want := "4 documents were rejected: illegal_argument_exception: 2 (e.g. limit of total fields exceeded), " +
+		"mapper_parsing_exception: 2 (e.g. failed to parse field [Value])"
+	logged := false
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.ErrorLevel && strings.Contains(entry.Message, want) {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("the summary %q was not logged", want)
+	}
+}
+
+func TestItemErrorsAreRateLimited(t *testing.T) {
+	errs := newItemErrors()
+	for i := 0; i < 5; i++ {
+		if summary, ok := errs.record("version_conflict_engine_exception", fmt.Sprintf("conflict %d", i)); ok {
+			t.Fatalf("got summary %q within the log interval", summary)
+		}
+	}
+	summary, ok := errs.summary()
+	want := "5 documents were rejected: version_conflict_engine_exception: 5 (e.g. conflict 0; conflict 1; conflict 2)"
+	if !ok || summary != want {
+		t.Errorf("got summary %q, want %q", summary, want)
+	}
+	if summary, ok := errs.summary(); ok {
+		t.Errorf("got summary %q again, want none after it has been logged", summary)
+	}
+
+	// the next error is logged once the interval has passed
+	errs.lastLog = time.Now().Add(-itemErrorsLogInterval)
+	summary, ok = errs.record("version_conflict_engine_exception", "conflict")
+	if !ok || !strings.HasPrefix(summary, "1 documents") {
+		t.Errorf("got summary %q, want the error to be logged", summary)
+	}
+}
+
+func TestStatsInterval(t *testing.T) {
+	// statsLines returns the number of stats lines logged so far
+	statsLines := func(hook *test.Hook) int {
+		n := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.InfoLevel && strings.Contains(entry.Message, "samples buffered") {
+				n++
+			}
+		}
+		return n
+	}
+	for _, interval := range []string{"0s", "20ms"} {
+		t.Run(interval, func(t *testing.T) {
+			cluster := newFakeCluster(t)
+			o, hook := newTestOutputWithLogs(t, cluster, "flushPeriod=1h,statsInterval="+interval)
+			if err := o.Start(); err != nil {
+				t.Fatal(err)
+			}
+			o.AddMetricSamples(newTestSamples(3))
+			if err := o.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			o.AddMetricSamples(newTestSamples(2))
+			if interval == "0s" {
+				if n := statsLines(hook); n != 0 {
+					t.Errorf("got %d stats lines, want none", n)
+				}
+			} else if !eventually(time.Second, func() bool {
+				for _, entry := range hook.AllEntries() {
+					if strings.HasPrefix(entry.Message, "Elasticsearch: 2 samples buffered, 3 flushed, 0 dropped") {
+						return true
+					}
+				}
+				return false
+			}) {
+				t.Errorf("got no stats line with the samples buffered and flushed in %v", hook.AllEntries())
+			}
+			if err := o.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the goroutine logging the stats has stopped
+			n := statsLines(hook)
+			time.Sleep(60 * time.Millisecond)
+			if got := statsLines(hook); got != n {
+				t.Errorf("got %d stats lines after Stop, want none", got-n)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"go.k6.io/k6/output"
+)
+
+// newFakeTLSCluster is a fakeCluster served over HTTPS, which requires a client certificate signed by clientCA if
+// it is set.
+func newFakeTLSCluster(t *testing.T, clientCA *x509.Certificate) *fakeCluster {
+	t.Helper()
+	c := &fakeCluster{}
+	c.Server = httptest.NewUnstartedServer(http.HandlerFunc(c.handle))
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA)
+		c.Server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	}
+	// the failed handshakes are expected
+	c.Config.ErrorLog = log.New(io.Discard, "", 0)
+	c.StartTLS()
+	t.Cleanup(c.Close)
+	return c
+}
+
+// certificatePEM returns the PEM encoding of the certificate of the cluster.
+func (c *fakeCluster) certificatePEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate().Raw}))
+}
+
+// newSelfSignedCert returns a self-signed client certificate and the PEM encoding of it and its key.
+func newSelfSignedCert(t *testing.T) (*x509.Certificate, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "k6"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeTempFile writes the content to a file in a temporary directory and returns its path.
+func writeTempFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// startTLSOutput creates and starts an output for the cluster, which fails if the TLS handshake does.
+func startTLSOutput(t *testing.T, cluster *fakeCluster, env map[string]string, arg string) error {
+	t.Helper()
+	logger, _ := test.NewNullLogger()
+	out, err := New(output.Params{
+		Logger:         logger,
+		ConfigArgument: "url=" + cluster.URL + ",startupRetries=0,maxRetries=0," + arg,
+		Environment:    env,
+	})
+	if err != nil {
+		return err
+	}
+	if err := out.Start(); err != nil {
+		return err
+	}
+	return out.Stop()
+}
+
+func TestCACertPEM(t *testing.T) {
+	cluster := newFakeTLSCluster(t, nil)
+	_, otherCA, _ := newSelfSignedCert(t)
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		arg     string
+		wantErr bool
+	}{
+		{name: "unknown authority", env: map[string]string{}, wantErr: true},
+		{name: "pem", env: map[string]string{"K6_ELASTICSEARCH_CA_CERT_PEM": cluster.certificatePEM()}},
+		{
+			// the file takes precedence over the PEM
+			name:    "file and pem",
+			env:     map[string]string{"K6_ELASTICSEARCH_CA_CERT_PEM": cluster.certificatePEM()},
+			arg:     "caCertFile=" + writeTempFile(t, "ca.pem", otherCA),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := startTLSOutput(t, cluster, tt.env, tt.arg); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want an error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	cluster := newFakeTLSCluster(t, nil)
+	caFile := writeTempFile(t, "ca.pem", []byte(cluster.certificatePEM()))
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		arg  string
+		// a part of the expected error, empty if the handshake succeeds
+		wantErr string
+	}{
+		{name: "verified", arg: "insecureSkipVerify=false", wantErr: "certificate"},
+		{name: "arg", arg: "insecureSkipVerify=true"},
+		{name: "arg alias", arg: "insecureSkipTLSVerify=true"},
+		{name: "env", env: map[string]string{"K6_ELASTICSEARCH_INSECURE_SKIP_VERIFY": "true"}},
+		{name: "env alias", env: map[string]string{"K6_ELASTICSEARCH_INSECURE_SKIP_TLS_VERIFY": "true"}},
+		{
+			name:    "with ca file",
+			arg:     "insecureSkipVerify=true,caCertFile=" + caFile,
+			wantErr: "insecureSkipVerify cannot be combined with a CA certificate",
+		},
+		{
+			name:    "alias with ca pem",
+			env:     map[string]string{"K6_ELASTICSEARCH_CA_CERT_PEM": cluster.certificatePEM()},
+			arg:     "insecureSkipTLSVerify=true",
+			wantErr: "insecureSkipVerify cannot be combined with a CA certificate",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := tt.env
+			if env == nil {
+				env = map[string]string{}
+			}
+			logger, hook := test.NewNullLogger()
+			out, err := New(output.Params{
+				Logger:         logger,
+				ConfigArgument: "url=" + cluster.URL + ",startupRetries=0,maxRetries=0," + tt.arg,
+				Environment:    env,
+			})
+			if err == nil {
+				if err = out.Start(); err == nil {
+					err = out.Stop()
+				}
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			warned := false
+			for _, entry := range hook.AllEntries() {
+				warned = warned || (entry.Level == logrus.WarnLevel && entry.Message ==
+					"Elasticsearch: TLS certificate verification is disabled, do not use this in production")
+			}
+			if !warned {
+				t.Error("got no warning about the disabled certificate verification")
+			}
+		})
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	clientCA, certPEM, keyPEM := newSelfSignedCert(t)
+	cluster := newFakeTLSCluster(t, clientCA)
+	env := map[string]string{"K6_ELASTICSEARCH_CA_CERT_PEM": cluster.certificatePEM()}
+	certFile := writeTempFile(t, "client.crt", certPEM)
+	keyFile := writeTempFile(t, "client.key", keyPEM)
+
+	tests := []struct {
+		name    string
+		arg     string
+		wantErr bool
+	}{
+		{name: "no certificate", wantErr: true},
+		{name: "certificate", arg: "clientCertFile=" + certFile + ",clientKeyFile=" + keyFile},
+		{name: "certificate without key", arg: "clientCertFile=" + certFile, wantErr: true},
+		{name: "key without certificate", arg: "clientKeyFile=" + keyFile, wantErr: true},
+		{name: "key as certificate", arg: "clientCertFile=" + keyFile + ",clientKeyFile=" + keyFile, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := startTLSOutput(t, cluster, env, tt.arg); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want an error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSVersionAndCipherSuites(t *testing.T) {
+	tests := []struct {
+		name             string
+		arg              string
+		wantMinVersion   uint16
+		wantCipherSuites []uint16
+		wantErr          string
+	}{
+		// Go picks its default, which is TLS 1.2
+		{name: "default"},
+		{name: "1.2", arg: "tlsMinVersion=1.2", wantMinVersion: tls.VersionTLS12},
+		{name: "1.3", arg: "tlsMinVersion=1.3", wantMinVersion: tls.VersionTLS13},
+		{
+			name: "cipher suites",
+			arg: "tlsMinVersion=1.2," +
+				"tlsCipherSuites={TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}",
+			wantMinVersion: tls.VersionTLS12,
+			wantCipherSuites: []uint16{
+				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			},
+		},
+		{name: "unknown version", arg: "tlsMinVersion=1.4", wantErr: "tlsMinVersion must be 1.0, 1.1, 1.2 or 1.3"},
+		{name: "unknown cipher suite", arg: "tlsCipherSuites=TLS_RSA_WITH_NOTHING", wantErr: "TLS_RSA_WITH_NOTHING"},
+		{
+			name:    "cipher suites with 1.3",
+			arg:     "tlsMinVersion=1.3,tlsCipherSuites=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			wantErr: "tlsCipherSuites have no effect with tlsMinVersion 1.3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := GetConsolidatedConfig(nil, map[string]string{}, tt.arg)
+			if err == nil {
+				err = config.Validate()
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			logger, _ := test.NewNullLogger()
+			tlsConfig, err := newTLSConfig(config, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transport, err := newHTTPTransport(config, tlsConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig = transport.TLSClientConfig
+			if tlsConfig.MinVersion != tt.wantMinVersion {
+				t.Errorf("got MinVersion %x, want %x", tlsConfig.MinVersion, tt.wantMinVersion)
+			}
+			if !reflect.DeepEqual(tlsConfig.CipherSuites, tt.wantCipherSuites) {
+				t.Errorf("got CipherSuites %v, want %v", tlsConfig.CipherSuites, tt.wantCipherSuites)
+			}
+		})
+	}
+}
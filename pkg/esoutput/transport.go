@@ -0,0 +1,781 @@
+/*
+ * Licensed to Elasticsearch B.V. under one or more contributor
+ * license agreements. See the NOTICE file distributed with
+ * this work for additional information regarding copyright
+ * ownership. Elasticsearch B.V. licenses this file to you under
+ * the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *	http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ * This project is based on a modification of
+ * https://github.com/grafana/xk6-output-prometheus-remote which
+ * is licensed under the Apache 2.0 License.
+ *
+ */
+
+package esoutput
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// timeoutTransport bounds the duration of every request including reading its response body, similar to
+// http.Client.Timeout.
+type timeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	res, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelOnClose calls cancel once the response body has been consumed, e.g. to release the context of a request.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// limitTransport bounds the number of bulk requests in flight, so that many workers don't overwhelm the cluster.
+// The others wait until a request has finished, which includes reading its response body.
+type limitTransport struct {
+	next  http.RoundTripper
+	slots chan struct{}
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, "/_bulk") {
+		return t.next.RoundTrip(req)
+	}
+	select {
+	case t.slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	release := sync.OnceFunc(func() { <-t.slots })
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: release}
+	return res, nil
+}
+
+// opaqueIDTransport sets the X-Opaque-Id header of every bulk request to the id of the test run and a sequence
+// number. Elasticsearch includes it in its slow logs and task list, so that requests can be traced back to a test.
+type opaqueIDTransport struct {
+	next   http.RoundTripper
+	prefix string
+	seq    uint64
+}
+
+func (t *opaqueIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, "/_bulk") {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Opaque-Id", t.prefix+strconv.FormatUint(atomic.AddUint64(&t.seq, 1), 10))
+	return t.next.RoundTrip(req)
+}
+
+// attemptCountTransport counts how often each bulk request of the indexer is sent, so that the retries of the client
+// show up in outputStats.
+type attemptCountTransport struct {
+	next http.RoundTripper
+}
+
+func (t *attemptCountTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if bulk, ok := req.Context().Value(bulkRequestKey{}).(*bulkRequest); ok {
+		atomic.AddInt32(&bulk.attempts, 1)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// bulkParamsTransport adds the query parameters configured in bulkParams to every bulk request.
+type bulkParamsTransport struct {
+	next   http.RoundTripper
+	params url.Values
+}
+
+func newBulkParamsTransport(next http.RoundTripper, params map[string]string) *bulkParamsTransport {
+	values := make(url.Values, len(params))
+	for name, value := range params {
+		values.Set(name, value)
+	}
+	return &bulkParamsTransport{next: next, params: values}
+}
+
+func (t *bulkParamsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, "/_bulk") {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	query := req.URL.Query()
+	for name, values := range t.params {
+		query[name] = values
+	}
+	req.URL.RawQuery = query.Encode()
+	return t.next.RoundTrip(req)
+}
+
+// compatibleWith is the major version requested by compatibilityTransport.
+const compatibleWith = "7"
+
+// compatibilityTransport requests the REST API compatibility of Elasticsearch with version 7 by sending versioned
+// media types, which eases running against clusters during a transition between major versions.
+type compatibilityTransport struct {
+	next http.RoundTripper
+}
+
+func (t *compatibilityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Accept", "application/vnd.elasticsearch+json;compatible-with="+compatibleWith)
+	if req.Body != nil && req.Body != http.NoBody {
+		// bulk bodies are newline-delimited, even though the client labels them as application/json
+		if strings.HasSuffix(req.URL.Path, "/_bulk") {
+			req.Header.Set("Content-Type", "application/vnd.elasticsearch+x-ndjson;compatible-with="+compatibleWith)
+		} else {
+			req.Header.Set("Content-Type", "application/vnd.elasticsearch+json;compatible-with="+compatibleWith)
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// productHeaderTransport marks every response as coming from Elasticsearch. The client refuses to work with a
+// cluster that doesn't send this header, which rules out API-compatible products like OpenSearch as well as proxies
+// that strip the header.
+type productHeaderTransport struct {
+	next http.RoundTripper
+}
+
+func (t *productHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.Header == nil {
+		res.Header = make(http.Header)
+	}
+	if res.Header.Get("X-Elastic-Product") == "" {
+		res.Header.Set("X-Elastic-Product", "Elasticsearch")
+	}
+	return res, nil
+}
+
+// credentialTransport authenticates requests with a password or API key read from a file. If a request is rejected
+// with 401, the file is read again and the request is retried once with the new credential, so that long tests
+// survive the rotation of the secret.
+type credentialTransport struct {
+	next     http.RoundTripper
+	fileName string
+	// authorization returns the value of the Authorization header for a credential
+	authorization func(credential string) string
+	logger        logrus.FieldLogger
+
+	mu     sync.RWMutex
+	header string
+}
+
+// newCredentialTransport returns a credentialTransport for the password or API key file of config, or nil if the
+// credentials are not read from a file.
+func newCredentialTransport(next http.RoundTripper, config Config, logger logrus.FieldLogger) *credentialTransport {
+	t := &credentialTransport{next: next, logger: logger}
+	switch {
+	case config.APIKeyFile.Valid:
+		t.fileName = config.APIKeyFile.String
+		t.authorization = func(apiKey string) string {
+			return "APIKey " + apiKey
+		}
+		t.header = t.authorization(config.APIKey.String)
+	case config.PasswordFile.Valid:
+		t.fileName = config.PasswordFile.String
+		username := config.User.String
+		t.authorization = func(password string) string {
+			req := http.Request{Header: make(http.Header)}
+			req.SetBasicAuth(username, password)
+			return req.Header.Get("Authorization")
+		}
+		t.header = t.authorization(config.Password.String)
+	default:
+		return nil
+	}
+	return t
+}
+
+func (t *credentialTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.RLock()
+	header := t.header
+	t.mu.RUnlock()
+
+	res, err := t.next.RoundTrip(t.authorize(req, header))
+	if err != nil || res.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+		return res, err
+	}
+	if !t.reload(header) {
+		return res, nil
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+
+	t.mu.RLock()
+	header = t.header
+	t.mu.RUnlock()
+	retry := t.authorize(req, header)
+	if req.Body != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(retry)
+}
+
+// authorize returns a copy of req with the Authorization header set to header.
+func (t *credentialTransport) authorize(req *http.Request, header string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", header)
+	return req
+}
+
+// reload reads the credential again after a request with the header used failed. It reports whether the request
+// should be retried, which is the case if the credential has changed in the meantime.
+func (t *credentialTransport) reload(used string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.header != used {
+		// another request already reloaded the credential
+		return true
+	}
+	credential, err := readSecretFile(t.fileName)
+	if err != nil {
+		t.logger.Errorf("Elasticsearch: cannot reload the credentials from %s: %v", t.fileName, err)
+		return false
+	}
+	header := t.authorization(credential)
+	if header == t.header {
+		t.logger.Warnf("Elasticsearch: request rejected with 401 but the credentials in %s have not changed", t.fileName)
+		return false
+	}
+	t.header = header
+	t.logger.Infof("Elasticsearch: reloaded the credentials from %s", t.fileName)
+	return true
+}
+
+// gzipTransport compresses request bodies at the configured level, which the client can't do as it always uses the
+// default level.
+type gzipTransport struct {
+	next  http.RoundTripper
+	level int
+}
+
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" {
+		return t.next.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := gzipBody(body, t.level)
+	if err != nil {
+		return nil, err
+	}
+	req = withBody(req, compressed)
+	req.Header.Set("Content-Encoding", "gzip")
+	return t.next.RoundTrip(req)
+}
+
+// gzipBody compresses body at the given level.
+func gzipBody(body []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compactBulkTransport moves the index of bulk requests whose items all target the same index from the action lines
+// into the path, e.g. with a date-based index name. This saves the repetition of the index name for every document.
+type compactBulkTransport struct {
+	next http.RoundTripper
+	// the index in the path of bulk requests, empty if there is none
+	index string
+}
+
+func (t *compactBulkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || !strings.HasSuffix(req.URL.Path, "/_bulk") || req.Header.Get("Content-Encoding") != "" {
+		return t.next.RoundTrip(req)
+	}
+	prefix := strings.TrimSuffix(req.URL.Path, "/_bulk")
+	if t.index != "" {
+		prefix = strings.TrimSuffix(prefix, "/"+t.index)
+	}
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	compact, index, ok := compactBulk(body)
+	if !ok {
+		compact = body
+	}
+	req = withBody(req, compact)
+	if ok {
+		req.URL.Path = prefix + "/" + index + "/_bulk"
+		req.URL.RawPath = ""
+	}
+	return t.next.RoundTrip(req)
+}
+
+// flushResult is the outcome of a flush of the bulk indexer, recorded by flushResultTransport for failover and
+// the circuit breaker.
+type flushResult struct {
+	// set once a bulk request has been sent, flushes of an empty buffer neither fail nor succeed
+	sent int32
+	// whether the last attempt of the bulk request failed
+	failed int32
+}
+
+type flushResultKey struct{}
+
+// withFlushResult is used in OnFlushStart of the bulk indexer to record the outcome of the flush.
+func withFlushResult(ctx context.Context) context.Context {
+	return context.WithValue(ctx, flushResultKey{}, &flushResult{})
+}
+
+// flushOutcome reports whether a flush has sent a bulk request and whether it failed.
+func flushOutcome(ctx context.Context) (sent, failed bool) {
+	result, ok := ctx.Value(flushResultKey{}).(*flushResult)
+	if !ok {
+		return false, false
+	}
+	return atomic.LoadInt32(&result.sent) == 1, atomic.LoadInt32(&result.failed) == 1
+}
+
+// flushResultTransport records the outcome of bulk requests in the context of their flush. Connection errors and
+// server errors count as failures, the client has retried them already by the time the flush ends.
+type flushResultTransport struct {
+	next http.RoundTripper
+}
+
+func (t *flushResultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if result, ok := req.Context().Value(flushResultKey{}).(*flushResult); ok {
+		atomic.StoreInt32(&result.sent, 1)
+		if err != nil || res.StatusCode >= http.StatusInternalServerError {
+			atomic.StoreInt32(&result.failed, 1)
+		} else {
+			atomic.StoreInt32(&result.failed, 0)
+		}
+	}
+	return res, err
+}
+
+// perIndexBulkTransport sends the items of a bulk request that target different indices in one request per index,
+// so that compactBulkTransport can move the index into the path of each. The responses are merged in the order of
+// the items, which the bulk indexer relies on.
+type perIndexBulkTransport struct {
+	next http.RoundTripper
+	// the gzip level of compressed requests
+	level int
+}
+
+func (t *perIndexBulkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.GetBody == nil || !strings.HasSuffix(req.URL.Path, "/_bulk") {
+		return t.next.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	compressed := req.Header.Get("Content-Encoding") == "gzip"
+	data := body
+	if compressed {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	}
+
+	// the positions of the items by index, in the order of their first item
+	var indices []string
+	positions := make(map[string][]int)
+	items := bulkItems(data)
+	for i, item := range items {
+		index, err := bulkItemIndex(item)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := positions[index]; !ok {
+			indices = append(indices, index)
+		}
+		positions[index] = append(positions[index], i)
+	}
+	if len(indices) <= 1 {
+		return t.next.RoundTrip(withBody(req, body))
+	}
+
+	merged := bulkResult{Items: make([]json.RawMessage, len(items))}
+	for _, index := range indices {
+		group := make([][]byte, 0, len(positions[index]))
+		for _, i := range positions[index] {
+			group = append(group, items[i])
+		}
+		groupBody := bytes.Join(group, nil)
+		if compressed {
+			if groupBody, err = gzipBody(groupBody, t.level); err != nil {
+				return nil, err
+			}
+		}
+		res, err := t.next.RoundTrip(withBody(req, groupBody))
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode >= 300 {
+			// the request fails as a whole, even if other indices have been written
+			return res, nil
+		}
+		var result bulkResult
+		err = json.NewDecoder(res.Body).Decode(&result)
+		_ = res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Items) != len(group) {
+			return nil, fmt.Errorf("bulk response for index %s has %d items instead of %d",
+				index, len(result.Items), len(group))
+		}
+		for i, item := range result.Items {
+			merged.Items[positions[index][i]] = item
+		}
+		merged.Took += result.Took
+		merged.Errors = merged.Errors || result.Errors
+	}
+	return jsonResponse(req, merged)
+}
+
+// bulkItemIndex returns the index in the action line of a bulk item, empty if it uses the index in the path.
+func bulkItemIndex(item []byte) (string, error) {
+	var action map[string]struct {
+		Index string `json:"_index"`
+	}
+	if err := json.Unmarshal(bytes.SplitN(item, []byte("\n"), 2)[0], &action); err != nil {
+		return "", err
+	}
+	for _, meta := range action {
+		return meta.Index, nil
+	}
+	return "", nil
+}
+
+// withBody returns a copy of req with the given body.
+func withBody(req *http.Request, body []byte) *http.Request {
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	return req
+}
+
+// compactBulk removes _index from all action lines of a bulk body if they have the same one, which is returned. It
+// relies on the format of the bulk indexer, which writes every action on one line with _index last.
+func compactBulk(body []byte) ([]byte, string, bool) {
+	const indexKey = `"_index":"`
+	var index []byte
+	compact := make([]byte, 0, len(body))
+	for i, line := range bytes.SplitAfter(body, []byte("\n")) {
+		// every action line is followed by the document
+		if i%2 == 1 || len(line) == 0 {
+			compact = append(compact, line...)
+			continue
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		pos := bytes.LastIndex(line, []byte(indexKey))
+		if pos < 0 || !bytes.HasSuffix(line, []byte(`"}}`)) {
+			return nil, "", false
+		}
+		name := line[pos+len(indexKey) : len(line)-len(`"}}`)]
+		if index == nil {
+			index = name
+		} else if !bytes.Equal(name, index) {
+			return nil, "", false
+		}
+		compact = append(compact, bytes.TrimSuffix(line[:pos], []byte(","))...)
+		compact = append(compact, "}}\n"...)
+	}
+	return compact, string(index), index != nil
+}
+
+// splitBulkTransport retries bulk requests rejected with 413 in halves until they are accepted, e.g. if a proxy has
+// a lower limit than maxBatchBytes. A single document that is still too large is reported as a failed item, so that
+// the other documents are not lost.
+type splitBulkTransport struct {
+	next   http.RoundTripper
+	logger logrus.FieldLogger
+	// the gzip level of compressed requests
+	level int
+	// set once the first request has been split
+	warned int32
+}
+
+func (t *splitBulkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusRequestEntityTooLarge || req.GetBody == nil ||
+		!strings.HasSuffix(req.URL.Path, "/_bulk") {
+		return res, err
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+	if atomic.CompareAndSwapInt32(&t.warned, 0, 1) {
+		t.logger.Warnf("Elasticsearch: a bulk request of %d bytes was rejected as too large, it is retried in "+
+			"smaller requests and maxBatchBytes should be lowered", req.ContentLength)
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	compressed := req.Header.Get("Content-Encoding") == "gzip"
+	var reader io.Reader = body
+	if compressed {
+		if reader, err = gzip.NewReader(body); err != nil {
+			return nil, err
+		}
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return t.split(req, bulkItems(data), compressed)
+}
+
+// split sends the items in two halves and merges the responses.
+func (t *splitBulkTransport) split(req *http.Request, items [][]byte, compressed bool) (*http.Response, error) {
+	if len(items) <= 1 {
+		return tooLargeResponse(req, items)
+	}
+	var results []bulkResult
+	for _, half := range [][][]byte{items[:len(items)/2], items[len(items)/2:]} {
+		res, err := t.send(req, half, compressed)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode >= 300 {
+			// the request fails as a whole, even if the other half has been indexed
+			return res, nil
+		}
+		var result bulkResult
+		err = json.NewDecoder(res.Body).Decode(&result)
+		_ = res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	merged := bulkResult{Took: results[0].Took + results[1].Took, Errors: results[0].Errors || results[1].Errors,
+		Items: append(results[0].Items, results[1].Items...)}
+	return jsonResponse(req, merged)
+}
+
+// send sends the items in one request, which is split again if it is still too large.
+func (t *splitBulkTransport) send(req *http.Request, items [][]byte, compressed bool) (*http.Response, error) {
+	body := bytes.Join(items, nil)
+	if compressed {
+		var err error
+		if body, err = gzipBody(body, t.level); err != nil {
+			return nil, err
+		}
+	}
+	res, err := t.next.RoundTrip(withBody(req, body))
+	if err != nil || res.StatusCode != http.StatusRequestEntityTooLarge {
+		return res, err
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+	return t.split(req, items, compressed)
+}
+
+// bulkResult is the response to a bulk request.
+type bulkResult struct {
+	Took   int64             `json:"took"`
+	Errors bool              `json:"errors"`
+	Items  []json.RawMessage `json:"items"`
+}
+
+// bulkItems splits an NDJSON bulk request body into its items, each consisting of the action and the document line.
+func bulkItems(body []byte) [][]byte {
+	var items [][]byte
+	for len(body) > 0 {
+		end := len(body)
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			if j := bytes.IndexByte(body[i+1:], '\n'); j >= 0 {
+				end = i + 1 + j + 1
+			}
+		}
+		items = append(items, body[:end])
+		body = body[end:]
+	}
+	return items
+}
+
+// tooLargeResponse reports the failure of the only item of a bulk request that is too large on its own.
+func tooLargeResponse(req *http.Request, items [][]byte) (*http.Response, error) {
+	result := bulkResult{Errors: true}
+	for _, item := range items {
+		var meta map[string]json.RawMessage
+		action := bytes.SplitN(item, []byte("\n"), 2)[0]
+		if err := json.Unmarshal(action, &meta); err != nil {
+			return nil, err
+		}
+		for name := range meta {
+			failure, err := json.Marshal(map[string]interface{}{name: map[string]interface{}{
+				"status": http.StatusRequestEntityTooLarge,
+				"error": map[string]string{
+					"type":   "request_entity_too_large",
+					"reason": "the document is too large for the cluster or a proxy in between",
+				},
+			}})
+			if err != nil {
+				return nil, err
+			}
+			result.Items = append(result.Items, failure)
+		}
+	}
+	return jsonResponse(req, result)
+}
+
+// jsonResponse returns a successful response with the given body, as if it came from Elasticsearch.
+func jsonResponse(req *http.Request, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":      []string{"application/json"},
+			"X-Elastic-Product": []string{"Elasticsearch"},
+		},
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}, nil
+}
+
+// dryRunTransport answers all requests itself instead of sending them to a cluster. The bodies of bulk requests are
+// written to out, or logged if out is nil.
+type dryRunTransport struct {
+	mu     sync.Mutex
+	out    io.Writer
+	logger logrus.FieldLogger
+}
+
+func (t *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var reader io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			reader = gz
+		}
+		var err error
+		if body, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+	}
+
+	response := []byte("{}")
+	if strings.HasSuffix(req.URL.Path, "/_bulk") {
+		if err := t.write(body); err != nil {
+			return nil, err
+		}
+		response = bulkResponse(body)
+	} else {
+		t.logger.Debugf("Elasticsearch (dry run): %s %s", req.Method, req.URL.Path)
+	}
+
+	return jsonResponse(req, json.RawMessage(response))
+}
+
+func (t *dryRunTransport) write(body []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.out == nil {
+		t.logger.Infof("Elasticsearch (dry run): bulk request\n%s", body)
+		return nil
+	}
+	_, err := t.out.Write(body)
+	return err
+}
+
+// bulkResponse reports the success of every action of an NDJSON bulk request body, whose lines alternate between
+// the action and the document.
+func bulkResponse(body []byte) []byte {
+	var items []map[string]map[string]int
+	lines := bytes.Split(bytes.TrimSpace(body), []byte("\n"))
+	for i := 0; i < len(lines); i += 2 {
+		var meta map[string]json.RawMessage
+		if err := json.Unmarshal(lines[i], &meta); err != nil {
+			continue
+		}
+		for action := range meta {
+			items = append(items, map[string]map[string]int{action: {"status": http.StatusCreated}})
+		}
+	}
+	response, _ := json.Marshal(map[string]interface{}{"errors": false, "items": items})
+	return response
+}